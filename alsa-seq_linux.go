@@ -0,0 +1,189 @@
+/*
+  MIT License
+  Copyright (c) 2020 Star Brilliant
+  Permission is hereby granted, free of charge, to any person obtaining a copy
+  of this software and associated documentation files (the "Software"), to deal
+  in the Software without restriction, including without limitation the rights
+  to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+  copies of the Software, and to permit persons to whom the Software is
+  furnished to do so, subject to the following conditions:
+  The above copyright notice and this permission notice shall be included in
+  all copies or substantial portions of the Software.
+  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+  AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+  LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+  OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+  SOFTWARE.
+*/
+
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"syscall"
+	"unsafe"
+
+	"github.com/m13253/midimark"
+)
+
+// The ALSA sequencer is used through its kernel interface, so we do not need libasound or cgo.
+// Constants and structure layouts are from <sound/asequencer.h>.
+const (
+	alsaSeqDevice = "/dev/snd/seq"
+
+	alsaSeqClientInfoSize = 188
+	alsaSeqEventSize      = 28
+	// struct snd_seq_port_info has a pointer in the middle
+	alsaSeqPortInfoSize = (96 + unsafe.Sizeof(uintptr(0)) + 64 + 3) &^ 3
+
+	alsaSeqUserClient = 1
+
+	alsaSeqPortCapWrite     = 1 << 1
+	alsaSeqPortCapSubsWrite = 1 << 6
+	alsaSeqPortTypeMIDI     = 1 << 1
+	alsaSeqPortTypeApp      = 1 << 20
+
+	alsaSeqEventLengthMask     = 3 << 2
+	alsaSeqEventLengthVariable = 1 << 2
+
+	alsaSeqEventNoteOn          = 6
+	alsaSeqEventNoteOff         = 7
+	alsaSeqEventController      = 10
+	alsaSeqEventProgramChange   = 11
+	alsaSeqEventPitchBend       = 13
+	alsaSeqEventControl14       = 14
+	alsaSeqEventRegParam        = 16
+	alsaSeqEventPortSubscribed  = 66
+	alsaSeqEventPortUnsubscribe = 67
+)
+
+func alsaSeqIoctl(f *os.File, write, read bool, nr, size uintptr, arg unsafe.Pointer) error {
+	// Encoded as in <asm-generic/ioctl.h>
+	var dir uintptr
+	if write {
+		dir |= 1
+	}
+	if read {
+		dir |= 2
+	}
+	req := dir<<30 | size<<16 | 'S'<<8 | nr
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), req, uintptr(arg))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// listenALSA registers a sequencer client with a virtual input port, which other programs can connect to.
+func (app *application) listenALSA(name string) (serve func(), err error) {
+	f, err := os.OpenFile(alsaSeqDevice, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	var client int32
+	err = alsaSeqIoctl(f, false, true, 0x01, 4, unsafe.Pointer(&client))
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to get ALSA client ID: %v", err)
+	}
+
+	clientInfo := make([]byte, alsaSeqClientInfoSize)
+	binary.NativeEndian.PutUint32(clientInfo[0:], uint32(client))
+	binary.NativeEndian.PutUint32(clientInfo[4:], alsaSeqUserClient)
+	copy(clientInfo[8:8+63], name)
+	err = alsaSeqIoctl(f, true, false, 0x11, alsaSeqClientInfoSize, unsafe.Pointer(&clientInfo[0]))
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to set ALSA client name: %v", err)
+	}
+
+	portInfo := make([]byte, alsaSeqPortInfoSize)
+	portInfo[0] = byte(client)
+	copy(portInfo[2:2+63], name)
+	binary.NativeEndian.PutUint32(portInfo[68:], alsaSeqPortCapWrite|alsaSeqPortCapSubsWrite)
+	binary.NativeEndian.PutUint32(portInfo[72:], alsaSeqPortTypeMIDI|alsaSeqPortTypeApp)
+	binary.NativeEndian.PutUint32(portInfo[76:], 16)
+	err = alsaSeqIoctl(f, true, true, 0x20, alsaSeqPortInfoSize, unsafe.Pointer(&portInfo[0]))
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to create ALSA port: %v", err)
+	}
+	fmt.Printf("Created ALSA sequencer port %d:%d\n", portInfo[0], portInfo[1])
+
+	return func() {
+		defer f.Close()
+		buf := make([]byte, 65536)
+		for {
+			n, err := f.Read(buf)
+			if err != nil {
+				app.debugChanMessage <- debugEventMessage{
+					Message: fmt.Sprintf("ALSA sequencer: %v", err),
+				}
+				return
+			}
+			for offset := 0; offset+alsaSeqEventSize <= n; {
+				event := buf[offset : offset+alsaSeqEventSize]
+				offset += alsaSeqEventSize
+				if event[1]&alsaSeqEventLengthMask == alsaSeqEventLengthVariable {
+					// Such as SysEx, the data follows the event
+					offset += int(binary.NativeEndian.Uint32(event[16:]))
+				}
+				app.dispatchALSAEvent(event)
+			}
+		}
+	}, nil
+}
+
+func (app *application) dispatchALSAEvent(event []byte) {
+	// The event data starts at byte 16
+	data := event[16:]
+	common := midimark.EventCommon{Channel: data[0]&0x0f + 1}
+	param := binary.NativeEndian.Uint32(data[4:])
+	value := int32(binary.NativeEndian.Uint32(data[8:]))
+	controlChange := func(control uint32, value int32) {
+		app.live.Dispatch(&midimark.EventControlChange{EventCommon: common, Control: uint8(control & 0x7f), Value: uint8(value & 0x7f)})
+	}
+
+	switch event[0] {
+	case alsaSeqEventNoteOn:
+		if data[2] == 0 {
+			app.live.Dispatch(&midimark.EventNoteOff{EventCommon: common, Key: midimark.Key(data[1] & 0x7f), Velocity: 0x40})
+		} else {
+			app.live.Dispatch(&midimark.EventNoteOn{EventCommon: common, Key: midimark.Key(data[1] & 0x7f), Velocity: data[2]})
+		}
+	case alsaSeqEventNoteOff:
+		app.live.Dispatch(&midimark.EventNoteOff{EventCommon: common, Key: midimark.Key(data[1] & 0x7f), Velocity: data[2]})
+	case alsaSeqEventController:
+		controlChange(param, value)
+	case alsaSeqEventProgramChange:
+		app.live.Dispatch(&midimark.EventProgramChange{EventCommon: common, Program: uint8(value&0x7f) + 1})
+	case alsaSeqEventPitchBend:
+		app.live.Dispatch(&midimark.EventPitchWheelChange{EventCommon: common, Pitch: int16(value)})
+	case alsaSeqEventControl14:
+		// Split back into MSB and LSB controllers
+		if param < 32 {
+			controlChange(param, value>>7)
+			controlChange(param+32, value)
+		} else {
+			controlChange(param, value)
+		}
+	case alsaSeqEventRegParam:
+		controlChange(0x65, int32(param>>7))
+		controlChange(0x64, int32(param))
+		controlChange(0x06, value>>7)
+		controlChange(0x26, value)
+	case alsaSeqEventPortSubscribed:
+		app.debugChanMessage <- debugEventMessage{
+			Message: fmt.Sprintf("ALSA port %d:%d connected", data[0], data[1]),
+		}
+	case alsaSeqEventPortUnsubscribe:
+		app.debugChanMessage <- debugEventMessage{
+			Message: fmt.Sprintf("ALSA port %d:%d disconnected", data[0], data[1]),
+		}
+	}
+}
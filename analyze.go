@@ -0,0 +1,188 @@
+/*
+  MIT License
+  Copyright (c) 2020 Star Brilliant
+  Permission is hereby granted, free of charge, to any person obtaining a copy
+  of this software and associated documentation files (the "Software"), to deal
+  in the Software without restriction, including without limitation the rights
+  to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+  copies of the Software, and to permit persons to whom the Software is
+  furnished to do so, subject to the following conditions:
+  The above copyright notice and this permission notice shall be included in
+  all copies or substantial portions of the Software.
+  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+  AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+  LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+  OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+  SOFTWARE.
+*/
+
+package main
+
+import (
+	"sort"
+	"time"
+
+	"github.com/m13253/midimark"
+)
+
+type trackStats struct {
+	TrackID        int
+	Name           string
+	Programs       []programChange
+	Channels       []uint8
+	NoteCount      int
+	MinKey         midimark.Key
+	MaxKey         midimark.Key
+	MaxPolyphony   int
+	PitchBendCount int
+	Duration       time.Duration
+}
+
+type programChange struct {
+	Time    time.Duration
+	Channel uint8
+	Program uint8
+}
+
+type polyphonyEdge struct {
+	Time  time.Duration
+	Delta int
+}
+
+func (app *application) analyzeTrack(trackID int, mtrk *midimark.MTrk, tempo *tempoMap) trackStats {
+	stats := trackStats{
+		TrackID: trackID,
+		MinKey:  0x7f,
+	}
+	var channels [16]bool
+	var edges []polyphonyEdge
+	if len(mtrk.Events) != 0 {
+		stats.Duration = tempo.Duration(mtrk.Events[len(mtrk.Events)-1].Common().AbsTick)
+	}
+	for _, event := range mtrk.Events {
+		switch event := event.(type) {
+		case *midimark.MetaEventSequenceTrackName:
+			if stats.Name == "" {
+				stats.Name = event.Text
+			}
+		case *midimark.EventProgramChange:
+			stats.Programs = append(stats.Programs, programChange{
+				Time:    tempo.Duration(event.AbsTick),
+				Channel: event.Channel,
+				Program: event.Program,
+			})
+		case *midimark.EventPitchWheelChange:
+			stats.PitchBendCount++
+		case *midimark.EventNoteOn:
+			stats.NoteCount++
+			if event.Key < stats.MinKey {
+				stats.MinKey = event.Key
+			}
+			if event.Key > stats.MaxKey {
+				stats.MaxKey = event.Key
+			}
+			if event.Channel >= 1 && event.Channel <= 16 {
+				channels[event.Channel-1] = true
+			}
+
+			// Same as connection.Start: notes without a note-off last for one second
+			start := tempo.Duration(event.AbsTick)
+			end := start + 1*time.Second
+			if event.RelatedNoteOff != nil {
+				end = tempo.Duration(event.RelatedNoteOff.AbsTick)
+			}
+			if end > start {
+				edges = append(edges, polyphonyEdge{start, 1}, polyphonyEdge{end, -1})
+			}
+		}
+	}
+	if stats.NoteCount == 0 {
+		stats.MinKey = 0
+	}
+	for i, used := range channels {
+		if used {
+			stats.Channels = append(stats.Channels, uint8(i+1))
+		}
+	}
+
+	// A note ending at the same time as another starts does not overlap it
+	sort.Slice(edges, func(i, j int) bool {
+		return edges[i].Time < edges[j].Time || (edges[i].Time == edges[j].Time && edges[i].Delta < edges[j].Delta)
+	})
+	polyphony := 0
+	for _, edge := range edges {
+		polyphony += edge.Delta
+		if polyphony > stats.MaxPolyphony {
+			stats.MaxPolyphony = polyphony
+		}
+	}
+	return stats
+}
+
+// Merge statistics of tracks with the same ID across all loaded songs,
+// because the configuration file assigns tracks by ID regardless of songs.
+func (app *application) analyzeSongs() []trackStats {
+	var merged []trackStats
+	for _, song := range app.songs {
+		for trackID, mtrk := range song.Sequence.Tracks {
+			if _, ok := song.Skipped[mtrk]; ok {
+				continue
+			}
+			stats := app.analyzeTrack(trackID, mtrk, song.Tempo[mtrk])
+			if stats.NoteCount == 0 {
+				continue
+			}
+			for len(merged) <= trackID {
+				merged = append(merged, trackStats{TrackID: len(merged)})
+			}
+			merged[trackID] = mergeTrackStats(merged[trackID], stats)
+		}
+	}
+	result := merged[:0]
+	for _, stats := range merged {
+		if stats.NoteCount != 0 {
+			result = append(result, stats)
+		}
+	}
+	return result
+}
+
+func mergeTrackStats(a, b trackStats) trackStats {
+	if a.NoteCount == 0 {
+		return b
+	}
+	var channels [16]bool
+	for _, ch := range a.Channels {
+		channels[ch-1] = true
+	}
+	for _, ch := range b.Channels {
+		channels[ch-1] = true
+	}
+	a.Channels = a.Channels[:0:0]
+	for i, used := range channels {
+		if used {
+			a.Channels = append(a.Channels, uint8(i+1))
+		}
+	}
+	if a.Name == "" {
+		a.Name = b.Name
+	}
+	a.Programs = append(a.Programs, b.Programs...)
+	a.PitchBendCount += b.PitchBendCount
+	if b.Duration > a.Duration {
+		a.Duration = b.Duration
+	}
+	a.NoteCount += b.NoteCount
+	if b.MinKey < a.MinKey {
+		a.MinKey = b.MinKey
+	}
+	if b.MaxKey > a.MaxKey {
+		a.MaxKey = b.MaxKey
+	}
+	if b.MaxPolyphony > a.MaxPolyphony {
+		a.MaxPolyphony = b.MaxPolyphony
+	}
+	return a
+}
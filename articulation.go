@@ -0,0 +1,68 @@
+/*
+  MIT License
+  Copyright (c) 2020 Star Brilliant
+  Permission is hereby granted, free of charge, to any person obtaining a copy
+  of this software and associated documentation files (the "Software"), to deal
+  in the Software without restriction, including without limitation the rights
+  to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+  copies of the Software, and to permit persons to whom the Software is
+  furnished to do so, subject to the following conditions:
+  The above copyright notice and this permission notice shall be included in
+  all copies or substantial portions of the Software.
+  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+  AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+  LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+  OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+  SOFTWARE.
+*/
+
+package main
+
+import (
+	"time"
+)
+
+// The beeper has no volume control, so note velocity changes how notes are articulated instead.
+// A zero velocity threshold disables that rule.
+type articulationConfig struct {
+	// Notes quieter than this are not played
+	MinVelocity uint8
+	// Notes quieter than this are shortened to StaccatoLength of their length
+	StaccatoVelocity uint8
+	StaccatoLength   float64
+	// Notes at least this loud start with a short blip one octave higher
+	AccentVelocity uint8
+	AccentLength   time.Duration
+}
+
+func newArticulationConfig() articulationConfig {
+	return articulationConfig{
+		StaccatoLength: 0.5,
+		AccentLength:   15 * time.Millisecond,
+	}
+}
+
+// Returns false if the note is too quiet to be played.
+func (conf *articulationConfig) Length(velocity uint8, length time.Duration) (time.Duration, bool) {
+	if velocity < conf.MinVelocity {
+		return 0, false
+	}
+	if velocity < conf.StaccatoVelocity {
+		length = time.Duration(float64(length) * conf.StaccatoLength)
+	}
+	return length, true
+}
+
+func (conf *articulationConfig) Tones(velocity uint8, frequency float64, length time.Duration, caps instrumentCapabilities) []tone {
+	accent := conf.AccentLength.Truncate(time.Millisecond)
+	if conf.AccentVelocity == 0 || velocity < conf.AccentVelocity || accent <= 0 || length <= accent {
+		return []tone{{Frequency: frequency, Length: length}}
+	}
+	accentFrequency := frequency * 2
+	if accentFrequency > caps.MaxFrequency {
+		accentFrequency = frequency
+	}
+	return []tone{{Frequency: accentFrequency, Length: accent}, {Frequency: frequency, Length: length - accent}}
+}
@@ -22,12 +22,15 @@ package main
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
 	"io"
+	"math"
 	"net"
 	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/m13253/midimark"
@@ -36,11 +39,29 @@ import (
 
 const DefaultTimeout = 1 * time.Minute
 
+const keepAliveInterval = 15 * time.Second
+
+// Lookahead needs a fresher estimate of the latency than keeping alive does.
+const latencyProbeInterval = 2 * time.Second
+
+// Notes later than this are dropped rather than played out of time, for example after reconnecting.
+const maxNoteLateness = 1 * time.Second
+
+var errSessionClosed = errors.New("SSH session closed")
+
 type connection struct {
 	AppConf    *config
 	ConnConf   *connConfig
 	KnownHosts ssh.HostKeyCallback
-	Songs      []song
+	Jumps      *jumpDialer
+	Queue      *songQueue
+	Status     *connectionStatus
+	EventLog   *eventLog
+	Replay     []replayNote
+	Live       <-chan midimark.Event
+	Instrument Instrument
+	// One-way network latency in nanoseconds, estimated from the keepalive replies
+	latency atomic.Int64
 
 	DebugChanMessage chan<- debugEventMessage
 	DebugChanNote    chan<- debugEventNote
@@ -49,20 +70,136 @@ type connection struct {
 }
 
 type note struct {
-	SongID    int
-	Event     midimark.Event
-	MTrk      *midimark.MTrk
-	SongStart time.Duration
+	Song    *song
+	TrackID int
+	Event   midimark.Event
+	MTrk    *midimark.MTrk
 }
 
 func (c *connection) Start() error {
-	notes := c.loadNotes()
+	addr := c.ConnConf.address()
+
+	c.Instrument = c.newInstrument(addr)
+	err := c.connect(addr)
+	if err != nil {
+		c.OnConnected.Done()
+		<-c.StartTime
+		return err
+	}
+	defer func() {
+		c.Instrument.Close()
+	}()
+	c.Status.SetState(connStateConnected)
+	c.OnConnected.Done()
+
+	startTime, ok := <-c.StartTime
+	if !ok {
+		panic("internal error: start time is invalid")
+	}
+
+	if c.Replay != nil {
+		err := c.replay(startTime)
+		if err != nil {
+			return err
+		}
+	}
+	if c.Live != nil {
+		controllers := newControllerState()
+		c.Status.SetSong(liveSongName)
+		err := c.playLive(&controllers)
+		for err != nil && c.AppConf.ReconnectDelay != 0 {
+			c.reconnect(addr, err)
+			c.Status.SetSong(liveSongName)
+			err = c.playLive(&controllers)
+		}
+		c.Status.SetSong("")
+		if err != nil {
+			return err
+		}
+	}
+	for i := 0; ; i++ {
+		item, ok := c.Queue.Get(i)
+		if !ok {
+			break
+		}
+		c.Status.SetSong(item.Song.Filename)
+		err := c.playSong(i, item, 0)
+		for err != nil && c.AppConf.ReconnectDelay != 0 {
+			lostAt := c.Queue.Elapsed() - item.Start
+			c.reconnect(addr, err)
+			c.Status.SetSong(item.Song.Filename)
+			// Notes missed while reconnecting are dropped for being too late
+			err = c.playSong(i, item, lostAt)
+		}
+		c.Status.SetSong("")
+		if err != nil {
+			return err
+		}
+	}
+
+	c.DebugChanMessage <- debugEventMessage{
+		Hostname: c.ConnConf.Name,
+		Message:  "Closing connection",
+	}
+	c.Status.SetState(connStateClosed)
+	return nil
+}
 
-	port := c.ConnConf.Port
+// Returns where the connection plays, for messages and SSH.
+func (conf *connConfig) address() string {
+	if conf.Driver == driverLocal {
+		return conf.Output
+	}
+	port := conf.Port
 	if port == "" {
 		port = "22"
 	}
-	addr := net.JoinHostPort(c.ConnConf.Host, port)
+	return net.JoinHostPort(conf.Host, port)
+}
+
+func (c *connection) connect(addr string) error {
+	if c.AppConf.DryRun {
+		c.DebugChanMessage <- debugEventMessage{
+			Hostname: c.ConnConf.Name,
+			Message:  fmt.Sprintf("Dry run, not connecting to %s", addr),
+		}
+	}
+	err := c.Instrument.Connect()
+	if err != nil {
+		return err
+	}
+	if !c.AppConf.DryRun {
+		c.DebugChanMessage <- debugEventMessage{
+			Hostname: c.ConnConf.Name,
+			Message:  fmt.Sprintf("Connected to %s", addr),
+		}
+	}
+	return nil
+}
+
+// Keep trying until connected again.
+func (c *connection) reconnect(addr string, cause error) {
+	c.Instrument.Close()
+	for {
+		c.Status.ConnectionFailed(cause)
+		c.DebugChanMessage <- debugEventMessage{
+			Hostname: c.ConnConf.Name,
+			Message:  fmt.Sprintf("Connection lost: %v, reconnecting in %v", cause, c.AppConf.ReconnectDelay),
+		}
+		c.Status.SetState(connStateConnecting)
+		time.Sleep(c.AppConf.ReconnectDelay)
+		err := c.connect(addr)
+		if err == nil {
+			c.Status.Reconnected()
+			return
+		}
+		cause = err
+	}
+}
+
+// openShell opens as many shells as the Sessions option over one SSH connection.
+// The returned cleanup function closes the shells and waits for their output to finish.
+func (c *connection) openShell(addr string) (stdins []io.Writer, cleanup func(), err error) {
 	sshConf := &ssh.ClientConfig{
 		User: c.ConnConf.Username,
 		Auth: []ssh.AuthMethod{
@@ -84,207 +221,295 @@ func (c *connection) Start() error {
 
 	c.DebugChanMessage <- debugEventMessage{
 		Hostname: c.ConnConf.Name,
-		Message:  fmt.Sprintf("Connecting to %s", addr),
+		Message:  fmt.Sprintf("Connecting to %s%s", addr, jumpVia(c.ConnConf.Jumps)),
 	}
 
-	sshClient, err := ssh.Dial("tcp", addr, sshConf)
+	sshClient, releaseJumps, err := c.Jumps.Dial(c.ConnConf, sshConf)
 	if err != nil {
-		c.OnConnected.Done()
-		<-c.StartTime
-		return err
+		return nil, nil, err
+	}
+
+	var shellCleanups []func()
+	closeShells := func() {
+		for _, cleanup := range shellCleanups {
+			cleanup()
+		}
 	}
-	defer sshClient.Close()
+	for i := 0; i < c.ConnConf.Sessions; i++ {
+		stdin, cleanup, err := c.startShell(sshClient)
+		if err != nil {
+			closeShells()
+			sshClient.Close()
+			releaseJumps()
+			return nil, nil, err
+		}
+		stdins = append(stdins, stdin)
+		shellCleanups = append(shellCleanups, cleanup)
+	}
+	stopKeepAlive := c.keepAlive(sshClient)
+
+	cleanup = func() {
+		closeShells()
+		stopKeepAlive()
+		sshClient.Close()
+		releaseJumps()
+	}
+	return stdins, cleanup, nil
+}
 
+// Starts a shell in a new session of the SSH connection.
+func (c *connection) startShell(sshClient *ssh.Client) (stdin io.Writer, cleanup func(), err error) {
 	sshSession, err := sshClient.NewSession()
 	if err != nil {
-		c.OnConnected.Done()
-		<-c.StartTime
-		return err
+		return nil, nil, err
 	}
-	defer sshSession.Close()
 
 	var stdoutFinished sync.WaitGroup
 	stdoutFinished.Add(1)
 	stdout := c.pipeToStdout(&stdoutFinished)
-	defer stdoutFinished.Wait()
-	defer stdout.Close()
 	sshSession.Stdout = stdout
 	sshSession.Stderr = stdout
 
-	var stdin *io.PipeWriter
-	sshSession.Stdin, stdin = io.Pipe()
+	stdinReader, stdinPipe := io.Pipe()
+	sshSession.Stdin = stdinReader
 
 	err = sshSession.Shell()
 	if err != nil {
-		stdin.Close()
-		c.OnConnected.Done()
-		<-c.StartTime
-		return err
+		stdinPipe.Close()
+		stdout.Close()
+		stdoutFinished.Wait()
+		sshSession.Close()
+		return nil, nil, err
 	}
-	defer sshSession.Wait()
-	defer stdin.Close()
 
-	c.DebugChanMessage <- debugEventMessage{
-		Hostname: c.ConnConf.Name,
-		Message:  fmt.Sprintf("Connected to %s", addr),
-	}
-	c.OnConnected.Done()
+	// If the session ends early, writing to stdin fails instead of blocking forever
+	sessionDone := make(chan struct{})
+	go func() {
+		err := sshSession.Wait()
+		if err == nil {
+			err = errSessionClosed
+		}
+		stdinReader.CloseWithError(err)
+		close(sessionDone)
+	}()
 
-	startTime, ok := <-c.StartTime
-	if !ok {
-		panic("internal error: start time is invalid")
+	cleanup = func() {
+		stdinPipe.Close()
+		<-sessionDone
+		stdout.Close()
+		stdoutFinished.Wait()
+		sshSession.Close()
 	}
+	return stdinPipe, cleanup, nil
+}
+
+// A dead network does not always close the connection, so we ask the router to reply from time to time.
+// The time it takes to reply is also our measure of the network latency.
+func (c *connection) keepAlive(sshClient *ssh.Client) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		interval := keepAliveInterval
+		if c.ConnConf.Lookahead > 0 {
+			interval = latencyProbeInterval
+		}
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			replied := make(chan error, 1)
+			requested := time.Now()
+			go func() {
+				_, _, err := sshClient.SendRequest("keepalive@openssh.com", true, nil)
+				replied <- err
+			}()
+			select {
+			case <-done:
+				return
+			case err := <-replied:
+				if err != nil {
+					sshClient.Close()
+					return
+				}
+				c.measureLatency(time.Since(requested))
+			case <-time.After(DefaultTimeout):
+				sshClient.Close()
+				return
+			}
 
-	currentRPN := uint16(0x0000)
-	currentData := uint16(0xffff)
-	RPN := [3]uint16{
-		0x00: 0x0100, // Pitch wheel range: (value>>7)+(value&0x7f)/100 semitones
-		0x01: 0x2000, // Fine tuning: (value-0x2000)/8192 semitones
-		0x02: 0x2000, // Coarse tuning: (value>>7)-0x40 semitones
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	return func() {
+		close(done)
 	}
-	pitchWheel := [16]int16{0}
+}
 
-	for _, note := range notes {
+// Notes before resumeAt are not sent again, but controller events are still followed.
+func (c *connection) playSong(queueID int, item scheduledSong, resumeAt time.Duration) error {
+	caps := c.Instrument.Capabilities()
+	// MIDI controller states are reset at the beginning of each song
+	controllers := newControllerState()
+	// Portamento glides from the previous note on this connection
+	var lastPitch float64
+	hasLastPitch := false
+	var batch noteBatch
+
+	for _, note := range c.loadNotes(item) {
+		song := note.Song
 		songAbsTick := note.Event.Common().AbsTick
-		songAbsTime := note.MTrk.ConvertAbsTickToDuration(songAbsTick)
-		startAbsTime := note.SongStart + songAbsTime
-		durationToSleep := startAbsTime - time.Now().Sub(startTime)
-		time.Sleep(durationToSleep)
+		songAbsTime := song.tickToDuration(note.MTrk, songAbsTick)
 
 		switch event := note.Event.(type) {
 		case *midimark.EventNoteOn:
-			var frequency float64
+			var frequency, pitch float64
 
 			if event.Channel != 10 {
-				pitchWheelRange := float64(RPN[0]>>7) + float64(RPN[0]&0x7f)/100
-				pitchWheelValue := float64(pitchWheel[event.Channel-1]) * float64(pitchWheelRange) / 8192
-				fineTuning := (float64(RPN[1]) - 0x2000) / 8192
-				coarseTuning := float64(RPN[2]>>7) - 0x40
-
-				pitch := float64(event.Key) + pitchWheelValue + fineTuning + coarseTuning
-				frequency = midiNoteToHertz(pitch)
+				pitch = controllers.Pitch(event, song.Transpose)
+				var substituted bool
+				frequency, substituted = midiNoteToHertz(pitch, caps)
+				if substituted {
+					c.Status.FrequencySubstituted()
+				}
 			} else {
-				frequency = 20
+				frequency = caps.MinFrequency
 			}
 
 			var length time.Duration
-			if event.RelatedNoteOff != nil {
-				songAbsTickOff := event.RelatedNoteOff.AbsTick
-				songAbsTimeOff := note.MTrk.ConvertAbsTickToDuration(songAbsTickOff)
+			if songAbsTimeOff, ok := song.noteOffTime(event); ok {
 				length = songAbsTimeOff - songAbsTime
 			} else {
 				length = 1 * time.Second
 			}
+			if songAbsTime < resumeAt {
+				continue
+			}
+			length, ok := c.ConnConf.Articulation.Length(event.Velocity, length)
+			if !ok {
+				c.Status.NoteDropped(dropReasonQuiet)
+				continue
+			}
 			if length <= 0 {
+				c.Status.NoteDropped(dropReasonEmpty)
 				continue
 			}
 
-			var lengthMilli int64
 			if event.Channel != 10 {
-				lengthMilli = int64((length + 999999*time.Nanosecond) / time.Millisecond)
+				length = time.Duration(toneMilli(max(length, caps.MinLength))) * time.Millisecond
 			} else {
-				lengthMilli = 1
+				length = caps.MinLength
 			}
 
-			_, err := fmt.Fprintf(stdin, ":beep as-value frequency=%.0f length=%dms;\n", frequency, lengthMilli)
-			if err != nil {
-				return err
-			}
-			select {
-			case c.DebugChanNote <- debugEventNote{
-				Hostname:    c.ConnConf.Name,
-				Frequency:   frequency,
-				LengthMilli: lengthMilli,
-			}:
-			default:
-			}
-		case *midimark.EventPitchWheelChange:
-			pitchWheel[event.Channel-1] = event.Pitch
-		case *midimark.EventControlChange:
-			switch event.Control {
-			case 0x06: // Data entry MSB
-				currentData = uint16(event.Value)<<7 | (currentData & 0x407f)
-				if (currentData&0xc000) == 0 && currentRPN <= 2 {
-					RPN[currentRPN] = currentData
-				}
-			case 0x26: // Data entry LSB
-				currentData = (currentData & 0xbf80) | uint16(event.Value)
-				if (currentData&0xc000) == 0 && currentRPN <= 2 {
-					RPN[currentRPN] = currentData
-				}
-			case 0x60: // Data +1
-				if currentRPN <= 2 {
-					RPN[currentRPN] = (RPN[currentRPN] + 1) & 0x3fff
+			tones := c.ConnConf.Articulation.Tones(event.Velocity, frequency, length, caps)
+			if event.Channel != 10 {
+				if glide := controllers.PortamentoTime(event.Channel); glide > 0 && hasLastPitch {
+					if glideTones := glideTones(lastPitch, pitch, glide, c.ConnConf.GlideStep, length, caps); glideTones != nil {
+						tones = glideTones
+					}
 				}
-			case 0x61: // Data -1
-				if currentRPN <= 2 {
-					RPN[currentRPN] = (RPN[currentRPN] - 1) & 0x3fff
+				lastPitch, hasLastPitch = pitch, true
+			}
+
+			if !batch.Fits(songAbsTime, c.ConnConf.Lookahead) {
+				played, err := c.sendBatch(queueID, item, &batch)
+				if !played || err != nil {
+					return err
 				}
-			case 0x64: // RPN LSB
-				currentRPN = (currentRPN & 0xbf80) | uint16(event.Value)
-			case 0x65: // RPN MSB
-				currentRPN = uint16(event.Value)<<7 | (currentRPN & 0x407f)
+				batch.Notes = batch.Notes[:0]
 			}
+			batch.Notes = append(batch.Notes, batchedNote{
+				Song:        song,
+				TrackID:     note.TrackID,
+				Event:       event,
+				Time:        songAbsTime,
+				Frequency:   frequency,
+				Pitch:       pitch,
+				LengthMilli: toneMilli(length),
+				Tones:       tones,
+			})
+		default:
+			controllers.Follow(event)
 		}
 	}
-
-	c.DebugChanMessage <- debugEventMessage{
-		Hostname: c.ConnConf.Name,
-		Message:  "Closing connection",
+	if len(batch.Notes) == 0 {
+		return nil
+	}
+	played, err := c.sendBatch(queueID, item, &batch)
+	if !played || err != nil {
+		return err
 	}
+	// Stay until the device has started the last note, before the shell may be closed
+	c.Queue.WaitUntil(queueID, batch.Notes[len(batch.Notes)-1].Time)
 	return nil
 }
 
-func (c *connection) loadNotes() []note {
-	songStart := time.Duration(0)
+// Returns the name of the nearest key, for display only.
+func noteName(event *midimark.EventNoteOn, pitch float64) string {
+	if event.Channel == 10 {
+		return "Drum"
+	}
+	key := math.Round(pitch)
+	if key < 0 || key > 127 {
+		return fmt.Sprintf("%.0f", key)
+	}
+	return midimark.Key(key).String()
+}
+
+func (c *connection) loadNotes(item scheduledSong) []note {
+	song := item.Song
+	tracks := song.tracksFor(c.ConnConf)
+	tracksDefined := song.tracksDefined(c.AppConf)
 	var notes []note
-	for songID, song := range c.Songs {
-		for trackID, mtrk := range song.Sequence.Tracks {
-			if _, ok := c.ConnConf.Tracks.Map[uint16(trackID)]; !ok {
-				if !c.ConnConf.Tracks.OtherTracks {
-					continue
-				}
-				if _, ok := c.AppConf.TracksDefined[uint16(trackID)]; ok {
-					continue
-				}
+	for trackID, mtrk := range song.Sequence.Tracks {
+		if _, ok := song.Skipped[mtrk]; ok {
+			continue
+		}
+		if _, ok := tracks.Map[uint16(trackID)]; !ok {
+			if !tracks.OtherTracks {
+				continue
 			}
-			for _, event := range mtrk.Events {
-				switch event := event.(type) {
-				case *midimark.EventNoteOn, *midimark.EventPitchWheelChange:
-				case *midimark.EventControlChange:
-					switch event.Control {
-					case 0x06: // Data entry MSB
-					case 0x26: // Data entry LSB
-					case 0x60: // Data +1
-					case 0x61: // Data -1
-					case 0x64: // RPN LSB
-					case 0x65: // RPN MSB
-					default:
-						continue
-					}
+			if _, ok := tracksDefined[uint16(trackID)]; ok {
+				continue
+			}
+		}
+		for _, event := range mtrk.Events {
+			switch event := event.(type) {
+			case *midimark.EventNoteOn, *midimark.EventPitchWheelChange:
+			case *midimark.EventControlChange:
+				switch event.Control {
+				case 0x05: // Portamento time
+				case 0x06: // Data entry MSB
+				case 0x26: // Data entry LSB
+				case 0x60: // Data +1
+				case 0x61: // Data -1
+				case 0x64: // RPN LSB
+				case 0x65: // RPN MSB
+				case 0x41: // Portamento on/off
 				default:
 					continue
 				}
-				notes = append(notes, note{
-					SongID:    songID,
-					Event:     event,
-					MTrk:      mtrk,
-					SongStart: songStart,
-				})
+			default:
+				continue
 			}
+			notes = append(notes, note{
+				Song:    song,
+				TrackID: trackID,
+				Event:   event,
+				MTrk:    mtrk,
+			})
 		}
-		songStart += song.Duration
+	}
+	// Sorted by time instead of ticks, because format 2 patterns have their own tempo
+	times := make(map[midimark.Event]time.Duration, len(notes))
+	for _, n := range notes {
+		times[n.Event] = song.Tempo.Duration(n.MTrk, n.Event.Common().AbsTick)
 	}
 	sort.Slice(notes, func(i, j int) bool {
-		if notes[i].SongID < notes[j].SongID {
-			return true
-		}
-		if notes[i].SongID == notes[j].SongID {
-			commonI, commonJ := notes[i].Event.Common(), notes[j].Event.Common()
-			return commonI.AbsTick < commonJ.AbsTick ||
-				(commonI.AbsTick == commonJ.AbsTick && commonI.FilePosition == commonJ.FilePosition)
-		}
-		return false
+		timeI, timeJ := times[notes[i].Event], times[notes[j].Event]
+		return timeI < timeJ ||
+			(timeI == timeJ && notes[i].Event.Common().FilePosition < notes[j].Event.Common().FilePosition)
 	})
 	return notes
 }
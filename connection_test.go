@@ -0,0 +1,336 @@
+/*
+  MIT License
+  Copyright (c) 2020 Star Brilliant
+  Permission is hereby granted, free of charge, to any person obtaining a copy
+  of this software and associated documentation files (the "Software"), to deal
+  in the Software without restriction, including without limitation the rights
+  to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+  copies of the Software, and to permit persons to whom the Software is
+  furnished to do so, subject to the following conditions:
+  The above copyright notice and this permission notice shall be included in
+  all copies or substantial portions of the Software.
+  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+  AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+  LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+  OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+  SOFTWARE.
+*/
+
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"fmt"
+	"net"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/m13253/MikroTiChestra/fakerouteros"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// startFakeRouter serves a fake RouterOS on a random local port until the test ends.
+func startFakeRouter(t *testing.T) (*fakerouteros.Server, string) {
+	t.Helper()
+	return startFakeRouterConfig(t, fakerouteros.Config{})
+}
+
+// startFakeRouterConfig is startFakeRouter with more options, user "admin" logs in with "secret".
+func startFakeRouterConfig(t *testing.T, conf fakerouteros.Config) (*fakerouteros.Server, string) {
+	t.Helper()
+	conf.Users = map[string]string{"admin": "secret"}
+	router, err := fakerouteros.NewServer(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go router.Serve(l)
+	t.Cleanup(func() {
+		router.Close()
+	})
+	return router, l.Addr().String()
+}
+
+// writeKnownHosts writes a known_hosts file with the key for addr.
+func writeKnownHosts(t *testing.T, addr string, key ssh.PublicKey) string {
+	t.Helper()
+	filename := filepath.Join(t.TempDir(), "known_hosts")
+	err := os.WriteFile(filename, []byte(knownhosts.Line([]string{knownhosts.Normalize(addr)}, key)+"\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+// loadTestConfig parses a configuration file with a single connection to addr.
+func loadTestConfig(t *testing.T, knownHosts, addr, password string) *config {
+	t.Helper()
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := &config{ConfigFile: filepath.Join(t.TempDir(), "MikroTiChestra.conf")}
+	err = os.WriteFile(conf.ConfigFile, []byte(fmt.Sprintf(
+		"KnownHosts\t%s\nHostKeyPolicy\tstrict\nInitialDelay\t200ms\nConnection\tA\nTrack\t\t0 Other\nHost\t\t%s\nPort\t\t%s\nUsername\tadmin\nPassword\t%s\n",
+		knownHosts, host, port, password)), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = conf.parseConfigFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conf
+}
+
+// runTestConnection plays the songs on the only connection of conf, like play does,
+// and returns its status, when the playback started and the error from the connection.
+func runTestConnection(t *testing.T, conf *config, songs ...*song) (*connectionStatus, time.Time, error) {
+	t.Helper()
+	hostKeys, err := newHostKeyStore(conf.KnownHosts, conf.HostKeyPolicy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	queue := newSongQueue(songs, false, false)
+	queue.Close()
+
+	messages := make(chan debugEventMessage)
+	notes := make(chan debugEventNote)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case msg := <-messages:
+				t.Logf("[%s] %s", msg.Hostname, msg.Message)
+				if msg.OnFinished != nil {
+					msg.OnFinished.Done()
+				}
+			case <-notes:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	var onConnected sync.WaitGroup
+	onConnected.Add(1)
+	startTimeChan := make(chan time.Time, 1)
+	connConf := conf.Connections[0]
+	c := &connection{
+		AppConf:          conf,
+		ConnConf:         connConf,
+		KnownHosts:       hostKeys.Callback(connConf),
+		Jumps:            newJumpDialer(hostKeys, conf.ShareProxyJump),
+		Queue:            queue,
+		Status:           newConnectionStatus(connConf.Name),
+		DebugChanMessage: messages,
+		DebugChanNote:    notes,
+		OnConnected:      &onConnected,
+		StartTime:        startTimeChan,
+	}
+	result := make(chan error, 1)
+	go func() {
+		result <- c.Start()
+	}()
+
+	onConnected.Wait()
+	startTime := time.Now().Add(conf.InitialDelay)
+	queue.SetStartTime(startTime)
+	startTimeChan <- startTime
+	close(startTimeChan)
+	select {
+	case err = <-result:
+	case <-time.After(30 * time.Second):
+		t.Fatal("connection did not finish")
+	}
+	return c.Status, startTime, err
+}
+
+func TestConnectionBeepTiming(t *testing.T) {
+	const tolerance = 50 * time.Millisecond
+	router, addr := startFakeRouter(t)
+	conf := loadTestConfig(t, writeKnownHosts(t, addr, router.HostKey()), addr, "secret")
+	app := &application{conf: *conf}
+	// C4, E4 and G4 every half second at 120 beats per minute, each a quarter of a second long
+	s := loadTestSong(t, app, newPlaylistEntry("test.mid"), smfFile(0, 96, smfTrack(smfEvents(
+		smfNote(0, 48, 60),
+		smfNote(96, 48, 64),
+		smfNote(192, 48, 67),
+	)...)))
+
+	_, startTime, err := runTestConnection(t, conf, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	beeps := router.Beeps()
+	want := []struct {
+		frequency float64
+		at        time.Duration
+	}{
+		{262, 0},
+		{330, 500 * time.Millisecond},
+		{392, time.Second},
+	}
+	if len(beeps) != len(want) {
+		t.Fatalf("got %d beeps, want %d: %+v", len(beeps), len(want), beeps)
+	}
+	if late := beeps[0].Time.Sub(startTime); late < -tolerance || late > tolerance {
+		t.Errorf("first beep is %v after the start time", late)
+	}
+	for i, beep := range beeps {
+		if beep.Frequency != want[i].frequency || beep.Length != 250*time.Millisecond {
+			t.Errorf("beep %d: got %v Hz for %v, want %v Hz for 250ms", i, beep.Frequency, beep.Length, want[i].frequency)
+		}
+		at := beep.Time.Sub(beeps[0].Time)
+		if d := at - want[i].at; d < -tolerance || d > tolerance {
+			t.Errorf("beep %d: played at %v, want %v within %v", i, at, want[i].at, tolerance)
+		}
+	}
+}
+
+func TestConnectionHostKeyMismatch(t *testing.T) {
+	router, addr := startFakeRouter(t)
+	// Another router has a different key
+	other, _ := startFakeRouter(t)
+	conf := loadTestConfig(t, writeKnownHosts(t, addr, other.HostKey()), addr, "secret")
+
+	_, _, err := runTestConnection(t, conf)
+	if err == nil {
+		t.Fatal("connected although the host key does not match known_hosts")
+	}
+	if !strings.Contains(err.Error(), "key mismatch") {
+		t.Errorf("got error %v, want a key mismatch", err)
+	}
+	if len(router.Commands()) != 0 {
+		t.Errorf("router received %+v", router.Commands())
+	}
+}
+
+func TestConnectionUnknownHostStrict(t *testing.T) {
+	router, addr := startFakeRouter(t)
+	conf := loadTestConfig(t, writeKnownHosts(t, "192.0.2.1:22", router.HostKey()), addr, "secret")
+
+	_, _, err := runTestConnection(t, conf)
+	if err == nil || !isUnknownHost(err) {
+		t.Errorf("got error %v, want an unknown host", err)
+	}
+	// The strict policy does not add the key
+	known, err := os.ReadFile(conf.KnownHosts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(known), knownhosts.Normalize(addr)) {
+		t.Errorf("%s was added to known_hosts", addr)
+	}
+}
+
+func TestConnectionAuthFailure(t *testing.T) {
+	router, addr := startFakeRouter(t)
+	conf := loadTestConfig(t, writeKnownHosts(t, addr, router.HostKey()), addr, "wrong")
+
+	_, _, err := runTestConnection(t, conf)
+	if err == nil {
+		t.Fatal("connected with a wrong password")
+	}
+	if !strings.Contains(err.Error(), "unable to authenticate") {
+		t.Errorf("got error %v, want an authentication failure", err)
+	}
+	if len(router.Commands()) != 0 {
+		t.Errorf("router received %+v", router.Commands())
+	}
+}
+
+func TestConnectionReconnect(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostKey, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The router restarts after the first beep, with the same address and host key
+	restarted := make(chan struct{})
+	var once sync.Once
+	var router *fakerouteros.Server
+	var addr string
+	router, addr = startFakeRouterConfig(t, fakerouteros.Config{
+		HostKey: hostKey,
+		OnCommand: func(cmd fakerouteros.Command) {
+			if len(cmd.Beeps) == 0 {
+				return
+			}
+			once.Do(func() {
+				go func() {
+					defer close(restarted)
+					router.Close()
+					time.Sleep(200 * time.Millisecond)
+					again, err := fakerouteros.NewServer(fakerouteros.Config{
+						Users:   map[string]string{"admin": "secret"},
+						HostKey: hostKey,
+					})
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					l, err := net.Listen("tcp", addr)
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					go again.Serve(l)
+					t.Cleanup(func() {
+						again.Close()
+					})
+				}()
+			})
+		},
+	})
+	conf := loadTestConfig(t, writeKnownHosts(t, addr, hostKey.PublicKey()), addr, "secret")
+	conf.ReconnectDelay = 100 * time.Millisecond
+	app := &application{conf: *conf}
+	// A note every half second for 3 seconds
+	var events []smfEvent
+	for i := int64(0); i < 6; i++ {
+		events = append(events, smfNote(i*96, 48, 60+byte(i))...)
+	}
+	s := loadTestSong(t, app, newPlaylistEntry("test.mid"), smfFile(0, 96, smfTrack(events...)))
+
+	status, _, err := runTestConnection(t, conf, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-restarted
+	info := status.Info()
+	if info.Reconnects != 1 || info.Failures < 1 {
+		t.Errorf("got %d reconnects and %d failures, want 1 reconnect after at least 1 failure", info.Reconnects, info.Failures)
+	}
+
+	app.statuses = []*connectionStatus{status}
+	app.queue = newSongQueue(nil, false, false)
+	w := httptest.NewRecorder()
+	app.handleHTTPMetrics(w, httptest.NewRequest("GET", "/metrics", nil))
+	metrics := w.Body.String()
+	for _, want := range []string{
+		"mikrotichestra_ssh_reconnects_total{connection=\"A\"} 1\n",
+		fmt.Sprintf("mikrotichestra_connection_failures_total{connection=\"A\"} %d\n", info.Failures),
+	} {
+		if !strings.Contains(metrics, want) {
+			t.Errorf("metrics do not contain %q:\n%s", want, metrics)
+		}
+	}
+}
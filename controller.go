@@ -0,0 +1,116 @@
+/*
+  MIT License
+  Copyright (c) 2020 Star Brilliant
+  Permission is hereby granted, free of charge, to any person obtaining a copy
+  of this software and associated documentation files (the "Software"), to deal
+  in the Software without restriction, including without limitation the rights
+  to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+  copies of the Software, and to permit persons to whom the Software is
+  furnished to do so, subject to the following conditions:
+  The above copyright notice and this permission notice shall be included in
+  all copies or substantial portions of the Software.
+  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+  AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+  LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+  OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+  SOFTWARE.
+*/
+
+package main
+
+import (
+	"time"
+
+	"github.com/m13253/midimark"
+)
+
+// controllerState follows the MIDI events that change the pitch of later notes,
+// and the pedals that change how long notes sound.
+type controllerState struct {
+	currentRPN  uint16
+	currentData uint16
+	RPN         [3]uint16
+	pitchWheel  [16]int16
+	Sustain     [16]bool
+	Sostenuto   [16]bool
+	Legato      [16]bool
+	portamento  [16]bool
+	// Portamento time MSB
+	portamentoTime [16]uint8
+}
+
+func newControllerState() controllerState {
+	return controllerState{
+		currentRPN:  0x0000,
+		currentData: 0xffff,
+		RPN: [3]uint16{
+			0x00: 0x0100, // Pitch wheel range: (value>>7)+(value&0x7f)/100 semitones
+			0x01: 0x2000, // Fine tuning: (value-0x2000)/8192 semitones
+			0x02: 0x2000, // Coarse tuning: (value>>7)-0x40 semitones
+		},
+	}
+}
+
+// Follow updates the state if the event is a pitch wheel change, an RPN control change or a pedal.
+func (s *controllerState) Follow(event midimark.Event) {
+	switch event := event.(type) {
+	case *midimark.EventPitchWheelChange:
+		s.pitchWheel[event.Channel-1] = event.Pitch
+	case *midimark.EventControlChange:
+		switch event.Control {
+		case 0x05: // Portamento time MSB
+			s.portamentoTime[event.Channel-1] = event.Value
+		case 0x41: // Portamento on/off
+			s.portamento[event.Channel-1] = event.Value >= 64
+		case 0x40: // Sustain
+			s.Sustain[event.Channel-1] = event.Value >= 64
+		case 0x42: // Sostenuto
+			s.Sostenuto[event.Channel-1] = event.Value >= 64
+		case 0x44: // Legato footswitch
+			s.Legato[event.Channel-1] = event.Value >= 64
+		case 0x06: // Data entry MSB
+			s.currentData = uint16(event.Value)<<7 | (s.currentData & 0x407f)
+			if (s.currentData&0xc000) == 0 && s.currentRPN <= 2 {
+				s.RPN[s.currentRPN] = s.currentData
+			}
+		case 0x26: // Data entry LSB
+			s.currentData = (s.currentData & 0xbf80) | uint16(event.Value)
+			if (s.currentData&0xc000) == 0 && s.currentRPN <= 2 {
+				s.RPN[s.currentRPN] = s.currentData
+			}
+		case 0x60: // Data +1
+			if s.currentRPN <= 2 {
+				s.RPN[s.currentRPN] = (s.RPN[s.currentRPN] + 1) & 0x3fff
+			}
+		case 0x61: // Data -1
+			if s.currentRPN <= 2 {
+				s.RPN[s.currentRPN] = (s.RPN[s.currentRPN] - 1) & 0x3fff
+			}
+		case 0x64: // RPN LSB
+			s.currentRPN = (s.currentRPN & 0xbf80) | uint16(event.Value)
+		case 0x65: // RPN MSB
+			s.currentRPN = uint16(event.Value)<<7 | (s.currentRPN & 0x407f)
+		}
+	}
+}
+
+// PortamentoTime returns how long a note in the channel glides from the previous note, or 0 if portamento is off.
+// The MIDI specification leaves the time unit to the synthesizer, here each step of CC 5 is 10 ms.
+func (s *controllerState) PortamentoTime(channel uint8) time.Duration {
+	if !s.portamento[channel-1] {
+		return 0
+	}
+	return time.Duration(s.portamentoTime[channel-1]) * 10 * time.Millisecond
+}
+
+// Pitch returns the note number of a non-drum note, with pitch wheel and tuning applied.
+func (s *controllerState) Pitch(event *midimark.EventNoteOn, transpose int) float64 {
+	pitchWheelRange := float64(s.RPN[0]>>7) + float64(s.RPN[0]&0x7f)/100
+	pitchWheelValue := float64(s.pitchWheel[event.Channel-1]) * float64(pitchWheelRange) / 8192
+	fineTuning := (float64(s.RPN[1]) - 0x2000) / 8192
+	coarseTuning := float64(s.RPN[2]>>7) - 0x40
+
+	return float64(event.Key) + float64(transpose) + pitchWheelValue + fineTuning + coarseTuning
+}
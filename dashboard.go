@@ -0,0 +1,189 @@
+/*
+  MIT License
+  Copyright (c) 2020 Star Brilliant
+  Permission is hereby granted, free of charge, to any person obtaining a copy
+  of this software and associated documentation files (the "Software"), to deal
+  in the Software without restriction, including without limitation the rights
+  to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+  copies of the Software, and to permit persons to whom the Software is
+  furnished to do so, subject to the following conditions:
+  The above copyright notice and this permission notice shall be included in
+  all copies or substantial portions of the Software.
+  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+  AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+  LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+  OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+  SOFTWARE.
+*/
+
+package main
+
+import (
+	_ "embed"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/m13253/midimark"
+)
+
+//go:embed dashboard.html
+var dashboardHTML []byte
+
+type rollNote struct {
+	Start  time.Duration
+	Length time.Duration
+	Key    float64
+	Drum   bool
+}
+
+type rollCacheKey struct {
+	Song *song
+	Conn *connConfig
+}
+
+// rollCache only keeps the songs in the last window asked for, usually the current one and the next,
+// so songs which have left the queue are not kept forever.
+type rollCache struct {
+	mu    sync.Mutex
+	notes map[rollCacheKey][]rollNote
+}
+
+type httpRollNote struct {
+	Start  float64 `json:"start"`
+	Length float64 `json:"length"`
+	Key    float64 `json:"key"`
+	Drum   bool    `json:"drum,omitempty"`
+}
+
+type httpRollLane struct {
+	Name  string         `json:"name"`
+	Notes []httpRollNote `json:"notes"`
+}
+
+type httpRoll struct {
+	From  float64        `json:"from"`
+	To    float64        `json:"to"`
+	Lanes []httpRollLane `json:"lanes"`
+}
+
+func (app *application) handleHTTPDashboard(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		httpError(w, http.StatusNotFound, "not found")
+		return
+	}
+	if !httpCheckMethod(w, r, http.MethodGet, http.MethodHead) {
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(dashboardHTML)
+}
+
+// GET /api/roll?from=<seconds>&to=<seconds> lists the notes each connection
+// plays in this range of the playback clock, for drawing a piano roll.
+func (app *application) handleHTTPRoll(w http.ResponseWriter, r *http.Request) {
+	if !httpCheckMethod(w, r, http.MethodGet) {
+		return
+	}
+	status := app.queue.Status()
+	from := status.Elapsed - 5*time.Second
+	to := status.Elapsed + 10*time.Second
+	if value, err := strconv.ParseFloat(r.FormValue("from"), 64); err == nil {
+		from = time.Duration(value * float64(time.Second))
+	}
+	if value, err := strconv.ParseFloat(r.FormValue("to"), 64); err == nil {
+		to = time.Duration(value * float64(time.Second))
+	}
+	if to-from > 5*time.Minute {
+		to = from + 5*time.Minute
+	}
+
+	result := httpRoll{
+		From:  from.Seconds(),
+		To:    to.Seconds(),
+		Lanes: make([]httpRollLane, len(app.conf.Connections)),
+	}
+	visible := make(map[*song]struct{})
+	for i, connConf := range app.conf.Connections {
+		lane := httpRollLane{
+			Name:  connConf.Name,
+			Notes: []httpRollNote{},
+		}
+		for _, item := range status.Items {
+			if item.Skipped || item.Start >= to || item.Start+item.Song.Duration+time.Second < from {
+				continue
+			}
+			visible[item.Song] = struct{}{}
+			for _, n := range app.rollNotes(item.Song, connConf) {
+				start := item.Start + n.Start
+				if start >= to || start+n.Length < from {
+					continue
+				}
+				lane.Notes = append(lane.Notes, httpRollNote{
+					Start:  start.Seconds(),
+					Length: n.Length.Seconds(),
+					Key:    n.Key,
+					Drum:   n.Drum,
+				})
+			}
+		}
+		result.Lanes[i] = lane
+	}
+	app.roll.keep(visible)
+	httpJSON(w, http.StatusOK, result)
+}
+
+// Forgets the notes of the songs not in keep.
+func (cache *rollCache) keep(songs map[*song]struct{}) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	for key := range cache.notes {
+		if _, ok := songs[key.Song]; !ok {
+			delete(cache.notes, key)
+		}
+	}
+}
+
+// Pitch wheel and tuning are ignored, the piano roll only needs to be roughly right.
+func (app *application) rollNotes(s *song, connConf *connConfig) []rollNote {
+	key := rollCacheKey{s, connConf}
+	app.roll.mu.Lock()
+	defer app.roll.mu.Unlock()
+	if notes, ok := app.roll.notes[key]; ok {
+		return notes
+	}
+
+	c := &connection{
+		AppConf:  &app.conf,
+		ConnConf: connConf,
+	}
+	var notes []rollNote
+	for _, n := range c.loadNotes(scheduledSong{Song: s}) {
+		event, ok := n.Event.(*midimark.EventNoteOn)
+		if !ok {
+			continue
+		}
+		start := s.tickToDuration(n.MTrk, event.AbsTick)
+		length := 1 * time.Second
+		if end, ok := s.noteOffTime(event); ok {
+			length = end - start
+		}
+		if length <= 0 {
+			continue
+		}
+		notes = append(notes, rollNote{
+			Start:  start,
+			Length: length,
+			Key:    float64(event.Key) + float64(s.Transpose),
+			Drum:   event.Channel == 10,
+		})
+	}
+	if app.roll.notes == nil {
+		app.roll.notes = make(map[rollCacheKey][]rollNote)
+	}
+	app.roll.notes[key] = notes
+	return notes
+}
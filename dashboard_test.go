@@ -0,0 +1,83 @@
+/*
+  MIT License
+  Copyright (c) 2020 Star Brilliant
+  Permission is hereby granted, free of charge, to any person obtaining a copy
+  of this software and associated documentation files (the "Software"), to deal
+  in the Software without restriction, including without limitation the rights
+  to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+  copies of the Software, and to permit persons to whom the Software is
+  furnished to do so, subject to the following conditions:
+  The above copyright notice and this permission notice shall be included in
+  all copies or substantial portions of the Software.
+  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+  AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+  LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+  OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+  SOFTWARE.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+func TestRollCacheKeepsVisibleSongs(t *testing.T) {
+	app := &application{conf: config{Connections: []*connConfig{{
+		Name:   "A",
+		Tracks: connTracksConfig{OtherTracks: true},
+	}}}}
+	app.conf.OtherTracksDefined = true
+	// Two songs of 2 seconds each
+	first := loadTestSong(t, app, newPlaylistEntry("first.mid"), smfFile(0, 96, smfTrack(smfNote(0, 384, 60)...)))
+	second := loadTestSong(t, app, newPlaylistEntry("second.mid"), smfFile(0, 96, smfTrack(smfNote(0, 384, 64)...)))
+	app.queue = newSongQueue([]*song{first, second}, false, false)
+	status := app.queue.Status()
+	if len(status.Items) != 2 {
+		t.Fatalf("got %d songs in the queue", len(status.Items))
+	}
+
+	roll := func(from, to float64) httpRoll {
+		t.Helper()
+		w := httptest.NewRecorder()
+		app.handleHTTPRoll(w, httptest.NewRequest("GET", "/api/roll?from="+strconv.FormatFloat(from, 'f', -1, 64)+"&to="+strconv.FormatFloat(to, 'f', -1, 64), nil))
+		var result httpRoll
+		err := json.Unmarshal(w.Body.Bytes(), &result)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return result
+	}
+	cached := func() map[*song]bool {
+		app.roll.mu.Lock()
+		defer app.roll.mu.Unlock()
+		songs := make(map[*song]bool)
+		for key := range app.roll.notes {
+			songs[key.Song] = true
+		}
+		return songs
+	}
+
+	result := roll(0, 1)
+	if len(result.Lanes) != 1 || len(result.Lanes[0].Notes) != 1 || result.Lanes[0].Notes[0].Key != 60 {
+		t.Fatalf("got %+v during the first song", result)
+	}
+	if songs := cached(); len(songs) != 1 || !songs[first] {
+		t.Errorf("cached %v during the first song", songs)
+	}
+
+	start := status.Items[1].Start.Seconds()
+	result = roll(start+1.5, start+2)
+	if len(result.Lanes[0].Notes) != 1 || result.Lanes[0].Notes[0].Key != 64 {
+		t.Fatalf("got %+v during the second song", result)
+	}
+	// The first song has been played, so its notes are forgotten
+	if songs := cached(); len(songs) != 1 || !songs[second] {
+		t.Errorf("cached %v during the second song", songs)
+	}
+}
@@ -0,0 +1,294 @@
+/*
+  MIT License
+  Copyright (c) 2020 Star Brilliant
+  Permission is hereby granted, free of charge, to any person obtaining a copy
+  of this software and associated documentation files (the "Software"), to deal
+  in the Software without restriction, including without limitation the rights
+  to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+  copies of the Software, and to permit persons to whom the Software is
+  furnished to do so, subject to the following conditions:
+  The above copyright notice and this permission notice shall be included in
+  all copies or substantial portions of the Software.
+  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+  AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+  LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+  OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+  SOFTWARE.
+*/
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Three rising beeps, to find which router is which by ear
+var identificationTones = []tone{
+	{Frequency: 1047, Length: 150 * time.Millisecond, Rest: 100 * time.Millisecond},
+	{Frequency: 1319, Length: 150 * time.Millisecond, Rest: 100 * time.Millisecond},
+	{Frequency: 1568, Length: 300 * time.Millisecond},
+}
+
+// The latency is the shortest of a few keepalive round trips.
+const doctorLatencyProbes = 3
+
+// The oldest RouterOS version MikroTiChestra plays on. Older ones have not been tried with :beep as it is written here.
+var minRouterOSVersion = [2]int{6, 0}
+
+// Major and minor numbers of versions such as "7.12 (stable)", "6.49.10 (long-term)" and "7.13beta2"
+var routerOSVersionPattern = regexp.MustCompile(`^(\d+)\.(\d+)`)
+
+// doctorResult is a row of the summary table, "-" marks what was not checked.
+type doctorResult struct {
+	Name     string
+	Address  string
+	Login    string
+	RouterOS string
+	Beeper   string
+	Latency  string
+	Tone     string
+	Failed   bool
+}
+
+// runDoctor checks every connection one by one, and plays a tone on each router to find it.
+func (app *application) runDoctor(args []string) {
+	flags := flag.NewFlagSet("doctor", flag.ExitOnError)
+	noTone := flags.Bool("no-tone", false, "Do not play the identification tone")
+	flags.Parse(args)
+
+	if app.conf.DryRun {
+		fmt.Println("doctor needs to connect to the routers, it cannot be used with -dry-run.")
+		os.Exit(1)
+	}
+	app.loadConfig()
+	app.loadKnownHosts()
+	jumps := newJumpDialer(app.hostKeys, app.conf.ShareProxyJump)
+
+	fmt.Println()
+	var results []doctorResult
+	for _, connConf := range app.conf.Connections {
+		results = append(results, app.diagnose(connConf, jumps, !*noTone))
+	}
+
+	fmt.Println()
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "Connection\tAddress\tLogin\tRouterOS\tBeeper\tLatency\tTone")
+	failed := false
+	for _, r := range results {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", r.Name, r.Address, r.Login, r.RouterOS, r.Beeper, r.Latency, r.Tone)
+		failed = failed || r.Failed
+	}
+	w.Flush()
+	if failed {
+		os.Exit(1)
+	}
+}
+
+func (app *application) diagnose(connConf *connConfig, jumps *jumpDialer, playTone bool) doctorResult {
+	r := doctorResult{
+		Name:     connConf.Name,
+		Address:  connConf.address() + jumpVia(connConf.Jumps),
+		Login:    "-",
+		RouterOS: "-",
+		Beeper:   "-",
+		Latency:  "-",
+		Tone:     "-",
+	}
+	if connConf.Driver == driverLocal {
+		r.Login = "local"
+		return r
+	}
+
+	fmt.Printf("[%s] Connecting to %s\n", r.Name, r.Address)
+	sshConf := &ssh.ClientConfig{
+		User: connConf.Username,
+		Auth: []ssh.AuthMethod{
+			ssh.Password(connConf.Password),
+		},
+		HostKeyCallback: app.hostKeys.Callback(connConf),
+		Timeout:         DefaultTimeout,
+	}
+	sshClient, releaseJumps, err := jumps.Dial(connConf, sshConf)
+	if err != nil {
+		fmt.Printf("[%s] %v\n", r.Name, err)
+		r.Login, r.Failed = "failed", true
+		return r
+	}
+	defer releaseJumps()
+	defer sshClient.Close()
+	r.Login = "ok"
+
+	latency, err := measureRoundTrip(sshClient)
+	if err != nil {
+		fmt.Printf("[%s] Measuring latency: %v\n", r.Name, err)
+		r.Latency, r.Failed = "failed", true
+	} else {
+		r.Latency = latency.Round(time.Microsecond).String()
+	}
+
+	if connConf.Driver == driverRouterOS {
+		var ok bool
+		r.RouterOS, r.Beeper, ok = checkRouterOS(sshClient, r.Name)
+		r.Failed = r.Failed || !ok
+	}
+
+	if playTone {
+		fmt.Printf("[%s] Playing the identification tone\n", r.Name)
+		err := playIdentificationTone(sshClient, connConf)
+		if err != nil {
+			fmt.Printf("[%s] %v\n", r.Name, err)
+			r.Tone, r.Failed = "failed", true
+		} else {
+			r.Tone = "played"
+		}
+	}
+	return r
+}
+
+func measureRoundTrip(sshClient *ssh.Client) (time.Duration, error) {
+	var best time.Duration
+	for i := 0; i < doctorLatencyProbes; i++ {
+		requested := time.Now()
+		_, _, err := sshClient.SendRequest("keepalive@openssh.com", true, nil)
+		if err != nil {
+			return 0, err
+		}
+		if roundTrip := time.Since(requested); i == 0 || roundTrip < best {
+			best = roundTrip
+		}
+	}
+	return best, nil
+}
+
+// Returns the RouterOS version, and whether the router has a beeper and :beep to play it.
+// Routers which are not RouterBOARDs, such as CHR and x86, have nothing to beep with.
+func checkRouterOS(sshClient *ssh.Client, name string) (version, beeper string, ok bool) {
+	version, versionOK := checkRouterOSVersion(sshClient, name)
+	beeper, beeperOK := checkBeeper(sshClient, name)
+	return version, beeper, versionOK && beeperOK
+}
+
+func checkRouterOSVersion(sshClient *ssh.Client, name string) (string, bool) {
+	version, err := runCommandOutput(sshClient, "/system resource get version")
+	if err != nil {
+		fmt.Printf("[%s] /system resource get version: %v\n", name, err)
+		return "failed", false
+	}
+	match := routerOSVersionPattern.FindStringSubmatch(version)
+	if match == nil {
+		// The :beep probe still tells whether it can play
+		fmt.Printf("[%s] Unknown RouterOS version %q\n", name, version)
+		return "unknown", true
+	}
+	major, _ := strconv.Atoi(match[1])
+	minor, _ := strconv.Atoi(match[2])
+	if major < minRouterOSVersion[0] || (major == minRouterOSVersion[0] && minor < minRouterOSVersion[1]) {
+		fmt.Printf("[%s] RouterOS %s is older than %d.%d, the oldest version MikroTiChestra plays on\n", name, version, minRouterOSVersion[0], minRouterOSVersion[1])
+		return version + ", too old", false
+	}
+	return version, true
+}
+
+// A beep of no length is silent, so it is tried even with -no-tone, to find routers without :beep.
+func checkBeeper(sshClient *ssh.Client, name string) (string, bool) {
+	output, err := runCommandOutput(sshClient, ":beep length=0")
+	// RouterOS prints nothing but errors
+	if err == nil && output != "" {
+		err = errors.New(output)
+	}
+	if err != nil && strings.Contains(err.Error(), "bad command name") {
+		fmt.Printf("[%s] This router has no :beep command\n", name)
+		return "no, :beep missing", false
+	}
+	if err != nil {
+		fmt.Printf("[%s] :beep length=0: %v\n", name, err)
+		return "failed", false
+	}
+
+	routerboard, err := runCommand(sshClient, "/system routerboard print")
+	if err != nil {
+		fmt.Printf("[%s] /system routerboard print: %v\n", name, err)
+		return "failed", false
+	}
+	if routerboard["routerboard"] != "yes" {
+		fmt.Printf("[%s] Not a RouterBOARD, there may be no beeper to play\n", name)
+		return "no, not a RouterBOARD", false
+	}
+	return "yes, " + routerboard["model"], true
+}
+
+// Runs a print command, and returns the "key: value" lines it prints.
+func runCommand(sshClient *ssh.Client, command string) (map[string]string, error) {
+	output, err := runCommandOutput(sshClient, command)
+	if err != nil {
+		return nil, err
+	}
+	fields := make(map[string]string)
+	sc := bufio.NewScanner(strings.NewReader(output))
+	for sc.Scan() {
+		key, value, ok := strings.Cut(sc.Text(), ":")
+		if ok {
+			fields[strings.TrimSpace(key)] = strings.TrimSpace(value)
+		}
+	}
+	return fields, nil
+}
+
+// Runs a command, and returns what it prints without the surrounding spaces.
+func runCommandOutput(sshClient *ssh.Client, command string) (string, error) {
+	sshSession, err := sshClient.NewSession()
+	if err != nil {
+		return "", err
+	}
+	defer sshSession.Close()
+	output, err := sshSession.CombinedOutput(command)
+	if err != nil {
+		return "", commandError(err, output)
+	}
+	return strings.TrimSpace(string(output)), nil
+}
+
+// Plays the tone with the driver of the connection, which also shows :beep works on a router.
+func playIdentificationTone(sshClient *ssh.Client, connConf *connConfig) error {
+	dialect := newShellDialect(connConf)
+	command := dialect.Setup() + dialect.Play(identificationTones)
+	if connConf.Driver != driverRouterOS {
+		// The other drivers play in the background
+		command += "wait\n"
+	}
+
+	sshSession, err := sshClient.NewSession()
+	if err != nil {
+		return err
+	}
+	defer sshSession.Close()
+	output, err := sshSession.CombinedOutput(command)
+	if err != nil {
+		return commandError(err, output)
+	}
+	// RouterOS prints nothing but errors, such as for a missing :beep
+	if connConf.Driver == driverRouterOS && len(strings.TrimSpace(string(output))) != 0 {
+		return errors.New(strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+func commandError(err error, output []byte) error {
+	if message := strings.TrimSpace(string(output)); message != "" {
+		return fmt.Errorf("%v: %s", err, message)
+	}
+	return err
+}
@@ -0,0 +1,133 @@
+/*
+  MIT License
+  Copyright (c) 2020 Star Brilliant
+  Permission is hereby granted, free of charge, to any person obtaining a copy
+  of this software and associated documentation files (the "Software"), to deal
+  in the Software without restriction, including without limitation the rights
+  to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+  copies of the Software, and to permit persons to whom the Software is
+  furnished to do so, subject to the following conditions:
+  The above copyright notice and this permission notice shall be included in
+  all copies or substantial portions of the Software.
+  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+  AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+  LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+  OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+  SOFTWARE.
+*/
+
+package main
+
+import (
+	"testing"
+
+	"github.com/m13253/MikroTiChestra/fakerouteros"
+)
+
+func TestDiagnoseRouterOS(t *testing.T) {
+	tests := []struct {
+		name     string
+		router   fakerouteros.Config
+		routerOS string
+		beeper   string
+		failed   bool
+	}{
+		{
+			name:     "working router",
+			router:   fakerouteros.Config{Version: "7.12 (stable)", Model: "RB951Ui-2HnD"},
+			routerOS: "7.12 (stable)",
+			beeper:   "yes, RB951Ui-2HnD",
+		},
+		{
+			name:     "long-term release",
+			router:   fakerouteros.Config{Version: "6.49.10 (long-term)", Model: "hAP ac lite"},
+			routerOS: "6.49.10 (long-term)",
+			beeper:   "yes, hAP ac lite",
+		},
+		{
+			name:     "too old",
+			router:   fakerouteros.Config{Version: "5.26", Model: "RB750"},
+			routerOS: "5.26, too old",
+			beeper:   "yes, RB750",
+			failed:   true,
+		},
+		{
+			name:     "unknown version",
+			router:   fakerouteros.Config{Version: "fake", Model: "RB750"},
+			routerOS: "unknown",
+			beeper:   "yes, RB750",
+		},
+		{
+			name:     "no :beep",
+			router:   fakerouteros.Config{Version: "7.12 (stable)", Model: "RB951Ui-2HnD", NoBeep: true},
+			routerOS: "7.12 (stable)",
+			beeper:   "no, :beep missing",
+			failed:   true,
+		},
+		{
+			name:     "CHR",
+			router:   fakerouteros.Config{Version: "7.12 (stable)"},
+			routerOS: "7.12 (stable)",
+			beeper:   "no, not a RouterBOARD",
+			failed:   true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			router, addr := startFakeRouterConfig(t, test.router)
+			conf := loadTestConfig(t, writeKnownHosts(t, addr, router.HostKey()), addr, "secret")
+			app := &application{conf: *conf}
+			var err error
+			app.hostKeys, err = newHostKeyStore(conf.KnownHosts, conf.HostKeyPolicy)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			r := app.diagnose(conf.Connections[0], newJumpDialer(app.hostKeys, false), false)
+			if r.Login != "ok" || r.RouterOS != test.routerOS || r.Beeper != test.beeper || r.Failed != test.failed {
+				t.Errorf("got %+v, want RouterOS %q, beeper %q, failed %v", r, test.routerOS, test.beeper, test.failed)
+			}
+			// Only the silent probe is played without the identification tone
+			for _, beep := range router.Beeps() {
+				if beep.Length != 0 {
+					t.Errorf("played %+v with -no-tone", beep)
+				}
+			}
+		})
+	}
+}
+
+func TestDiagnoseTone(t *testing.T) {
+	router, addr := startFakeRouterConfig(t, fakerouteros.Config{Model: "RB951Ui-2HnD"})
+	conf := loadTestConfig(t, writeKnownHosts(t, addr, router.HostKey()), addr, "secret")
+	app := &application{conf: *conf}
+	var err error
+	app.hostKeys, err = newHostKeyStore(conf.KnownHosts, conf.HostKeyPolicy)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := app.diagnose(conf.Connections[0], newJumpDialer(app.hostKeys, false), true)
+	if r.Failed || r.Tone != "played" {
+		t.Errorf("got %+v", r)
+	}
+	var played []float64
+	for _, beep := range router.Beeps() {
+		if beep.Length != 0 {
+			played = append(played, beep.Frequency)
+		}
+	}
+	if len(played) != len(identificationTones) {
+		t.Fatalf("played %v, want the identification tone", played)
+	}
+	for i, frequency := range played {
+		if frequency != identificationTones[i].Frequency {
+			t.Errorf("tone %d: got %v Hz, want %v Hz", i, frequency, identificationTones[i].Frequency)
+		}
+	}
+	if r.Latency == "-" || r.Latency == "failed" {
+		t.Errorf("latency is %s", r.Latency)
+	}
+}
@@ -0,0 +1,194 @@
+/*
+  MIT License
+  Copyright (c) 2020 Star Brilliant
+  Permission is hereby granted, free of charge, to any person obtaining a copy
+  of this software and associated documentation files (the "Software"), to deal
+  in the Software without restriction, including without limitation the rights
+  to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+  copies of the Software, and to permit persons to whom the Software is
+  furnished to do so, subject to the following conditions:
+  The above copyright notice and this permission notice shall be included in
+  all copies or substantial portions of the Software.
+  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+  AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+  LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+  OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+  SOFTWARE.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/m13253/midimark"
+)
+
+// eventLog writes every connection message and note to a file.
+// Timestamps use the monotonic clock, counting from when the log is opened.
+// A nil *eventLog discards everything.
+type eventLog struct {
+	mu     sync.Mutex
+	f      *os.File
+	json   bool
+	opened time.Time
+}
+
+type noteRecord struct {
+	Hostname    string
+	QueueID     int
+	Song        string
+	TrackID     int
+	Channel     uint8
+	Key         midimark.Key
+	Frequency   float64
+	LengthMilli int64
+	// The tones of the note, including accents and glides
+	Tones []tone
+	// Times on the playback clock
+	Scheduled time.Duration
+	Sent      time.Duration
+	Command   string
+}
+
+// Field names are kept short, since there is one line per note.
+type logRecord struct {
+	Time        float64      `json:"t"`
+	Type        string       `json:"type"`
+	Hostname    string       `json:"host,omitempty"`
+	Message     string       `json:"message,omitempty"`
+	QueueID     *int         `json:"queue,omitempty"`
+	Song        string       `json:"song,omitempty"`
+	TrackID     *int         `json:"track,omitempty"`
+	Channel     uint8        `json:"channel,omitempty"`
+	Key         *uint8       `json:"key,omitempty"`
+	Frequency   float64      `json:"frequency,omitempty"`
+	LengthMilli int64        `json:"length_ms,omitempty"`
+	Tones       []toneRecord `json:"tones,omitempty"`
+	Scheduled   *float64     `json:"scheduled,omitempty"`
+	Sent        *float64     `json:"sent,omitempty"`
+	Command     string       `json:"command,omitempty"`
+}
+
+type toneRecord struct {
+	Frequency   float64 `json:"frequency"`
+	LengthMilli int64   `json:"length_ms"`
+	RestMilli   int64   `json:"rest_ms,omitempty"`
+}
+
+func newToneRecords(tones []tone) []toneRecord {
+	if len(tones) == 0 {
+		return nil
+	}
+	records := make([]toneRecord, len(tones))
+	for i, t := range tones {
+		records[i] = toneRecord{
+			Frequency:   t.Frequency,
+			LengthMilli: toneMilli(t.Length),
+			RestMilli:   toneMilli(t.Rest),
+		}
+	}
+	return records
+}
+
+func (r toneRecord) Tone() tone {
+	return tone{
+		Frequency: r.Frequency,
+		Length:    time.Duration(r.LengthMilli) * time.Millisecond,
+		Rest:      time.Duration(r.RestMilli) * time.Millisecond,
+	}
+}
+
+func openEventLog(filename, format string) (*eventLog, error) {
+	if format != "text" && format != "json" {
+		return nil, fmt.Errorf("unknown log format %q", format)
+	}
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return nil, err
+	}
+	return &eventLog{
+		f:      f,
+		json:   format == "json",
+		opened: time.Now(),
+	}, nil
+}
+
+func (l *eventLog) Close() error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.f.Close()
+}
+
+func (l *eventLog) Message(hostname, message string) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	t := time.Since(l.opened)
+	if l.json {
+		l.writeJSON(logRecord{
+			Time:     t.Seconds(),
+			Type:     "message",
+			Hostname: hostname,
+			Message:  message,
+		})
+		return
+	}
+	if hostname != "" {
+		fmt.Fprintf(l.f, "%12.6f [%s] %s\n", t.Seconds(), hostname, message)
+	} else {
+		fmt.Fprintf(l.f, "%12.6f %s\n", t.Seconds(), message)
+	}
+}
+
+func (l *eventLog) Note(rec noteRecord) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	t := time.Since(l.opened)
+	if l.json {
+		key := uint8(rec.Key)
+		scheduled, sent := rec.Scheduled.Seconds(), rec.Sent.Seconds()
+		l.writeJSON(logRecord{
+			Time:        t.Seconds(),
+			Type:        "note",
+			Hostname:    rec.Hostname,
+			QueueID:     &rec.QueueID,
+			Song:        rec.Song,
+			TrackID:     &rec.TrackID,
+			Channel:     rec.Channel,
+			Key:         &key,
+			Frequency:   rec.Frequency,
+			LengthMilli: rec.LengthMilli,
+			Tones:       newToneRecords(rec.Tones),
+			Scheduled:   &scheduled,
+			Sent:        &sent,
+			Command:     rec.Command,
+		})
+		return
+	}
+	fmt.Fprintf(l.f, "%12.6f [%s] queue=%d song=%q track=%d channel=%d key=%s scheduled=%.6f sent=%.6f > %s\n",
+		t.Seconds(), rec.Hostname, rec.QueueID, rec.Song, rec.TrackID, rec.Channel, rec.Key, rec.Scheduled.Seconds(), rec.Sent.Seconds(), strings.TrimSpace(rec.Command))
+}
+
+func (l *eventLog) writeJSON(rec logRecord) {
+	buf, err := json.Marshal(rec)
+	if err != nil {
+		return
+	}
+	l.f.Write(append(buf, '\n'))
+}
@@ -0,0 +1,166 @@
+/*
+  MIT License
+  Copyright (c) 2020 Star Brilliant
+  Permission is hereby granted, free of charge, to any person obtaining a copy
+  of this software and associated documentation files (the "Software"), to deal
+  in the Software without restriction, including without limitation the rights
+  to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+  copies of the Software, and to permit persons to whom the Software is
+  furnished to do so, subject to the following conditions:
+  The above copyright notice and this permission notice shall be included in
+  all copies or substantial portions of the Software.
+  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+  AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+  LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+  OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+  SOFTWARE.
+*/
+
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/m13253/MikroTiChestra/fakerouteros"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// runFakeRouter pretends to be a MikroTik router, printing the beeps it receives.
+func (app *application) runFakeRouter(args []string) {
+	flags := flag.NewFlagSet("fake-router", flag.ExitOnError)
+	listen := flags.String("listen", "127.0.0.1:2222", "Address to accept SSH connections on")
+	username := flags.String("username", "admin", "User name to accept")
+	password := flags.String("password", "admin", "Password to accept")
+	authorizedKeys := flags.String("authorized-keys", "", "Also accept the public keys in this file")
+	hostKeyFile := flags.String("host-key", "", "Private host key file, created if it does not exist, a new key each time if empty")
+	knownHostsFile := flags.String("known-hosts", "", "Add the host key to this known_hosts file")
+	banner := flags.String("banner", "", "Banner shown to clients before logging in")
+	forwarding := flags.Bool("forwarding", false, "Accept TCP forwarding, to act as a jump host")
+	version := flags.String("version", "7.12 (stable)", "RouterOS version to report")
+	model := flags.String("model", "RB951Ui-2HnD", "RouterBOARD model to report, or empty to report none, like a CHR")
+	noBeep := flags.Bool("no-beep", false, "Answer :beep with \"bad command name\", like a router without it")
+	flags.Parse(args)
+
+	conf := fakerouteros.Config{
+		Users:      map[string]string{*username: *password},
+		Banner:     *banner,
+		Forwarding: *forwarding,
+		Version:    *version,
+		Model:      *model,
+		NoBeep:     *noBeep,
+	}
+	if *authorizedKeys != "" {
+		keys, err := loadAuthorizedKeys(*authorizedKeys)
+		if err != nil {
+			fmt.Printf("Failed to load authorized keys: %v\n", err)
+			os.Exit(1)
+		}
+		conf.AuthorizedKeys = keys
+	}
+	if *hostKeyFile != "" {
+		signer, err := loadOrCreateHostKey(*hostKeyFile)
+		if err != nil {
+			fmt.Printf("Failed to load host key: %v\n", err)
+			os.Exit(1)
+		}
+		conf.HostKey = signer
+	}
+	start := time.Now()
+	conf.OnCommand = func(cmd fakerouteros.Command) {
+		for _, beep := range cmd.Beeps {
+			fmt.Printf("%10.3f [%s] beep frequency=%.0f length=%v\n", beep.Time.Sub(start).Seconds(), beep.User, beep.Frequency, beep.Length)
+		}
+		if cmd.Error != "" {
+			fmt.Printf("%10.3f [%s] %s: %s\n", cmd.Time.Sub(start).Seconds(), cmd.User, strings.TrimSpace(cmd.Line), cmd.Error)
+		}
+	}
+
+	server, err := fakerouteros.NewServer(conf)
+	if err != nil {
+		fmt.Printf("Failed to start server: %v\n", err)
+		os.Exit(1)
+	}
+	l, err := net.Listen("tcp", *listen)
+	if err != nil {
+		fmt.Printf("Failed to listen: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Host key: %s\n", ssh.FingerprintSHA256(server.HostKey()))
+	if *knownHostsFile != "" {
+		err := appendKnownHost(*knownHostsFile, l.Addr().String(), server.HostKey())
+		if err != nil {
+			fmt.Printf("Failed to write known_hosts: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	fmt.Printf("Listening on %s\n", l.Addr())
+	err = server.Serve(l)
+	if err != nil {
+		fmt.Printf("Failed to serve: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func loadAuthorizedKeys(filename string) ([]ssh.PublicKey, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var keys []ssh.PublicKey
+	for len(strings.TrimSpace(string(data))) != 0 {
+		key, _, _, rest, err := ssh.ParseAuthorizedKey(data)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+		data = rest
+	}
+	return keys, nil
+}
+
+// The same host key across restarts avoids editing known_hosts every time.
+func loadOrCreateHostKey(filename string) (ssh.Signer, error) {
+	data, err := os.ReadFile(filename)
+	if err == nil {
+		return ssh.ParsePrivateKey(data)
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	block, err := ssh.MarshalPrivateKey(key, "")
+	if err != nil {
+		return nil, err
+	}
+	err = os.WriteFile(filename, pem.EncodeToMemory(block), 0600)
+	if err != nil {
+		return nil, err
+	}
+	return ssh.NewSignerFromKey(key)
+}
+
+func appendKnownHost(filename, addr string, key ssh.PublicKey) error {
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = fmt.Fprintln(f, knownhosts.Line([]string{knownhosts.Normalize(addr)}, key))
+	return err
+}
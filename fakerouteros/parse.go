@@ -0,0 +1,117 @@
+/*
+  MIT License
+  Copyright (c) 2020 Star Brilliant
+  Permission is hereby granted, free of charge, to any person obtaining a copy
+  of this software and associated documentation files (the "Software"), to deal
+  in the Software without restriction, including without limitation the rights
+  to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+  copies of the Software, and to permit persons to whom the Software is
+  furnished to do so, subject to the following conditions:
+  The above copyright notice and this permission notice shall be included in
+  all copies or substantial portions of the Software.
+  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+  AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+  LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+  OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+  SOFTWARE.
+*/
+
+package fakerouteros
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type statement struct {
+	// "beep", "delay" or "" for an empty statement
+	Name      string
+	Frequency float64
+	Length    time.Duration
+}
+
+// Only the subset of the RouterOS scripting language used by MikroTiChestra is understood.
+func splitStatements(line string) []string {
+	var statements []string
+	for _, st := range strings.Split(line, ";") {
+		if st = strings.TrimSpace(st); st != "" {
+			statements = append(statements, st)
+		}
+	}
+	return statements
+}
+
+func parseStatement(st string) (statement, error) {
+	fields := strings.Fields(st)
+	switch fields[0] {
+	case ":beep":
+		result := statement{
+			Name:      "beep",
+			Frequency: 1000,
+			Length:    100 * time.Millisecond,
+		}
+		for _, arg := range fields[1:] {
+			if arg == "as-value" {
+				continue
+			}
+			key, value, ok := strings.Cut(arg, "=")
+			if !ok {
+				return statement{}, fmt.Errorf("expected end of command (line 1 column %d)", strings.Index(st, arg)+1)
+			}
+			switch key {
+			case "frequency":
+				frequency, err := strconv.ParseFloat(value, 64)
+				if err != nil || frequency < 20 || frequency > 20000 {
+					return statement{}, fmt.Errorf("value of frequency out of range (20..20000)")
+				}
+				result.Frequency = frequency
+			case "length":
+				length, err := parseTime(value)
+				if err != nil {
+					return statement{}, fmt.Errorf("invalid value for argument length")
+				}
+				result.Length = length
+			default:
+				return statement{}, fmt.Errorf("expected end of command (line 1 column %d)", strings.Index(st, arg)+1)
+			}
+		}
+		return result, nil
+	case ":delay":
+		if len(fields) != 2 {
+			return statement{}, fmt.Errorf("invalid value for argument delay-time")
+		}
+		delay, err := parseTime(strings.TrimPrefix(fields[1], "delay-time="))
+		if err != nil {
+			return statement{}, fmt.Errorf("invalid value for argument delay-time")
+		}
+		return statement{Name: "delay", Length: delay}, nil
+	}
+	return statement{}, fmt.Errorf("bad command name %s (line 1 column 1)", strings.TrimPrefix(fields[0], ":"))
+}
+
+// RouterOS times are like "500ms", "1s", "1m30s", "00:01:30", or a number of seconds.
+func parseTime(value string) (time.Duration, error) {
+	if seconds, err := strconv.ParseFloat(value, 64); err == nil {
+		return time.Duration(seconds * float64(time.Second)), nil
+	}
+	if parts := strings.Split(value, ":"); len(parts) == 3 {
+		var total time.Duration
+		for i, unit := range []time.Duration{time.Hour, time.Minute, time.Second} {
+			n, err := strconv.ParseFloat(parts[i], 64)
+			if err != nil {
+				return 0, err
+			}
+			total += time.Duration(n * float64(unit))
+		}
+		return total, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, err
+	}
+	return d, nil
+}
@@ -0,0 +1,111 @@
+/*
+  MIT License
+  Copyright (c) 2020 Star Brilliant
+  Permission is hereby granted, free of charge, to any person obtaining a copy
+  of this software and associated documentation files (the "Software"), to deal
+  in the Software without restriction, including without limitation the rights
+  to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+  copies of the Software, and to permit persons to whom the Software is
+  furnished to do so, subject to the following conditions:
+  The above copyright notice and this permission notice shall be included in
+  all copies or substantial portions of the Software.
+  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+  AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+  LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+  OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+  SOFTWARE.
+*/
+
+package fakerouteros
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseTime(t *testing.T) {
+	tests := []struct {
+		value string
+		want  time.Duration
+	}{
+		{"500ms", 500 * time.Millisecond},
+		{"1s", time.Second},
+		{"1m30s", 90 * time.Second},
+		{"00:01:30", 90 * time.Second},
+		{"0.25", 250 * time.Millisecond},
+		{"2", 2 * time.Second},
+	}
+	for _, test := range tests {
+		got, err := parseTime(test.value)
+		if err != nil {
+			t.Errorf("parseTime(%q): %v", test.value, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("parseTime(%q) = %v, want %v", test.value, got, test.want)
+		}
+	}
+	for _, value := range []string{"", "soon", "1:2", "00:xx:00"} {
+		if _, err := parseTime(value); err == nil {
+			t.Errorf("parseTime(%q) should fail", value)
+		}
+	}
+}
+
+func TestSplitStatements(t *testing.T) {
+	got := splitStatements(" :beep frequency=440;; :delay 10ms ;")
+	want := []string{":beep frequency=440", ":delay 10ms"}
+	if strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestParseStatement(t *testing.T) {
+	tests := []struct {
+		statement string
+		want      statement
+		err       string
+	}{
+		{
+			statement: ":beep",
+			want:      statement{Name: "beep", Frequency: 1000, Length: 100 * time.Millisecond},
+		},
+		{
+			statement: ":beep as-value frequency=440 length=250ms",
+			want:      statement{Name: "beep", Frequency: 440, Length: 250 * time.Millisecond},
+		},
+		{
+			statement: ":delay 1s",
+			want:      statement{Name: "delay", Length: time.Second},
+		},
+		{
+			statement: ":delay delay-time=20ms",
+			want:      statement{Name: "delay", Length: 20 * time.Millisecond},
+		},
+		{statement: ":beep frequency=10", err: "value of frequency out of range"},
+		{statement: ":beep frequency=30000", err: "value of frequency out of range"},
+		{statement: ":beep length=long", err: "invalid value for argument length"},
+		{statement: ":beep volume=11", err: "expected end of command (line 1 column 7)"},
+		{statement: ":delay", err: "invalid value for argument delay-time"},
+		{statement: ":put hello", err: "bad command name put"},
+	}
+	for _, test := range tests {
+		got, err := parseStatement(test.statement)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("parseStatement(%q): got error %v, want %q", test.statement, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseStatement(%q): %v", test.statement, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("parseStatement(%q) = %+v, want %+v", test.statement, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,493 @@
+/*
+  MIT License
+  Copyright (c) 2020 Star Brilliant
+  Permission is hereby granted, free of charge, to any person obtaining a copy
+  of this software and associated documentation files (the "Software"), to deal
+  in the Software without restriction, including without limitation the rights
+  to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+  copies of the Software, and to permit persons to whom the Software is
+  furnished to do so, subject to the following conditions:
+  The above copyright notice and this permission notice shall be included in
+  all copies or substantial portions of the Software.
+  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+  AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+  LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+  OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+  SOFTWARE.
+*/
+
+// Package fakerouteros is an SSH server pretending to be a MikroTik router.
+// It records every beep it is asked to play, so MikroTiChestra can be tried and tested without hardware.
+package fakerouteros
+
+import (
+	"bufio"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+type Config struct {
+	// Passwords by user name
+	Users map[string]string
+	// Keys accepted for any user name in Users
+	AuthorizedKeys []ssh.PublicKey
+	// A new ed25519 key is generated if nil
+	HostKey ssh.Signer
+	// Sent before authentication
+	Banner string
+	// Shown in the prompt, "MikroTik" if empty
+	Identity string
+	// Called for each command line received, after it is run
+	OnCommand func(Command)
+	// Accept TCP forwarding, like "/ip ssh set forwarding-enabled=local", so the server can be a jump host
+	Forwarding bool
+	// Shown by "/system resource print" and "/system resource get version", "7.12 (stable)" if empty
+	Version string
+	// Shown by "/system routerboard print", which says it is not a RouterBOARD if empty, like a CHR
+	Model string
+	// Answer :beep with "bad command name", like a router without it
+	NoBeep bool
+}
+
+// Command is a line received from a client.
+type Command struct {
+	Time  time.Time
+	User  string
+	Line  string
+	Beeps []Beep
+	// What a print or get command shows
+	Output string
+	// Empty if the line was run successfully
+	Error string
+}
+
+// Beep is a tone started by a :beep command.
+// Time includes the delays from earlier :delay commands on the same line.
+type Beep struct {
+	Time      time.Time
+	User      string
+	Frequency float64
+	Length    time.Duration
+}
+
+type Server struct {
+	conf    Config
+	sshConf *ssh.ServerConfig
+
+	mu        sync.Mutex
+	commands  []Command
+	beeps     []Beep
+	listeners []net.Listener
+	conns     map[net.Conn]struct{}
+	closed    bool
+	wg        sync.WaitGroup
+}
+
+func NewServer(conf Config) (*Server, error) {
+	if conf.HostKey == nil {
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		conf.HostKey, err = ssh.NewSignerFromKey(key)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if conf.Identity == "" {
+		conf.Identity = "MikroTik"
+	}
+	if conf.Version == "" {
+		conf.Version = "7.12 (stable)"
+	}
+	s := &Server{
+		conf:  conf,
+		conns: make(map[net.Conn]struct{}),
+	}
+	s.sshConf = &ssh.ServerConfig{
+		PasswordCallback: func(meta ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if expected, ok := conf.Users[meta.User()]; ok && expected == string(password) {
+				return nil, nil
+			}
+			return nil, errors.New("invalid user name or password")
+		},
+		PublicKeyCallback: func(meta ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if _, ok := conf.Users[meta.User()]; ok {
+				for _, authorized := range conf.AuthorizedKeys {
+					if string(authorized.Marshal()) == string(key.Marshal()) {
+						return nil, nil
+					}
+				}
+			}
+			return nil, errors.New("key not authorized")
+		},
+	}
+	if conf.Banner != "" {
+		s.sshConf.BannerCallback = func(ssh.ConnMetadata) string {
+			return conf.Banner
+		}
+	}
+	s.sshConf.AddHostKey(conf.HostKey)
+	return s, nil
+}
+
+// HostKey returns the public key clients should find in known_hosts.
+func (s *Server) HostKey() ssh.PublicKey {
+	return s.conf.HostKey.PublicKey()
+}
+
+// ListenAndServe listens on a TCP address such as "127.0.0.1:2222" and serves until Close is called.
+func (s *Server) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+// Serve accepts connections from l until Close is called.
+func (s *Server) Serve(l net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		l.Close()
+		return net.ErrClosed
+	}
+	s.listeners = append(s.listeners, l)
+	s.mu.Unlock()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if closed {
+				return nil
+			}
+			return err
+		}
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			conn.Close()
+			return nil
+		}
+		s.conns[conn] = struct{}{}
+		s.wg.Add(1)
+		s.mu.Unlock()
+		go s.handleConn(conn)
+	}
+}
+
+// Close stops the listeners, disconnects all clients and waits for them to finish.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	for _, l := range s.listeners {
+		l.Close()
+	}
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+	return nil
+}
+
+// Commands returns the command lines received so far.
+func (s *Server) Commands() []Command {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Command(nil), s.commands...)
+}
+
+// Beeps returns the beeps played so far, in order of time.
+func (s *Server) Beeps() []Beep {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Beep(nil), s.beeps...)
+}
+
+func (s *Server) handleConn(conn net.Conn) {
+	defer s.wg.Done()
+	defer func() {
+		conn.Close()
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+	}()
+
+	sshConn, chans, reqs, err := ssh.NewServerConn(conn, s.sshConf)
+	if err != nil {
+		return
+	}
+	defer sshConn.Close()
+	// Including keepalive@openssh.com, which only needs a reply
+	go ssh.DiscardRequests(reqs)
+
+	var wg sync.WaitGroup
+	for newChannel := range chans {
+		if newChannel.ChannelType() == "direct-tcpip" && s.conf.Forwarding {
+			wg.Add(1)
+			go func(newChannel ssh.NewChannel) {
+				defer wg.Done()
+				s.handleForward(newChannel)
+			}(newChannel)
+			continue
+		}
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "unknown channel type")
+			continue
+		}
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.handleSession(sshConn.User(), channel, requests)
+		}()
+	}
+	wg.Wait()
+}
+
+// Connects the channel to the address asked for by the client.
+func (s *Server) handleForward(newChannel ssh.NewChannel) {
+	var target struct {
+		Host       string
+		Port       uint32
+		OriginHost string
+		OriginPort uint32
+	}
+	err := ssh.Unmarshal(newChannel.ExtraData(), &target)
+	if err != nil {
+		newChannel.Reject(ssh.ConnectionFailed, "invalid forwarding request")
+		return
+	}
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(target.Host, fmt.Sprint(target.Port)), 10*time.Second)
+	if err != nil {
+		newChannel.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+	defer conn.Close()
+	channel, requests, err := newChannel.Accept()
+	if err != nil {
+		return
+	}
+	defer channel.Close()
+	go ssh.DiscardRequests(requests)
+
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(conn, channel)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(channel, conn)
+		done <- struct{}{}
+	}()
+	<-done
+}
+
+func (s *Server) handleSession(user string, channel ssh.Channel, requests <-chan *ssh.Request) {
+	defer channel.Close()
+	type start struct {
+		pty bool
+		// The command line of an exec request, or empty for a shell
+		exec string
+	}
+	started := make(chan start, 1)
+	go func() {
+		pty := false
+		for req := range requests {
+			switch req.Type {
+			case "pty-req":
+				pty = true
+				req.Reply(true, nil)
+			case "shell":
+				req.Reply(true, nil)
+				select {
+				case started <- start{pty: pty}:
+				default:
+				}
+			case "exec":
+				var payload struct{ Command string }
+				if ssh.Unmarshal(req.Payload, &payload) != nil || payload.Command == "" {
+					req.Reply(false, nil)
+					continue
+				}
+				req.Reply(true, nil)
+				select {
+				case started <- start{pty: pty, exec: payload.Command}:
+				default:
+				}
+			case "env", "window-change":
+				req.Reply(true, nil)
+			default:
+				req.Reply(false, nil)
+			}
+		}
+		close(started)
+	}()
+	st, ok := <-started
+	if !ok {
+		return
+	}
+	pty := st.pty
+	if st.exec != "" {
+		cmd := s.run(user, st.exec)
+		io.WriteString(channel, cmd.Output)
+		status := uint32(0)
+		if cmd.Error != "" {
+			io.WriteString(channel, cmd.Error+"\r\n")
+			status = 1
+		}
+		channel.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{status}))
+		return
+	}
+
+	// Without a terminal, a router prints nothing but errors
+	prompt := fmt.Sprintf("[%s@%s] > ", user, s.conf.Identity)
+	if pty {
+		io.WriteString(channel, prompt)
+	}
+	sc := bufio.NewScanner(channel)
+	for sc.Scan() {
+		line := strings.TrimRight(sc.Text(), "\r")
+		if pty {
+			io.WriteString(channel, line+"\r\n")
+		}
+		if trimmed := strings.TrimSpace(line); trimmed == "/quit" || trimmed == "quit" {
+			break
+		}
+		cmd := s.run(user, line)
+		io.WriteString(channel, cmd.Output)
+		if cmd.Error != "" {
+			io.WriteString(channel, cmd.Error+"\r\n")
+		}
+		if pty {
+			io.WriteString(channel, prompt)
+		}
+	}
+	channel.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{0}))
+}
+
+// Runs the statements of a line in order, sleeping for :delay like a router would.
+func (s *Server) run(user, line string) Command {
+	cmd := Command{
+		Time: time.Now(),
+		User: user,
+		Line: line,
+	}
+	if output, err, ok := s.print(strings.TrimSpace(line)); ok {
+		cmd.Output = output
+		cmd.Error = err
+		s.mu.Lock()
+		s.commands = append(s.commands, cmd)
+		s.mu.Unlock()
+		if s.conf.OnCommand != nil {
+			s.conf.OnCommand(cmd)
+		}
+		return cmd
+	}
+	for _, statement := range splitStatements(line) {
+		st, err := parseStatement(statement)
+		if err == nil && st.Name == "beep" && s.conf.NoBeep {
+			err = fmt.Errorf("bad command name beep (line 1 column 2)")
+		}
+		if err != nil {
+			cmd.Error = err.Error()
+			break
+		}
+		switch st.Name {
+		case "beep":
+			beep := Beep{
+				Time:      time.Now(),
+				User:      user,
+				Frequency: st.Frequency,
+				Length:    st.Length,
+			}
+			cmd.Beeps = append(cmd.Beeps, beep)
+			s.mu.Lock()
+			s.beeps = append(s.beeps, beep)
+			s.mu.Unlock()
+		case "delay":
+			time.Sleep(st.Length)
+		}
+	}
+	s.mu.Lock()
+	s.commands = append(s.commands, cmd)
+	s.mu.Unlock()
+	if s.conf.OnCommand != nil {
+		s.conf.OnCommand(cmd)
+	}
+	return cmd
+}
+
+// Answers the commands which tell what the router is.
+// "print" shows every field, aligned like RouterOS does, and "get" shows the value of one field.
+func (s *Server) print(line string) (output string, err string, ok bool) {
+	fields, get, ok := s.fields(line)
+	if !ok {
+		return "", "", false
+	}
+	if get != "" {
+		for _, field := range fields {
+			if field[0] == get {
+				return field[1] + "\r\n", "", true
+			}
+		}
+		return "", "input does not match any value of value-name", true
+	}
+	var result strings.Builder
+	for _, field := range fields {
+		fmt.Fprintf(&result, "%20s: %s\r\n", field[0], field[1])
+	}
+	return result.String(), "", true
+}
+
+// Returns the fields of a menu for a print or get command, and the name of the field to get.
+func (s *Server) fields(line string) (fields [][2]string, get string, ok bool) {
+	menu, found := strings.CutSuffix(line, " print")
+	if !found {
+		menu, get, found = strings.Cut(line, " get ")
+		if get = strings.TrimSpace(get); !found || get == "" || strings.ContainsAny(get, " ;") {
+			return nil, "", false
+		}
+	}
+	switch menu {
+	case "/system resource":
+		fields = [][2]string{
+			{"uptime", "1d2h3m4s"},
+			{"version", s.conf.Version},
+			{"board-name", "FakeRouterOS"},
+			{"platform", "MikroTik"},
+		}
+	case "/system routerboard":
+		if s.conf.Model == "" {
+			fields = [][2]string{{"routerboard", "no"}}
+		} else {
+			fields = [][2]string{
+				{"routerboard", "yes"},
+				{"model", s.conf.Model},
+				{"firmware-type", "fake"},
+			}
+		}
+	default:
+		return nil, "", false
+	}
+	return fields, get, true
+}
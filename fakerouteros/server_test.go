@@ -0,0 +1,344 @@
+/*
+  MIT License
+  Copyright (c) 2020 Star Brilliant
+  Permission is hereby granted, free of charge, to any person obtaining a copy
+  of this software and associated documentation files (the "Software"), to deal
+  in the Software without restriction, including without limitation the rights
+  to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+  copies of the Software, and to permit persons to whom the Software is
+  furnished to do so, subject to the following conditions:
+  The above copyright notice and this permission notice shall be included in
+  all copies or substantial portions of the Software.
+  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+  AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+  LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+  OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+  SOFTWARE.
+*/
+
+package fakerouteros
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// startServer serves on a random local port until the test ends.
+func startServer(t *testing.T, conf Config) (*Server, string) {
+	t.Helper()
+	if conf.Users == nil {
+		conf.Users = map[string]string{"admin": "secret"}
+	}
+	s, err := NewServer(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(l)
+	t.Cleanup(func() {
+		s.Close()
+	})
+	return s, l.Addr().String()
+}
+
+func clientConfig(s *Server, user string, auth ssh.AuthMethod) *ssh.ClientConfig {
+	return &ssh.ClientConfig{
+		User:            user,
+		Auth:            []ssh.AuthMethod{auth},
+		HostKeyCallback: ssh.FixedHostKey(s.HostKey()),
+		Timeout:         10 * time.Second,
+	}
+}
+
+func dial(t *testing.T, s *Server, addr string) *ssh.Client {
+	t.Helper()
+	client, err := ssh.Dial("tcp", addr, clientConfig(s, "admin", ssh.Password("secret")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		client.Close()
+	})
+	return client
+}
+
+// runShell writes the lines to a shell without a terminal, and returns what it printed.
+func runShell(t *testing.T, client *ssh.Client, lines ...string) string {
+	t.Helper()
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+	var output strings.Builder
+	session.Stdin = strings.NewReader(strings.Join(append(lines, "/quit"), "\n") + "\n")
+	session.Stdout = &output
+	err = session.Shell()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = session.Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return output.String()
+}
+
+func TestShellBeeps(t *testing.T) {
+	var mu sync.Mutex
+	var seen []Command
+	s, addr := startServer(t, Config{
+		OnCommand: func(cmd Command) {
+			mu.Lock()
+			seen = append(seen, cmd)
+			mu.Unlock()
+		},
+	})
+	output := runShell(t, dial(t, s, addr), ":beep as-value frequency=440 length=100ms; :delay 200ms; :beep frequency=880 length=50ms;")
+	if output != "" {
+		t.Errorf("got output %q, want none without a terminal", output)
+	}
+
+	beeps := s.Beeps()
+	if len(beeps) != 2 {
+		t.Fatalf("got %d beeps, want 2", len(beeps))
+	}
+	if beeps[0].Frequency != 440 || beeps[0].Length != 100*time.Millisecond || beeps[0].User != "admin" {
+		t.Errorf("first beep is %+v", beeps[0])
+	}
+	if beeps[1].Frequency != 880 || beeps[1].Length != 50*time.Millisecond {
+		t.Errorf("second beep is %+v", beeps[1])
+	}
+	// The second beep waits for the delay
+	if gap := beeps[1].Time.Sub(beeps[0].Time); gap < 200*time.Millisecond || gap > 400*time.Millisecond {
+		t.Errorf("beeps are %v apart, want 200ms", gap)
+	}
+
+	commands := s.Commands()
+	if len(commands) != 1 || len(commands[0].Beeps) != 2 || commands[0].Error != "" {
+		t.Fatalf("got commands %+v", commands)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(seen) != 1 || seen[0].Line != commands[0].Line {
+		t.Errorf("OnCommand saw %+v", seen)
+	}
+}
+
+func TestShellError(t *testing.T) {
+	s, addr := startServer(t, Config{})
+	output := runShell(t, dial(t, s, addr), ":beep frequency=440; :put hello; :beep frequency=880")
+	if !strings.Contains(output, "bad command name put") {
+		t.Errorf("got output %q", output)
+	}
+	// Statements before the error are still run, like on a router
+	if beeps := s.Beeps(); len(beeps) != 1 || beeps[0].Frequency != 440 {
+		t.Errorf("got beeps %+v", beeps)
+	}
+	if commands := s.Commands(); len(commands) != 1 || commands[0].Error == "" {
+		t.Errorf("got commands %+v", commands)
+	}
+}
+
+func TestExec(t *testing.T) {
+	s, addr := startServer(t, Config{Version: "6.49.10 (long-term)", Model: "hAP ac lite"})
+	client := dial(t, s, addr)
+
+	tests := []struct {
+		command string
+		want    []string
+	}{
+		{"/system resource print", []string{"             version: 6.49.10 (long-term)\r\n"}},
+		{"/system routerboard print", []string{"         routerboard: yes\r\n", "               model: hAP ac lite\r\n"}},
+		{"/system resource get version", []string{"6.49.10 (long-term)\r\n"}},
+		{"/system routerboard get model", []string{"hAP ac lite\r\n"}},
+	}
+	for _, test := range tests {
+		session, err := client.NewSession()
+		if err != nil {
+			t.Fatal(err)
+		}
+		output, err := session.Output(test.command)
+		session.Close()
+		if err != nil {
+			t.Errorf("%s: %v", test.command, err)
+			continue
+		}
+		for _, want := range test.want {
+			if !strings.Contains(string(output), want) {
+				t.Errorf("%s: got %q, want it to contain %q", test.command, output, want)
+			}
+		}
+	}
+
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+	output, err := session.CombinedOutput(":put hello")
+	var exitErr *ssh.ExitError
+	if !errors.As(err, &exitErr) || exitErr.ExitStatus() != 1 {
+		t.Errorf("got error %v, want exit status 1", err)
+	}
+	if !strings.Contains(string(output), "bad command name put") {
+		t.Errorf("got output %q", output)
+	}
+
+	session, err = client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+	output, err = session.CombinedOutput("/system resource get colour")
+	if err == nil || !strings.Contains(string(output), "input does not match any value of value-name") {
+		t.Errorf("got output %q and error %v for a field that does not exist", output, err)
+	}
+}
+
+func TestNoBeep(t *testing.T) {
+	s, addr := startServer(t, Config{NoBeep: true})
+	output := runShell(t, dial(t, s, addr), ":beep length=0", ":delay 10ms")
+	if !strings.Contains(output, "bad command name beep") {
+		t.Errorf("got output %q", output)
+	}
+	if beeps := s.Beeps(); len(beeps) != 0 {
+		t.Errorf("got beeps %+v", beeps)
+	}
+	// Other commands still work
+	if commands := s.Commands(); len(commands) != 2 || commands[1].Error != "" {
+		t.Errorf("got commands %+v", commands)
+	}
+}
+
+func TestAuthentication(t *testing.T) {
+	_, authorized, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	authorizedSigner, err := ssh.NewSignerFromKey(authorized)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, other, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherSigner, err := ssh.NewSignerFromKey(other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, addr := startServer(t, Config{
+		AuthorizedKeys: []ssh.PublicKey{authorizedSigner.PublicKey()},
+	})
+
+	tests := []struct {
+		name string
+		user string
+		auth ssh.AuthMethod
+		ok   bool
+	}{
+		{"password", "admin", ssh.Password("secret"), true},
+		{"wrong password", "admin", ssh.Password("wrong"), false},
+		{"unknown user", "guest", ssh.Password("secret"), false},
+		{"authorized key", "admin", ssh.PublicKeys(authorizedSigner), true},
+		{"authorized key for an unknown user", "guest", ssh.PublicKeys(authorizedSigner), false},
+		{"other key", "admin", ssh.PublicKeys(otherSigner), false},
+	}
+	for _, test := range tests {
+		client, err := ssh.Dial("tcp", addr, clientConfig(s, test.user, test.auth))
+		if err == nil {
+			client.Close()
+		}
+		if (err == nil) != test.ok {
+			t.Errorf("%s: got error %v", test.name, err)
+		}
+	}
+}
+
+func TestHostKey(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, addr := startServer(t, Config{HostKey: signer})
+	if string(s.HostKey().Marshal()) != string(signer.PublicKey().Marshal()) {
+		t.Fatal("HostKey does not return the configured key")
+	}
+
+	// A server with a generated key is a different host
+	other, _ := startServer(t, Config{})
+	_, err = ssh.Dial("tcp", addr, clientConfig(other, "admin", ssh.Password("secret")))
+	if err == nil {
+		t.Error("connected although the host key does not match")
+	}
+}
+
+func TestForwarding(t *testing.T) {
+	target, targetAddr := startServer(t, Config{Identity: "target"})
+	jump, jumpAddr := startServer(t, Config{Forwarding: true})
+	closed, closedAddr := startServer(t, Config{})
+
+	conn, err := dial(t, jump, jumpAddr).Dial("tcp", targetAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sshConn, chans, reqs, err := ssh.NewClientConn(conn, targetAddr, clientConfig(target, "admin", ssh.Password("secret")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := ssh.NewClient(sshConn, chans, reqs)
+	defer client.Close()
+	runShell(t, client, ":beep frequency=523")
+	if beeps := target.Beeps(); len(beeps) != 1 || beeps[0].Frequency != 523 {
+		t.Errorf("got beeps %+v on the target", beeps)
+	}
+	if beeps := jump.Beeps(); len(beeps) != 0 {
+		t.Errorf("got beeps %+v on the jump host", beeps)
+	}
+
+	_, err = dial(t, closed, closedAddr).Dial("tcp", targetAddr)
+	if err == nil {
+		t.Error("forwarded a connection without Forwarding")
+	}
+}
+
+func TestClose(t *testing.T) {
+	s, addr := startServer(t, Config{})
+	client := dial(t, s, addr)
+	err := s.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Closing the server disconnects the client
+	done := make(chan error, 1)
+	go func() {
+		done <- client.Wait()
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("client still connected after Close")
+	}
+	_, err = net.DialTimeout("tcp", addr, time.Second)
+	if err == nil {
+		t.Error("still listening after Close")
+	}
+}
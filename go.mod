@@ -6,6 +6,7 @@ require (
 	github.com/fatih/color v1.18.0
 	github.com/m13253/midimark v0.0.0-20231125183016-7e637b008886
 	golang.org/x/crypto v0.31.0
+	golang.org/x/term v0.27.0
 )
 
 require (
@@ -0,0 +1,168 @@
+/*
+  MIT License
+  Copyright (c) 2020 Star Brilliant
+  Permission is hereby granted, free of charge, to any person obtaining a copy
+  of this software and associated documentation files (the "Software"), to deal
+  in the Software without restriction, including without limitation the rights
+  to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+  copies of the Software, and to permit persons to whom the Software is
+  furnished to do so, subject to the following conditions:
+  The above copyright notice and this permission notice shall be included in
+  all copies or substantial portions of the Software.
+  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+  AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+  LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+  OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+  SOFTWARE.
+*/
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"golang.org/x/term"
+)
+
+// Values of the "HostKeyPolicy" option, deciding what happens to a router not in KnownHosts
+const (
+	// Refuse to connect
+	hostKeyPolicyStrict = "strict"
+	// Trust on first use, adding the key to KnownHosts
+	hostKeyPolicyTOFU = "tofu"
+	// Ask on the terminal whether to add the key to KnownHosts
+	hostKeyPolicyAsk = "ask"
+)
+
+// hostKeyStore checks host keys against the known_hosts file, and adds new ones as the policy allows.
+// A key different from the one already known is never added.
+type hostKeyStore struct {
+	filename string
+	policy   string
+
+	mu    sync.Mutex
+	known ssh.HostKeyCallback
+	stdin *bufio.Reader
+}
+
+func newHostKeyStore(filename, policy string) (*hostKeyStore, error) {
+	// Keys can be added to a file that does not exist yet
+	if policy != hostKeyPolicyStrict {
+		err := createKnownHosts(filename)
+		if err != nil {
+			return nil, err
+		}
+	}
+	known, err := knownhosts.New(filename)
+	if err != nil {
+		return nil, err
+	}
+	return &hostKeyStore{
+		filename: filename,
+		policy:   policy,
+		known:    known,
+		stdin:    bufio.NewReader(os.Stdin),
+	}, nil
+}
+
+// Callback returns the host key callback for a connection, which is nil in a dry run.
+// With HostKeyFingerprint, the key must match it, and KnownHosts is not used.
+func (s *hostKeyStore) Callback(connConf *connConfig) ssh.HostKeyCallback {
+	if s == nil {
+		return nil
+	}
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		if connConf.HostKeyFingerprint != "" {
+			return checkFingerprint(key, connConf.HostKeyFingerprint)
+		}
+		return s.check(hostname, remote, key)
+	}
+}
+
+func (s *hostKeyStore) check(hostname string, remote net.Addr, key ssh.PublicKey) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err := s.known(hostname, remote, key)
+	if !isUnknownHost(err) {
+		return err
+	}
+	switch s.policy {
+	case hostKeyPolicyTOFU:
+	case hostKeyPolicyAsk:
+		if !s.ask(fmt.Sprintf("The host key of %s is not known, %s %s.\nTrust it and add it to %s? [y/N] ", hostname, key.Type(), ssh.FingerprintSHA256(key), s.filename)) {
+			return err
+		}
+	default:
+		return err
+	}
+	return s.add(hostname, key)
+}
+
+// add records the key, and reloads the file so other connections to the same host accept it.
+// s.mu must be held.
+func (s *hostKeyStore) add(hostname string, key ssh.PublicKey) error {
+	err := appendKnownHost(s.filename, hostname, key)
+	if err != nil {
+		return err
+	}
+	known, err := knownhosts.New(s.filename)
+	if err != nil {
+		return err
+	}
+	s.known = known
+	return nil
+}
+
+// Asks a yes or no question, the answer is no if there is no terminal to ask on.
+func (s *hostKeyStore) ask(question string) bool {
+	if !term.IsTerminal(int(os.Stdin.Fd())) {
+		return false
+	}
+	fmt.Print(question)
+	answer, _ := s.stdin.ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
+
+// A host is unknown if known_hosts has no key for it, rather than a different key.
+func isUnknownHost(err error) bool {
+	var keyErr *knownhosts.KeyError
+	return errors.As(err, &keyErr) && len(keyErr.Want) == 0
+}
+
+func checkFingerprint(key ssh.PublicKey, fingerprint string) error {
+	if actual := ssh.FingerprintSHA256(key); actual != fingerprint {
+		return fmt.Errorf("host key %s does not match HostKeyFingerprint %s", actual, fingerprint)
+	}
+	return nil
+}
+
+func createKnownHosts(filename string) error {
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if errors.Is(err, fs.ErrExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+func validateHostKeyPolicy(policy string) error {
+	switch policy {
+	case hostKeyPolicyStrict, hostKeyPolicyTOFU, hostKeyPolicyAsk:
+		return nil
+	}
+	return fmt.Errorf("unknown host key policy %q, must be %q, %q or %q", policy, hostKeyPolicyStrict, hostKeyPolicyTOFU, hostKeyPolicyAsk)
+}
@@ -0,0 +1,382 @@
+/*
+  MIT License
+  Copyright (c) 2020 Star Brilliant
+  Permission is hereby granted, free of charge, to any person obtaining a copy
+  of this software and associated documentation files (the "Software"), to deal
+  in the Software without restriction, including without limitation the rights
+  to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+  copies of the Software, and to permit persons to whom the Software is
+  furnished to do so, subject to the following conditions:
+  The above copyright notice and this permission notice shall be included in
+  all copies or substantial portions of the Software.
+  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+  AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+  LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+  OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+  SOFTWARE.
+*/
+
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const maxUploadSize = 16 << 20
+
+type httpSong struct {
+	ID       int     `json:"id"`
+	Filename string  `json:"filename"`
+	Duration float64 `json:"duration"`
+}
+
+type httpQueueItem struct {
+	Index    int     `json:"index"`
+	Filename string  `json:"filename"`
+	Start    float64 `json:"start"`
+	Duration float64 `json:"duration"`
+	State    string  `json:"state"`
+}
+
+type httpConnection struct {
+	Name          string  `json:"name"`
+	State         string  `json:"state"`
+	Error         string  `json:"error,omitempty"`
+	Song          string  `json:"song,omitempty"`
+	NotesSent     int64   `json:"notes_sent"`
+	LastFrequency float64 `json:"last_frequency"`
+}
+
+type httpStatus struct {
+	Elapsed     float64          `json:"elapsed"`
+	Paused      bool             `json:"paused"`
+	Current     int              `json:"current"`
+	Connections []httpConnection `json:"connections"`
+}
+
+func (app *application) startHTTPServer() {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", app.handleHTTPDashboard)
+	mux.HandleFunc("/api/roll", app.handleHTTPRoll)
+	mux.HandleFunc("/api/status", app.handleHTTPStatus)
+	mux.HandleFunc("/api/connections", app.handleHTTPConnections)
+	mux.HandleFunc("/api/songs", app.handleHTTPSongs)
+	mux.HandleFunc("/api/queue", app.handleHTTPQueue)
+	mux.HandleFunc("/api/queue/", app.handleHTTPQueueItem)
+	mux.HandleFunc("/api/start", app.handleHTTPControl(app.queue.Resume))
+	mux.HandleFunc("/api/pause", app.handleHTTPControl(app.queue.Pause))
+	mux.HandleFunc("/api/stop", app.handleHTTPControl(app.queue.Stop))
+	mux.HandleFunc("/api/skip", app.handleHTTPControl(app.queue.Skip))
+	mux.HandleFunc("/api/events", app.handleHTTPEvents)
+	mux.HandleFunc("/metrics", app.handleHTTPMetrics)
+
+	server := &http.Server{
+		Addr:              app.conf.HTTPListen,
+		Handler:           app.httpAuth(mux),
+		ReadHeaderTimeout: DefaultTimeout,
+	}
+	app.debugChanMessage <- debugEventMessage{
+		Message: fmt.Sprintf("Listening for HTTP on %s", app.conf.HTTPListen),
+	}
+	go func() {
+		err := server.ListenAndServe()
+		app.debugChanMessage <- debugEventMessage{
+			Message: fmt.Sprintf("HTTP server stopped: %v", err),
+		}
+	}()
+}
+
+func (app *application) httpAuth(next http.Handler) http.Handler {
+	if app.conf.HTTPPassword == "" {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		username, password, ok := r.BasicAuth()
+		if !ok ||
+			subtle.ConstantTimeCompare([]byte(username), []byte(app.conf.HTTPUsername)) != 1 ||
+			subtle.ConstantTimeCompare([]byte(password), []byte(app.conf.HTTPPassword)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="MikroTiChestra"`)
+			httpError(w, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (app *application) handleHTTPStatus(w http.ResponseWriter, r *http.Request) {
+	if !httpCheckMethod(w, r, http.MethodGet) {
+		return
+	}
+	status := app.queue.Status()
+	httpJSON(w, http.StatusOK, httpStatus{
+		Elapsed:     status.Elapsed.Seconds(),
+		Paused:      status.Paused,
+		Current:     status.Current,
+		Connections: app.httpConnections(),
+	})
+}
+
+func (app *application) handleHTTPConnections(w http.ResponseWriter, r *http.Request) {
+	if !httpCheckMethod(w, r, http.MethodGet) {
+		return
+	}
+	httpJSON(w, http.StatusOK, app.httpConnections())
+}
+
+func (app *application) httpConnections() []httpConnection {
+	result := make([]httpConnection, len(app.statuses))
+	for i, status := range app.statuses {
+		info := status.Info()
+		result[i] = httpConnection{
+			Name:          info.Name,
+			State:         info.State,
+			Error:         info.Error,
+			Song:          info.Song,
+			NotesSent:     info.NotesSent,
+			LastFrequency: info.LastFrequency,
+		}
+	}
+	return result
+}
+
+// GET lists the songs that can be queued, POST uploads a new one.
+func (app *application) handleHTTPSongs(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		library := app.queue.Library()
+		result := make([]httpSong, len(library))
+		for i, s := range library {
+			result[i] = httpSong{
+				ID:       i,
+				Filename: s.Filename,
+				Duration: s.Duration.Seconds(),
+			}
+		}
+		httpJSON(w, http.StatusOK, result)
+	case http.MethodPost:
+		app.handleHTTPUpload(w, r)
+	default:
+		httpCheckMethod(w, r, http.MethodGet, http.MethodPost)
+	}
+}
+
+// The MIDI file can be either the request body, or a field named "file" in a multipart form.
+// Unless "enqueue=false" is specified, the song is queued after upload.
+func (app *application) handleHTTPUpload(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxUploadSize)
+	filename := r.URL.Query().Get("name")
+	var body io.Reader = r.Body
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType == "multipart/form-data" {
+		file, header, err := r.FormFile("file")
+		if err != nil {
+			httpError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		defer file.Close()
+		body = file
+		if filename == "" {
+			filename = header.Filename
+		}
+	}
+	buf, err := io.ReadAll(body)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	filename = path.Base("/" + filename)
+	if filename == "/" {
+		filename = "upload.mid"
+	}
+
+	var warnings []string
+	seq, err := decodeSongFile(filename, bytes.NewReader(buf), func(err error) {
+		warnings = append(warnings, err.Error())
+	})
+	if err != nil {
+		httpError(w, http.StatusBadRequest, fmt.Sprintf("%s: %v", filename, err))
+		return
+	}
+	s, err := app.newSong(newPlaylistEntry(filename), seq)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, fmt.Sprintf("%s: %v", filename, err))
+		return
+	}
+	var id int
+	if r.URL.Query().Get("enqueue") == "false" {
+		id = app.queue.AddToLibrary(s)
+	} else {
+		id = app.queue.Add(s)
+	}
+	app.debugChanMessage <- debugEventMessage{
+		Message: fmt.Sprintf("Uploaded %s (%v)", filename, s.Duration),
+	}
+	httpJSON(w, http.StatusCreated, struct {
+		httpSong
+		Warnings []string `json:"warnings"`
+	}{
+		httpSong: httpSong{
+			ID:       id,
+			Filename: s.Filename,
+			Duration: s.Duration.Seconds(),
+		},
+		Warnings: warnings,
+	})
+}
+
+// GET lists the queue, POST with "song=<ID>" puts a song from the library to the end of the queue.
+func (app *application) handleHTTPQueue(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		status := app.queue.Status()
+		result := make([]httpQueueItem, 0, len(status.Items))
+		for i, item := range status.Items {
+			state := "pending"
+			if item.Skipped {
+				state = "skipped"
+			} else if i < status.Current {
+				state = "played"
+			} else if i == status.Current {
+				state = "playing"
+				if status.Elapsed >= item.Start+item.Song.Duration {
+					state = "played"
+				}
+			}
+			result = append(result, httpQueueItem{
+				Index:    i,
+				Filename: item.Song.Filename,
+				Start:    item.Start.Seconds(),
+				Duration: item.Song.Duration.Seconds(),
+				State:    state,
+			})
+		}
+		httpJSON(w, http.StatusOK, result)
+	case http.MethodPost:
+		id, err := strconv.Atoi(r.FormValue("song"))
+		if err != nil || !app.queue.Enqueue(id) {
+			httpError(w, http.StatusBadRequest, "invalid song ID")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		httpCheckMethod(w, r, http.MethodGet, http.MethodPost)
+	}
+}
+
+// DELETE /api/queue/<index> removes a song that has not started yet.
+func (app *application) handleHTTPQueueItem(w http.ResponseWriter, r *http.Request) {
+	if !httpCheckMethod(w, r, http.MethodDelete) {
+		return
+	}
+	index, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/api/queue/"))
+	if err != nil {
+		httpError(w, http.StatusNotFound, "invalid queue index")
+		return
+	}
+	if !app.queue.Remove(index) {
+		httpError(w, http.StatusConflict, "song is already playing or removed")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (app *application) handleHTTPControl(action func()) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !httpCheckMethod(w, r, http.MethodPost) {
+			return
+		}
+		action()
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// Server-Sent Events: "message" for connection messages, "note" for notes played.
+func (app *application) handleHTTPEvents(w http.ResponseWriter, r *http.Request) {
+	if !httpCheckMethod(w, r, http.MethodGet) {
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		httpError(w, http.StatusInternalServerError, "streaming not supported")
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	events := app.events.Subscribe(256)
+	defer app.events.Unsubscribe(events)
+	keepAlive := time.NewTicker(15 * time.Second)
+	defer keepAlive.Stop()
+	for {
+		var err error
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepAlive.C:
+			_, err = io.WriteString(w, ": keep-alive\n\n")
+		case event := <-events:
+			switch event := event.(type) {
+			case debugEventMessage:
+				err = writeSSE(w, "message", struct {
+					Hostname string `json:"hostname"`
+					Message  string `json:"message"`
+				}{event.Hostname, event.Message})
+			case debugEventNote:
+				err = writeSSE(w, "note", struct {
+					Hostname    string  `json:"hostname"`
+					Frequency   float64 `json:"frequency"`
+					LengthMilli int64   `json:"length_milli"`
+				}{event.Hostname, event.Frequency, event.LengthMilli})
+			}
+		}
+		if err != nil {
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+func writeSSE(w io.Writer, event string, data interface{}) error {
+	buf, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, buf)
+	return err
+}
+
+func httpCheckMethod(w http.ResponseWriter, r *http.Request, methods ...string) bool {
+	for _, method := range methods {
+		if r.Method == method {
+			return true
+		}
+	}
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	httpError(w, http.StatusMethodNotAllowed, "method not allowed")
+	return false
+}
+
+func httpJSON(w http.ResponseWriter, code int, data interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(data)
+}
+
+func httpError(w http.ResponseWriter, code int, message string) {
+	httpJSON(w, code, struct {
+		Error string `json:"error"`
+	}{message})
+}
@@ -0,0 +1,603 @@
+/*
+  MIT License
+  Copyright (c) 2020 Star Brilliant
+  Permission is hereby granted, free of charge, to any person obtaining a copy
+  of this software and associated documentation files (the "Software"), to deal
+  in the Software without restriction, including without limitation the rights
+  to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+  copies of the Software, and to permit persons to whom the Software is
+  furnished to do so, subject to the following conditions:
+  The above copyright notice and this permission notice shall be included in
+  all copies or substantial portions of the Software.
+  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+  AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+  LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+  OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+  SOFTWARE.
+*/
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/m13253/midimark"
+)
+
+// importABC reads the first tune of an ABC notation file. Each voice ("V:") becomes a part.
+// Simple repeats are played, but first and second endings are not.
+func importABC(r io.Reader) (*midimark.Sequence, error) {
+	p := &abcParser{
+		builder:  newSequenceBuilder(),
+		voices:   make(map[string]*abcVoice),
+		meterNum: 4,
+		meterDen: 4,
+		velocity: 100,
+	}
+	sc := bufio.NewScanner(r)
+	started := false
+	for sc.Scan() {
+		line := sc.Text()
+		if i := strings.IndexByte(line, '%'); i >= 0 && (i == 0 || line[i-1] != '\\') {
+			line = line[:i]
+		}
+		if strings.TrimSpace(line) == "" {
+			if p.inBody {
+				// A blank line ends the tune
+				break
+			}
+			continue
+		}
+		if match := regexABCField.FindStringSubmatch(line); match != nil {
+			if match[1] == "X" {
+				if started {
+					break
+				}
+				started = true
+			}
+			err := p.field(match[1][0], strings.TrimSpace(match[2]))
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if !p.inBody {
+			p.startBody()
+		}
+		err := p.body(line)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	if len(p.order) == 0 {
+		return nil, errors.New("no ABC tune found")
+	}
+	for _, voice := range p.order {
+		voice.flush(p.builder)
+	}
+	return p.builder.Sequence(), nil
+}
+
+var regexABCField = regexp.MustCompile(`^([A-Za-z]):(.*)$`)
+
+type abcParser struct {
+	builder  *sequenceBuilder
+	voices   map[string]*abcVoice
+	order    []*abcVoice
+	voice    *abcVoice
+	inBody   bool
+	title    string
+	unitNum  int64
+	unitDen  int64
+	meterNum int64
+	meterDen int64
+	tempo    float64
+	velocity uint8
+	key      [7]int
+}
+
+type abcVoice struct {
+	name  string
+	track int
+	tick  int64
+	notes []importedNote
+
+	accidentals map[string]int
+	// Notes started by the last note or chord, for ties and broken rhythm
+	lastNotes    []int
+	lastStart    int64
+	tie          bool
+	nextFactor   [2]int64
+	tupletLeft   int
+	tupletFactor [2]int64
+	repeatStart  int
+	repeatTick   int64
+}
+
+func (p *abcParser) field(key byte, value string) error {
+	switch key {
+	case 'T':
+		if p.title == "" {
+			p.title = value
+		}
+	case 'L':
+		num, den, ok := parseABCFraction(value)
+		if !ok {
+			return fmt.Errorf("invalid ABC unit note length %q", value)
+		}
+		p.unitNum, p.unitDen = num, den
+	case 'M':
+		switch value {
+		case "C":
+			p.meterNum, p.meterDen = 4, 4
+		case "C|":
+			p.meterNum, p.meterDen = 2, 2
+		default:
+			if num, den, ok := parseABCFraction(value); ok {
+				p.meterNum, p.meterDen = num, den
+			}
+		}
+	case 'Q':
+		p.tempo = p.parseTempo(value)
+		if p.inBody {
+			tick := int64(0)
+			if p.voice != nil {
+				tick = p.voice.tick
+			}
+			p.builder.SetTempo(tick, p.tempo)
+		}
+	case 'K':
+		p.key = parseABCKey(value)
+		if !p.inBody {
+			p.startBody()
+		}
+	case 'V':
+		id, properties, _ := strings.Cut(value, " ")
+		name := id
+		if match := regexABCVoiceName.FindStringSubmatch(properties); match != nil {
+			name = match[1]
+		}
+		if !p.inBody {
+			p.startBody()
+		}
+		p.selectVoice(id, name)
+	}
+	return nil
+}
+
+var regexABCVoiceName = regexp.MustCompile(`(?:^|\s)(?:name|nm)="([^"]*)"`)
+
+func (p *abcParser) startBody() {
+	p.inBody = true
+	if p.unitDen == 0 {
+		// The default unit depends on the meter
+		if 4*p.meterNum < 3*p.meterDen {
+			p.unitNum, p.unitDen = 1, 16
+		} else {
+			p.unitNum, p.unitDen = 1, 8
+		}
+	}
+	if p.tempo == 0 {
+		p.tempo = 120
+	}
+	p.builder.SetTempo(0, p.tempo)
+}
+
+func (p *abcParser) selectVoice(id, name string) {
+	voice, ok := p.voices[id]
+	if !ok {
+		voice = &abcVoice{
+			name:        name,
+			track:       p.builder.AddTrack(name),
+			accidentals: make(map[string]int),
+		}
+		p.voices[id] = voice
+		p.order = append(p.order, voice)
+	}
+	p.voice = voice
+}
+
+func (p *abcParser) parseTempo(value string) float64 {
+	if i := strings.LastIndexByte(value, '"'); i >= 0 {
+		value = value[i+1:]
+	}
+	beat, bpm, ok := strings.Cut(value, "=")
+	if !ok {
+		// Legacy form, in unit notes per minute
+		n, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		if err != nil {
+			return p.tempo
+		}
+		return n * 4 * float64(p.unitNum) / float64(max(p.unitDen, 1))
+	}
+	n, err := strconv.ParseFloat(strings.TrimSpace(strings.Trim(bpm, `" `)), 64)
+	if err != nil {
+		return p.tempo
+	}
+	quarters := 0.0
+	for _, f := range strings.Fields(beat) {
+		num, den, ok := parseABCFraction(f)
+		if !ok {
+			return p.tempo
+		}
+		quarters += 4 * float64(num) / float64(den)
+	}
+	if quarters == 0 {
+		quarters = 1
+	}
+	return n * quarters
+}
+
+func parseABCFraction(s string) (num, den int64, ok bool) {
+	a, b, found := strings.Cut(strings.TrimSpace(s), "/")
+	num, err := strconv.ParseInt(a, 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	den = 1
+	if found {
+		den, err = strconv.ParseInt(b, 10, 64)
+		if err != nil || den == 0 {
+			return 0, 0, false
+		}
+	}
+	return num, den, true
+}
+
+// Returns the accidental of each letter from C to B in a key such as "G", "F#m" or "D dor".
+func parseABCKey(value string) [7]int {
+	var result [7]int
+	value = strings.TrimSpace(value)
+	if value == "" || value[0] < 'A' || value[0] > 'G' {
+		return result
+	}
+	// Position on the circle of fifths, counting sharps as positive
+	fifths := map[byte]int{'F': -1, 'C': 0, 'G': 1, 'D': 2, 'A': 3, 'E': 4, 'B': 5}[value[0]]
+	value = value[1:]
+	if strings.HasPrefix(value, "#") {
+		fifths += 7
+		value = value[1:]
+	} else if strings.HasPrefix(value, "b") {
+		fifths -= 7
+		value = value[1:]
+	}
+	mode := strings.ToLower(strings.TrimSpace(value))
+	if len(mode) > 3 {
+		mode = mode[:3]
+	}
+	switch mode {
+	case "m", "min", "aeo":
+		fifths -= 3
+	case "mix":
+		fifths--
+	case "dor":
+		fifths -= 2
+	case "phr":
+		fifths -= 4
+	case "lyd":
+		fifths++
+	case "loc":
+		fifths -= 5
+	}
+	letters := "CDEFGAB"
+	for i := 0; i < fifths && i < 7; i++ {
+		result[strings.IndexByte(letters, "FCGDAEB"[i])] = 1
+	}
+	for i := 0; i < -fifths && i < 7; i++ {
+		result[strings.IndexByte(letters, "BEADGCF"[i])] = -1
+	}
+	return result
+}
+
+var abcDynamics = map[string]uint8{
+	"ppp": 30, "pp": 45, "p": 60, "mp": 75, "mf": 90, "f": 105, "ff": 120, "fff": 127,
+}
+
+func (p *abcParser) body(line string) error {
+	if p.voice == nil {
+		p.selectVoice("", p.title)
+	}
+	v := p.voice
+	for i := 0; i < len(line); {
+		c := line[i]
+		i++
+		switch {
+		case c == ' ' || c == '\t' || c == '\\' || c == '`' || c == 'y' || c == ')' || c == '&':
+		case c == '"':
+			i = skipPast(line, i, '"')
+		case c == '!' || c == '+':
+			end := skipPast(line, i, c)
+			if velocity, ok := abcDynamics[line[i:max(i, end-1)]]; ok {
+				p.velocity = velocity
+			}
+			i = end
+		case c == '{':
+			i = skipPast(line, i, '}')
+		case strings.IndexByte(".~HLMOPSTuv", c) >= 0:
+		case c == '-':
+			v.tie = true
+		case c == '(':
+			if i < len(line) && line[i] >= '2' && line[i] <= '9' {
+				n := int64(line[i] - '0')
+				i++
+				q := int64(2)
+				if n == 2 || n == 4 || n == 8 {
+					q = 3
+				}
+				// The (p:q:r form
+				if i+1 < len(line) && line[i] == ':' && line[i+1] >= '1' && line[i+1] <= '9' {
+					q = int64(line[i+1] - '0')
+					i += 2
+				}
+				v.tupletLeft = int(n)
+				if i+1 < len(line) && line[i] == ':' && line[i+1] >= '1' && line[i+1] <= '9' {
+					v.tupletLeft = int(line[i+1] - '0')
+					i += 2
+				}
+				v.tupletFactor = [2]int64{q, n}
+			}
+		case c == '>' || c == '<':
+			n := 1
+			for i < len(line) && line[i] == c {
+				n++
+				i++
+			}
+			// a>b makes a dotted and b shorter
+			den := int64(1) << n
+			long, short := [2]int64{2*den - 1, den}, [2]int64{1, den}
+			if c == '<' {
+				long, short = short, long
+			}
+			v.scaleLast(long)
+			v.nextFactor = short
+		case c == '|' || c == ':' || (c == '[' && i < len(line) && line[i] == '|'):
+			i = p.barLine(line, i-1)
+		case c == '[' && i < len(line) && line[i] >= '1' && line[i] <= '9':
+			// First and second endings are not supported
+			for i < len(line) && (line[i] >= '0' && line[i] <= '9' || line[i] == ',' || line[i] == '-') {
+				i++
+			}
+		case c == '[' && i+1 < len(line) && line[i+1] == ':':
+			end := skipPast(line, i, ']')
+			err := p.field(line[i], strings.TrimSpace(line[i+2:max(i+2, end-1)]))
+			if err != nil {
+				return err
+			}
+			i = end
+			v = p.voice
+		case c == '[':
+			// Chord
+			var keys []int
+			var chordLength int64
+			for i < len(line) && line[i] != ']' {
+				key, length, next, err := p.note(line, i)
+				if err != nil {
+					return err
+				}
+				if next == i {
+					i++
+					continue
+				}
+				if keys == nil {
+					chordLength = length
+				}
+				keys = append(keys, key)
+				i = next
+			}
+			if i < len(line) {
+				i++
+			}
+			num, den, next := parseABCLength(line, i)
+			i = next
+			v.play(p.builder, keys, chordLength*num/den, p.velocity)
+		case c == 'z' || c == 'x':
+			num, den, next := parseABCLength(line, i)
+			i = next
+			v.play(p.builder, nil, wholeNoteTicks(p.unitNum*num, p.unitDen*den), p.velocity)
+		case c == 'Z' || c == 'X':
+			num, den, next := parseABCLength(line, i)
+			i = next
+			v.play(p.builder, nil, wholeNoteTicks(p.meterNum*num, p.meterDen*den), p.velocity)
+		case strings.IndexByte("^_=ABCDEFGabcdefg", c) >= 0:
+			key, length, next, err := p.note(line, i-1)
+			if err != nil {
+				return err
+			}
+			i = next
+			v.play(p.builder, []int{key}, length, p.velocity)
+		default:
+			return fmt.Errorf("ABC error at %q: unexpected %q", line[i-1:], c)
+		}
+	}
+	return nil
+}
+
+// Parses a note with its accidentals, octave and length.
+func (p *abcParser) note(line string, i int) (key int, length int64, next int, err error) {
+	v := p.voice
+	accidental, explicit := 0, false
+	for i < len(line) && strings.IndexByte("^_=", line[i]) >= 0 {
+		explicit = true
+		switch line[i] {
+		case '^':
+			accidental++
+		case '_':
+			accidental--
+		}
+		i++
+	}
+	if i >= len(line) {
+		return 0, 0, i, fmt.Errorf("ABC error: accidental without note")
+	}
+	letter := line[i]
+	octave := 4
+	if letter >= 'a' && letter <= 'g' {
+		octave = 5
+		letter -= 'a' - 'A'
+	} else if letter < 'A' || letter > 'G' {
+		return 0, 0, i, nil
+	}
+	i++
+	for i < len(line) && (line[i] == '\'' || line[i] == ',') {
+		if line[i] == '\'' {
+			octave++
+		} else {
+			octave--
+		}
+		i++
+	}
+	index := strings.IndexByte("CDEFGAB", letter)
+	// Accidentals last until the end of the bar
+	name := fmt.Sprintf("%c%d", letter, octave)
+	if explicit {
+		v.accidentals[name] = accidental
+	} else if a, ok := v.accidentals[name]; ok {
+		accidental = a
+	} else {
+		accidental = p.key[index]
+	}
+	key = 12*(octave+1) + []int{0, 2, 4, 5, 7, 9, 11}[index] + accidental
+	num, den, i := parseABCLength(line, i)
+	return key, wholeNoteTicks(p.unitNum*num, p.unitDen*den), i, nil
+}
+
+func parseABCLength(line string, i int) (num, den int64, next int) {
+	num, den = 1, 1
+	start := i
+	for i < len(line) && line[i] >= '0' && line[i] <= '9' {
+		i++
+	}
+	if i > start {
+		num, _ = strconv.ParseInt(line[start:i], 10, 64)
+	}
+	for i < len(line) && line[i] == '/' {
+		i++
+		start = i
+		for i < len(line) && line[i] >= '0' && line[i] <= '9' {
+			i++
+		}
+		if i > start {
+			d, _ := strconv.ParseInt(line[start:i], 10, 64)
+			den *= max(d, 1)
+		} else {
+			den *= 2
+		}
+	}
+	return num, den, i
+}
+
+func (p *abcParser) barLine(line string, i int) int {
+	v := p.voice
+	colonsBefore := 0
+	for i < len(line) && line[i] == ':' {
+		colonsBefore++
+		i++
+	}
+	bars := 0
+	for i < len(line) && (line[i] == '|' || line[i] == '[' || line[i] == ']') {
+		bars++
+		i++
+	}
+	colonsAfter := 0
+	for i < len(line) && line[i] == ':' {
+		colonsAfter++
+		i++
+	}
+	// Endings such as "|1" are not supported
+	for i < len(line) && line[i] >= '0' && line[i] <= '9' {
+		i++
+	}
+	if bars == 0 && colonsBefore >= 2 {
+		// "::" ends one repeat and starts another
+		colonsBefore, colonsAfter = 1, 1
+	}
+	v.accidentals = make(map[string]int)
+	if colonsBefore > 0 {
+		v.repeat()
+	}
+	if colonsAfter > 0 {
+		v.repeatStart, v.repeatTick = len(v.notes), v.tick
+	}
+	return i
+}
+
+func skipPast(line string, i int, c byte) int {
+	end := strings.IndexByte(line[i:], c)
+	if end < 0 {
+		return len(line)
+	}
+	return i + end + 1
+}
+
+// Plays a note, a chord, or a rest if keys is empty.
+func (v *abcVoice) play(builder *sequenceBuilder, keys []int, length int64, velocity uint8) {
+	if v.nextFactor[1] != 0 {
+		length = length * v.nextFactor[0] / v.nextFactor[1]
+		v.nextFactor = [2]int64{}
+	}
+	if v.tupletLeft > 0 {
+		length = length * v.tupletFactor[0] / v.tupletFactor[1]
+		v.tupletLeft--
+	}
+	tie := v.tie
+	v.tie = false
+	lastNotes := v.lastNotes
+	v.lastNotes = nil
+	v.lastStart = v.tick
+	for _, key := range keys {
+		tied := false
+		if tie {
+			for _, j := range lastNotes {
+				if v.notes[j].key == key && v.notes[j].tick+v.notes[j].length == v.tick {
+					v.notes[j].length += length
+					v.lastNotes = append(v.lastNotes, j)
+					tied = true
+					break
+				}
+			}
+		}
+		if !tied {
+			v.notes = append(v.notes, importedNote{tick: v.tick, length: length, key: key, velocity: velocity})
+			v.lastNotes = append(v.lastNotes, len(v.notes)-1)
+		}
+	}
+	v.tick += length
+}
+
+// Changes the length of the last note or chord for broken rhythm.
+func (v *abcVoice) scaleLast(factor [2]int64) {
+	length := v.tick - v.lastStart
+	newLength := length * factor[0] / factor[1]
+	for _, j := range v.lastNotes {
+		v.notes[j].length += newLength - length
+	}
+	v.tick = v.lastStart + newLength
+}
+
+func (v *abcVoice) repeat() {
+	offset := v.tick - v.repeatTick
+	for _, n := range v.notes[v.repeatStart:] {
+		n.tick += offset
+		v.notes = append(v.notes, n)
+	}
+	v.tick += offset
+	v.lastNotes = nil
+	v.repeatStart, v.repeatTick = len(v.notes), v.tick
+}
+
+func (v *abcVoice) flush(builder *sequenceBuilder) {
+	for _, n := range v.notes {
+		builder.AddNote(v.track, n.tick, n.length, n.key, n.velocity)
+	}
+}
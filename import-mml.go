@@ -0,0 +1,206 @@
+/*
+  MIT License
+  Copyright (c) 2020 Star Brilliant
+  Permission is hereby granted, free of charge, to any person obtaining a copy
+  of this software and associated documentation files (the "Software"), to deal
+  in the Software without restriction, including without limitation the rights
+  to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+  copies of the Software, and to permit persons to whom the Software is
+  furnished to do so, subject to the following conditions:
+  The above copyright notice and this permission notice shall be included in
+  all copies or substantial portions of the Software.
+  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+  AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+  LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+  OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+  SOFTWARE.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/m13253/midimark"
+)
+
+// importMML reads Music Macro Language. Parts are separated by "," or ";".
+//
+//	c d e f g a b   Notes, followed by "+" or "#" for sharp, "-" for flat, then an optional length and dots
+//	r or p          Rest
+//	n<key>          Note by MIDI key number
+//	o<n> > <        Set octave, octave up, octave down; o4c is the middle C
+//	l<n>            Default length, 4 is a quarter note
+//	t<n>            Tempo in quarter notes per minute
+//	v<n>            Volume from 0 to 15
+//	&               Tie to the next note
+func importMML(r io.Reader) (*midimark.Sequence, error) {
+	src, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	b := newSequenceBuilder()
+	b.SetTempo(0, 120)
+	for _, part := range strings.FieldsFunc(stripMMLComments(string(src)), func(r rune) bool { return r == ',' || r == ';' }) {
+		if strings.TrimSpace(part) == "" {
+			continue
+		}
+		p := &mmlParser{src: strings.ToLower(part), builder: b, track: b.AddTrack(""), octave: 4, length: wholeNoteTicks(1, 4), velocity: 100}
+		err := p.parse()
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(b.tracks) == 1 {
+		return nil, fmt.Errorf("no MML found")
+	}
+	return b.Sequence(), nil
+}
+
+func stripMMLComments(src string) string {
+	var out strings.Builder
+	for {
+		start := strings.Index(src, "/*")
+		if start < 0 {
+			out.WriteString(src)
+			return out.String()
+		}
+		out.WriteString(src[:start])
+		end := strings.Index(src[start+2:], "*/")
+		if end < 0 {
+			return out.String()
+		}
+		src = src[start+2+end+2:]
+	}
+}
+
+type mmlParser struct {
+	src      string
+	pos      int
+	builder  *sequenceBuilder
+	track    int
+	tick     int64
+	octave   int
+	length   int64
+	velocity uint8
+
+	// The last note, which a tie extends
+	tiedKey    int
+	tiedStart  int64
+	tiedLength int64
+	tie        bool
+}
+
+func (p *mmlParser) parse() error {
+	for p.pos < len(p.src) {
+		c := p.src[p.pos]
+		p.pos++
+		switch c {
+		case ' ', '\t', '\r', '\n':
+		case 'c', 'd', 'e', 'f', 'g', 'a', 'b':
+			semitone := map[byte]int{'c': 0, 'd': 2, 'e': 4, 'f': 5, 'g': 7, 'a': 9, 'b': 11}[c]
+			for p.pos < len(p.src) {
+				if p.src[p.pos] == '+' || p.src[p.pos] == '#' {
+					semitone++
+				} else if p.src[p.pos] == '-' {
+					semitone--
+				} else {
+					break
+				}
+				p.pos++
+			}
+			p.note(12*(p.octave+1)+semitone, p.readLength())
+		case 'n':
+			key, ok := p.readNumber()
+			if !ok {
+				return p.errorf("missing key number")
+			}
+			p.note(key, p.length)
+		case 'r', 'p':
+			p.flush()
+			p.tick += p.readLength()
+		case 'o':
+			octave, ok := p.readNumber()
+			if !ok {
+				return p.errorf("missing octave")
+			}
+			p.octave = octave
+		case '>':
+			p.octave++
+		case '<':
+			p.octave--
+		case 'l':
+			p.length = p.readLength()
+		case 't':
+			tempo, ok := p.readNumber()
+			if !ok || tempo <= 0 {
+				return p.errorf("invalid tempo")
+			}
+			p.builder.SetTempo(p.tick, float64(tempo))
+		case 'v':
+			volume, ok := p.readNumber()
+			if !ok || volume < 0 || volume > 15 {
+				return p.errorf("invalid volume")
+			}
+			p.velocity = uint8(volume * 127 / 15)
+		case '&':
+			p.tie = true
+		default:
+			return p.errorf("unknown command %q", c)
+		}
+	}
+	p.flush()
+	return nil
+}
+
+// Notes are added once we know whether they are tied to the next one.
+func (p *mmlParser) note(key int, length int64) {
+	if p.tie && key == p.tiedKey {
+		p.tiedLength += length
+	} else {
+		p.flush()
+		p.tiedKey, p.tiedStart, p.tiedLength = key, p.tick, length
+	}
+	p.tie = false
+	p.tick += length
+}
+
+func (p *mmlParser) flush() {
+	if p.tiedLength != 0 {
+		p.builder.AddNote(p.track, p.tiedStart, p.tiedLength, p.tiedKey, p.velocity)
+	}
+	p.tiedLength = 0
+	p.tie = false
+}
+
+func (p *mmlParser) readNumber() (int, bool) {
+	start := p.pos
+	n := 0
+	for p.pos < len(p.src) && p.src[p.pos] >= '0' && p.src[p.pos] <= '9' {
+		n = n*10 + int(p.src[p.pos]-'0')
+		p.pos++
+	}
+	return n, p.pos != start
+}
+
+func (p *mmlParser) readLength() int64 {
+	length := p.length
+	if n, ok := p.readNumber(); ok && n > 0 {
+		length = wholeNoteTicks(1, int64(n))
+	}
+	dot := length / 2
+	for p.pos < len(p.src) && p.src[p.pos] == '.' {
+		length += dot
+		dot /= 2
+		p.pos++
+	}
+	return length
+}
+
+func (p *mmlParser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("MML error at %q: %s", p.src[max(0, p.pos-1):min(len(p.src), p.pos+10)], fmt.Sprintf(format, args...))
+}
@@ -0,0 +1,184 @@
+/*
+  MIT License
+  Copyright (c) 2020 Star Brilliant
+  Permission is hereby granted, free of charge, to any person obtaining a copy
+  of this software and associated documentation files (the "Software"), to deal
+  in the Software without restriction, including without limitation the rights
+  to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+  copies of the Software, and to permit persons to whom the Software is
+  furnished to do so, subject to the following conditions:
+  The above copyright notice and this permission notice shall be included in
+  all copies or substantial portions of the Software.
+  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+  AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+  LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+  OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+  SOFTWARE.
+*/
+
+package main
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/m13253/midimark"
+)
+
+type musicXMLScore struct {
+	XMLName  xml.Name
+	PartList []struct {
+		ID   string `xml:"id,attr"`
+		Name string `xml:"part-name"`
+	} `xml:"part-list>score-part"`
+	Parts []struct {
+		ID       string `xml:"id,attr"`
+		Measures []struct {
+			Elements []musicXMLElement `xml:",any"`
+		} `xml:"measure"`
+	} `xml:"part"`
+}
+
+// musicXMLElement is any child of a measure, only the fields of its kind are set.
+type musicXMLElement struct {
+	XMLName   xml.Name
+	Divisions int64     `xml:"divisions"`
+	Duration  int64     `xml:"duration"`
+	Chord     *struct{} `xml:"chord"`
+	Rest      *struct{} `xml:"rest"`
+	Grace     *struct{} `xml:"grace"`
+	Pitch     *struct {
+		Step   string  `xml:"step"`
+		Alter  float64 `xml:"alter"`
+		Octave int     `xml:"octave"`
+	} `xml:"pitch"`
+	Ties []struct {
+		Type string `xml:"type,attr"`
+	} `xml:"tie"`
+	Tempo    string          `xml:"tempo,attr"`
+	Dynamics string          `xml:"dynamics,attr"`
+	Sounds   []musicXMLSound `xml:"sound"`
+}
+
+type musicXMLSound struct {
+	Tempo    string `xml:"tempo,attr"`
+	Dynamics string `xml:"dynamics,attr"`
+}
+
+// importMusicXML reads an uncompressed partwise MusicXML file. Each part becomes a track.
+// Repeats are not played.
+func importMusicXML(r io.Reader) (*midimark.Sequence, error) {
+	var score musicXMLScore
+	err := xml.NewDecoder(r).Decode(&score)
+	if err != nil {
+		return nil, err
+	}
+	if score.XMLName.Local != "score-partwise" {
+		return nil, fmt.Errorf("unsupported MusicXML root element <%s>, only <score-partwise> is supported", score.XMLName.Local)
+	}
+	if len(score.Parts) == 0 {
+		return nil, errors.New("no parts in MusicXML")
+	}
+	names := make(map[string]string)
+	for _, part := range score.PartList {
+		names[part.ID] = strings.TrimSpace(part.Name)
+	}
+
+	b := newSequenceBuilder()
+	b.SetTempo(0, 120)
+	for _, part := range score.Parts {
+		track := b.AddTrack(names[part.ID])
+		divisions := int64(1)
+		velocity := uint8(90)
+		tick, lastStart := int64(0), int64(0)
+		var notes []importedNote
+		// Notes waiting for a tie to continue them, by key
+		tied := make(map[int]int)
+
+		sound := func(s musicXMLSound) {
+			if tempo, err := strconv.ParseFloat(s.Tempo, 64); err == nil && tempo > 0 {
+				b.SetTempo(tick, tempo)
+			}
+			// Percentage of forte, which is velocity 90
+			if dynamics, err := strconv.ParseFloat(s.Dynamics, 64); err == nil && dynamics >= 0 {
+				velocity = uint8(math.Min(127, math.Round(dynamics*0.9)))
+			}
+		}
+
+		for _, measure := range part.Measures {
+			for _, el := range measure.Elements {
+				length := el.Duration * importDivision / divisions
+				switch el.XMLName.Local {
+				case "attributes":
+					if el.Divisions > 0 {
+						divisions = el.Divisions
+					}
+				case "backup":
+					tick -= length
+				case "forward":
+					tick += length
+				case "sound":
+					sound(musicXMLSound{Tempo: el.Tempo, Dynamics: el.Dynamics})
+				case "direction":
+					for _, s := range el.Sounds {
+						sound(s)
+					}
+				case "note":
+					if el.Grace != nil {
+						continue
+					}
+					start := tick
+					if el.Chord != nil {
+						start = lastStart
+					} else {
+						lastStart = tick
+						tick += length
+					}
+					if el.Rest != nil || el.Pitch == nil {
+						continue
+					}
+					step := strings.IndexByte("CDEFGAB", strings.ToUpper(strings.TrimSpace(el.Pitch.Step) + " ")[0])
+					if step < 0 {
+						return nil, fmt.Errorf("invalid MusicXML pitch step %q", el.Pitch.Step)
+					}
+					key := 12*(el.Pitch.Octave+1) + []int{0, 2, 4, 5, 7, 9, 11}[step] + int(math.Round(el.Pitch.Alter))
+					noteVelocity := velocity
+					if dynamics, err := strconv.ParseFloat(el.Dynamics, 64); err == nil && dynamics >= 0 {
+						noteVelocity = uint8(math.Min(127, math.Round(dynamics*0.9)))
+					}
+					tieStart, tieStop := false, false
+					for _, tie := range el.Ties {
+						switch tie.Type {
+						case "start":
+							tieStart = true
+						case "stop":
+							tieStop = true
+						}
+					}
+					if j, ok := tied[key]; ok && tieStop && notes[j].tick+notes[j].length == start {
+						notes[j].length += length
+						if !tieStart {
+							delete(tied, key)
+						}
+						continue
+					}
+					notes = append(notes, importedNote{tick: start, length: length, key: key, velocity: noteVelocity})
+					if tieStart {
+						tied[key] = len(notes) - 1
+					}
+				}
+			}
+		}
+		for _, n := range notes {
+			b.AddNote(track, n.tick, n.length, n.key, n.velocity)
+		}
+	}
+	return b.Sequence(), nil
+}
@@ -0,0 +1,156 @@
+/*
+  MIT License
+  Copyright (c) 2020 Star Brilliant
+  Permission is hereby granted, free of charge, to any person obtaining a copy
+  of this software and associated documentation files (the "Software"), to deal
+  in the Software without restriction, including without limitation the rights
+  to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+  copies of the Software, and to permit persons to whom the Software is
+  furnished to do so, subject to the following conditions:
+  The above copyright notice and this permission notice shall be included in
+  all copies or substantial portions of the Software.
+  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+  AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+  LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+  OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+  SOFTWARE.
+*/
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/m13253/midimark"
+)
+
+// importRTTTL reads Nokia ringtones, such as "Name:d=4,o=5,b=120:8e6,8d#6,p,c".
+// Each ringtone on its own line becomes a part, so several ringtones can be played together.
+func importRTTTL(r io.Reader) (*midimark.Sequence, error) {
+	b := newSequenceBuilder()
+	// Every ringtone has its own tempo, so they are converted to the tempo of the first one
+	tempo := 0.0
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.SplitN(line, ":", 3)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("invalid RTTTL, expecting \"name:defaults:notes\": %q", line)
+		}
+		duration, octave, bpm := int64(4), 6, 63.0
+		for _, option := range strings.Split(fields[1], ",") {
+			key, value, _ := strings.Cut(strings.TrimSpace(option), "=")
+			n, err := strconv.Atoi(strings.TrimSpace(value))
+			if err != nil {
+				return nil, fmt.Errorf("invalid RTTTL option %q", option)
+			}
+			switch strings.ToLower(strings.TrimSpace(key)) {
+			case "d":
+				duration = int64(n)
+			case "o":
+				octave = n
+			case "b":
+				bpm = float64(n)
+			}
+		}
+		if duration <= 0 || bpm <= 0 {
+			return nil, errors.New("invalid RTTTL, duration and tempo must be positive")
+		}
+		if tempo == 0 {
+			tempo = bpm
+			b.SetTempo(0, tempo)
+		}
+
+		track := b.AddTrack(strings.TrimSpace(fields[0]))
+		tick := int64(0)
+		for _, token := range strings.Split(fields[2], ",") {
+			token = strings.ToLower(strings.TrimSpace(token))
+			if token == "" {
+				continue
+			}
+			key, length, err := parseRTTTLNote(token, duration, octave)
+			if err != nil {
+				return nil, err
+			}
+			length = int64(float64(length) * tempo / bpm)
+			b.AddNote(track, tick, length, key, 100)
+			tick += length
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	if tempo == 0 {
+		return nil, errors.New("no RTTTL ringtone found")
+	}
+	return b.Sequence(), nil
+}
+
+// The key is -1 for a pause.
+func parseRTTTLNote(token string, defaultDuration int64, defaultOctave int) (key int, length int64, err error) {
+	i := 0
+	readNumber := func() (int, bool) {
+		start := i
+		for i < len(token) && token[i] >= '0' && token[i] <= '9' {
+			i++
+		}
+		n, err := strconv.Atoi(token[start:i])
+		return n, err == nil
+	}
+
+	duration := defaultDuration
+	if n, ok := readNumber(); ok {
+		duration = int64(n)
+	}
+	if i >= len(token) || duration <= 0 {
+		return 0, 0, fmt.Errorf("invalid RTTTL note %q", token)
+	}
+	semitones := map[byte]int{'c': 0, 'd': 2, 'e': 4, 'f': 5, 'g': 7, 'a': 9, 'b': 11, 'h': 11}
+	semitone, ok := semitones[token[i]]
+	isPause := token[i] == 'p'
+	if !ok && !isPause {
+		return 0, 0, fmt.Errorf("invalid RTTTL note %q", token)
+	}
+	i++
+	if i < len(token) && token[i] == '#' {
+		semitone++
+		i++
+	}
+	dotted := false
+	if i < len(token) && token[i] == '.' {
+		dotted = true
+		i++
+	}
+	octave := defaultOctave
+	if n, ok := readNumber(); ok {
+		octave = n
+	}
+	// Some ringtones put the dot after the octave
+	if i < len(token) && token[i] == '.' {
+		dotted = true
+		i++
+	}
+	if i != len(token) {
+		return 0, 0, fmt.Errorf("invalid RTTTL note %q", token)
+	}
+
+	length = wholeNoteTicks(1, duration)
+	if dotted {
+		length += length / 2
+	}
+	if isPause {
+		return -1, length, nil
+	}
+	// A4 is 440 Hz
+	return 12*(octave+1) + semitone, length, nil
+}
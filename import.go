@@ -0,0 +1,218 @@
+/*
+  MIT License
+  Copyright (c) 2020 Star Brilliant
+  Permission is hereby granted, free of charge, to any person obtaining a copy
+  of this software and associated documentation files (the "Software"), to deal
+  in the Software without restriction, including without limitation the rights
+  to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+  copies of the Software, and to permit persons to whom the Software is
+  furnished to do so, subject to the following conditions:
+  The above copyright notice and this permission notice shall be included in
+  all copies or substantial portions of the Software.
+  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+  AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+  LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+  OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+  SOFTWARE.
+*/
+
+package main
+
+import (
+	"io"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/m13253/midimark"
+)
+
+// A songImporter reads a song written in another format than MIDI.
+// Each part of the song becomes a track, numbered from 1, with its own channel.
+type songImporter func(r io.Reader) (*midimark.Sequence, error)
+
+var songImporters = map[string]songImporter{
+	".rtttl":    importRTTTL,
+	".rtx":      importRTTTL,
+	".mml":      importMML,
+	".abc":      importABC,
+	".musicxml": importMusicXML,
+	".xml":      importMusicXML,
+}
+
+// decodeSongFile chooses the importer by the extension of filename, or decodes a Standard MIDI File.
+func decodeSongFile(filename string, r io.ReadSeeker, warningCallback midimark.WarningCallback) (*midimark.Sequence, error) {
+	if importer, ok := songImporters[strings.ToLower(filepath.Ext(filename))]; ok {
+		return importer(r)
+	}
+	seq, err := midimark.DecodeSequenceFromSMF(r, warningCallback)
+	if err == nil && seq.Header.Format == 2 {
+		pairPatternNotes(seq)
+	}
+	return seq, err
+}
+
+// midimark does not pair the notes of format 2 files, so it is done here in the same way,
+// except that each track is paired on its own.
+func pairPatternNotes(seq *midimark.Sequence) {
+	for _, mtrk := range seq.Tracks {
+		var noteOn [16][128][]*midimark.EventNoteOn
+		for _, event := range mtrk.Events {
+			switch event := event.(type) {
+			case *midimark.EventNoteOn:
+				event.RelatedNoteOff = nil
+				if event.Channel-1 >= 16 || event.Key >= 0x80 {
+					break
+				}
+				noteOn[event.Channel-1][event.Key] = append(noteOn[event.Channel-1][event.Key], event)
+			case *midimark.EventNoteOff:
+				event.RelatedNoteOn = nil
+				if event.Channel-1 >= 16 || event.Key >= 0x80 {
+					break
+				}
+				pending := noteOn[event.Channel-1][event.Key]
+				if len(pending) == 0 {
+					break
+				}
+				event.RelatedNoteOn = pending[0]
+				pending[0].RelatedNoteOff = event
+				noteOn[event.Channel-1][event.Key] = pending[1:]
+			}
+		}
+	}
+}
+
+func isSongFile(filename string) bool {
+	ext := strings.ToLower(filepath.Ext(filename))
+	if ext == ".mid" || ext == ".midi" {
+		return true
+	}
+	_, ok := songImporters[ext]
+	return ok
+}
+
+// Ticks per quarter note of imported songs
+const importDivision = 480
+
+type importedNote struct {
+	tick     int64
+	length   int64
+	key      int
+	velocity uint8
+}
+
+// sequenceBuilder collects the notes of an imported song in any order.
+// Track 0 holds the tempo changes.
+type sequenceBuilder struct {
+	tracks [][]midimark.Event
+}
+
+func newSequenceBuilder() *sequenceBuilder {
+	return &sequenceBuilder{
+		tracks: make([][]midimark.Event, 1),
+	}
+}
+
+// AddTrack returns the new track number.
+func (b *sequenceBuilder) AddTrack(name string) int {
+	track := len(b.tracks)
+	b.tracks = append(b.tracks, nil)
+	if name != "" {
+		b.tracks[track] = append(b.tracks[track], &midimark.MetaEventSequenceTrackName{Text: name})
+	}
+	return track
+}
+
+func (b *sequenceBuilder) SetTempo(tick int64, quartersPerMinute float64) {
+	if quartersPerMinute <= 0 {
+		return
+	}
+	b.tracks[0] = append(b.tracks[0], &midimark.MetaEventSetTempo{
+		EventCommon:  midimark.EventCommon{AbsTick: tick},
+		UsPerQuarter: uint32(60000000 / quartersPerMinute),
+	})
+}
+
+// Notes outside the MIDI range are ignored.
+func (b *sequenceBuilder) AddNote(track int, tick, length int64, key int, velocity uint8) {
+	if key < 0 || key > 127 || length <= 0 {
+		return
+	}
+	if velocity == 0 {
+		velocity = 1
+	}
+	channel := b.channel(track)
+	b.tracks[track] = append(b.tracks[track],
+		&midimark.EventNoteOn{
+			EventCommon: midimark.EventCommon{AbsTick: tick, Channel: channel},
+			Key:         midimark.Key(key),
+			Velocity:    velocity,
+		},
+		&midimark.EventNoteOff{
+			EventCommon: midimark.EventCommon{AbsTick: tick + length, Channel: channel},
+			Key:         midimark.Key(key),
+			Velocity:    0x40,
+		},
+	)
+}
+
+// Tracks take channels in order, skipping the drum channel.
+func (b *sequenceBuilder) channel(track int) uint8 {
+	channel := (track-1)%15 + 1
+	if channel >= 10 {
+		channel++
+	}
+	return uint8(channel)
+}
+
+func (b *sequenceBuilder) Sequence() *midimark.Sequence {
+	seq := &midimark.Sequence{
+		Header: &midimark.MThd{
+			Format:   1,
+			NTrks:    uint16(len(b.tracks)),
+			Division: importDivision,
+		},
+	}
+	position := int64(0)
+	for _, events := range b.tracks {
+		// At the same tick, notes end before new ones start
+		order := func(event midimark.Event) int {
+			switch event.(type) {
+			case *midimark.EventNoteOff:
+				return 1
+			case *midimark.EventNoteOn:
+				return 2
+			}
+			return 0
+		}
+		sort.SliceStable(events, func(i, j int) bool {
+			tickI, tickJ := events[i].Common().AbsTick, events[j].Common().AbsTick
+			return tickI < tickJ || (tickI == tickJ && order(events[i]) < order(events[j]))
+		})
+		endTick := int64(0)
+		if len(events) != 0 {
+			endTick = events[len(events)-1].Common().AbsTick
+		}
+		events = append(events, &midimark.MetaEventEndOfTrack{EventCommon: midimark.EventCommon{AbsTick: endTick}})
+		for _, event := range events {
+			// Keeps the order when events are sorted by file position
+			event.Common().FilePosition = position
+			position++
+		}
+		seq.Tracks = append(seq.Tracks, &midimark.MTrk{Events: events})
+	}
+	seq.ConvertAbsToDeltaTick()
+	seq.CalculateNotePair()
+	seq.CalculateTempoTable()
+	return seq
+}
+
+// Converts a fraction of a whole note into ticks.
+func wholeNoteTicks(numerator, denominator int64) int64 {
+	if denominator == 0 {
+		return 0
+	}
+	return 4 * importDivision * numerator / denominator
+}
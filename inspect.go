@@ -0,0 +1,175 @@
+/*
+  MIT License
+  Copyright (c) 2020 Star Brilliant
+  Permission is hereby granted, free of charge, to any person obtaining a copy
+  of this software and associated documentation files (the "Software"), to deal
+  in the Software without restriction, including without limitation the rights
+  to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+  copies of the Software, and to permit persons to whom the Software is
+  furnished to do so, subject to the following conditions:
+  The above copyright notice and this permission notice shall be included in
+  all copies or substantial portions of the Software.
+  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+  AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+  LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+  OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+  SOFTWARE.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+type inspectSong struct {
+	Filename string         `json:"filename"`
+	Format   uint16         `json:"format"`
+	Division string         `json:"division"`
+	Duration float64        `json:"duration"`
+	Tracks   []inspectTrack `json:"tracks"`
+}
+
+type inspectTrack struct {
+	TrackID        int              `json:"track"`
+	Name           string           `json:"name"`
+	Programs       []inspectProgram `json:"programs"`
+	Channels       []int            `json:"channels"`
+	NoteCount      int              `json:"notes"`
+	MinKey         string           `json:"min_key,omitempty"`
+	MaxKey         string           `json:"max_key,omitempty"`
+	MaxPolyphony   int              `json:"max_polyphony"`
+	PitchBendCount int              `json:"pitch_bends"`
+	Duration       float64          `json:"duration"`
+}
+
+type inspectProgram struct {
+	Time    float64 `json:"time"`
+	Channel int     `json:"channel"`
+	Program int     `json:"program"`
+	Name    string  `json:"name"`
+}
+
+func (app *application) runInspect(args []string) {
+	flags := flag.NewFlagSet("inspect", flag.ExitOnError)
+	jsonFile := flags.String("json", "", "Also write the result in JSON format to this file")
+	flags.Parse(args)
+
+	app.loadSongs(flags.Args())
+
+	result := make([]inspectSong, 0, len(app.songs))
+	for _, song := range app.songs {
+		result = append(result, app.inspectSong(song))
+	}
+
+	for _, s := range result {
+		fmt.Println()
+		fmt.Printf("%s: format %d, %d tracks, %s, duration %.3fs\n", s.Filename, s.Format, len(s.Tracks), s.Division, s.Duration)
+		fmt.Printf("  %-6s %-20s %-10s %6s %-10s %9s %10s %9s\n", "Track", "Name", "Channels", "Notes", "Range", "Polyphony", "Pitch bend", "Duration")
+		for _, t := range s.Tracks {
+			keyRange := "-"
+			if t.NoteCount != 0 {
+				keyRange = t.MinKey + "-" + t.MaxKey
+			}
+			fmt.Printf("  %-6d %-20q %-10s %6d %-10s %9d %10d %8.3fs\n", t.TrackID, t.Name, formatChannels(t.Channels), t.NoteCount, keyRange, t.MaxPolyphony, t.PitchBendCount, t.Duration)
+			for _, p := range t.Programs {
+				fmt.Printf("         Program %d (%s) on channel %d at %.3fs\n", p.Program, p.Name, p.Channel, p.Time)
+			}
+		}
+	}
+
+	if *jsonFile != "" {
+		fmt.Println()
+		fmt.Printf("Writing JSON file: %s\n", *jsonFile)
+		buf, err := json.MarshalIndent(result, "", "  ")
+		if err == nil {
+			err = os.WriteFile(*jsonFile, append(buf, '\n'), 0666)
+		}
+		if err != nil {
+			fmt.Printf("Failed to write JSON file: %v\n", err)
+			os.Exit(1)
+		}
+	}
+}
+
+func (app *application) inspectSong(song *song) inspectSong {
+	header := song.Sequence.Header
+	result := inspectSong{
+		Filename: song.Filename,
+		Format:   header.Format,
+		Duration: app.determineSongDuration(song).Seconds(),
+		Tracks:   make([]inspectTrack, 0, len(song.Sequence.Tracks)),
+	}
+	if header.Framerate != 0 {
+		result.Division = fmt.Sprintf("%d fps, %d ticks per frame", header.Framerate, header.Division)
+	} else {
+		result.Division = fmt.Sprintf("%d ticks per quarter note", header.Division)
+	}
+
+	for trackID, mtrk := range song.Sequence.Tracks {
+		stats := app.analyzeTrack(trackID, mtrk, song.Tempo[mtrk])
+		track := inspectTrack{
+			TrackID:        stats.TrackID,
+			Name:           strings.TrimSpace(stats.Name),
+			Programs:       make([]inspectProgram, 0, len(stats.Programs)),
+			Channels:       make([]int, 0, len(stats.Channels)),
+			NoteCount:      stats.NoteCount,
+			MaxPolyphony:   stats.MaxPolyphony,
+			PitchBendCount: stats.PitchBendCount,
+			Duration:       stats.Duration.Seconds(),
+		}
+		for _, ch := range stats.Channels {
+			track.Channels = append(track.Channels, int(ch))
+		}
+		if stats.NoteCount != 0 {
+			track.MinKey = stats.MinKey.String()
+			track.MaxKey = stats.MaxKey.String()
+		}
+		for _, p := range stats.Programs {
+			track.Programs = append(track.Programs, inspectProgram{
+				Time:    p.Time.Seconds(),
+				Channel: int(p.Channel),
+				Program: int(p.Program),
+				Name:    programName(p.Channel, p.Program),
+			})
+		}
+		result.Tracks = append(result.Tracks, track)
+	}
+	return result
+}
+
+func programName(channel, program uint8) string {
+	if channel == 10 {
+		return "Drum kit"
+	}
+	// midimark numbers programs from 1, same as the General MIDI specification
+	if program < 1 || program > 128 {
+		return "Unknown"
+	}
+	return generalMIDIPrograms[program-1]
+}
+
+var generalMIDIPrograms = [128]string{
+	"Acoustic Grand Piano", "Bright Acoustic Piano", "Electric Grand Piano", "Honky-tonk Piano", "Electric Piano 1", "Electric Piano 2", "Harpsichord", "Clavinet",
+	"Celesta", "Glockenspiel", "Music Box", "Vibraphone", "Marimba", "Xylophone", "Tubular Bells", "Dulcimer",
+	"Drawbar Organ", "Percussive Organ", "Rock Organ", "Church Organ", "Reed Organ", "Accordion", "Harmonica", "Tango Accordion",
+	"Acoustic Guitar (nylon)", "Acoustic Guitar (steel)", "Electric Guitar (jazz)", "Electric Guitar (clean)", "Electric Guitar (muted)", "Overdriven Guitar", "Distortion Guitar", "Guitar Harmonics",
+	"Acoustic Bass", "Electric Bass (finger)", "Electric Bass (pick)", "Fretless Bass", "Slap Bass 1", "Slap Bass 2", "Synth Bass 1", "Synth Bass 2",
+	"Violin", "Viola", "Cello", "Contrabass", "Tremolo Strings", "Pizzicato Strings", "Orchestral Harp", "Timpani",
+	"String Ensemble 1", "String Ensemble 2", "Synth Strings 1", "Synth Strings 2", "Choir Aahs", "Voice Oohs", "Synth Voice", "Orchestra Hit",
+	"Trumpet", "Trombone", "Tuba", "Muted Trumpet", "French Horn", "Brass Section", "Synth Brass 1", "Synth Brass 2",
+	"Soprano Sax", "Alto Sax", "Tenor Sax", "Baritone Sax", "Oboe", "English Horn", "Bassoon", "Clarinet",
+	"Piccolo", "Flute", "Recorder", "Pan Flute", "Blown Bottle", "Shakuhachi", "Whistle", "Ocarina",
+	"Lead 1 (square)", "Lead 2 (sawtooth)", "Lead 3 (calliope)", "Lead 4 (chiff)", "Lead 5 (charang)", "Lead 6 (voice)", "Lead 7 (fifths)", "Lead 8 (bass + lead)",
+	"Pad 1 (new age)", "Pad 2 (warm)", "Pad 3 (polysynth)", "Pad 4 (choir)", "Pad 5 (bowed)", "Pad 6 (metallic)", "Pad 7 (halo)", "Pad 8 (sweep)",
+	"FX 1 (rain)", "FX 2 (soundtrack)", "FX 3 (crystal)", "FX 4 (atmosphere)", "FX 5 (brightness)", "FX 6 (goblins)", "FX 7 (echoes)", "FX 8 (sci-fi)",
+	"Sitar", "Banjo", "Shamisen", "Koto", "Kalimba", "Bagpipe", "Fiddle", "Shanai",
+	"Tinkle Bell", "Agogo", "Steel Drums", "Woodblock", "Taiko Drum", "Melodic Tom", "Synth Drum", "Reverse Cymbal",
+	"Guitar Fret Noise", "Breath Noise", "Seashore", "Bird Tweet", "Telephone Ring", "Helicopter", "Applause", "Gunshot",
+}
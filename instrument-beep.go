@@ -0,0 +1,68 @@
+/*
+  MIT License
+  Copyright (c) 2020 Star Brilliant
+  Permission is hereby granted, free of charge, to any person obtaining a copy
+  of this software and associated documentation files (the "Software"), to deal
+  in the Software without restriction, including without limitation the rights
+  to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+  copies of the Software, and to permit persons to whom the Software is
+  furnished to do so, subject to the following conditions:
+  The above copyright notice and this permission notice shall be included in
+  all copies or substantial portions of the Software.
+  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+  AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+  LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+  OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+  SOFTWARE.
+*/
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// beepDialect plays the PC speaker of a Linux host with the "beep" program.
+// The user needs permission to use the PC speaker, see the manual of beep.
+type beepDialect struct{}
+
+func (beepDialect) Setup() string {
+	return ""
+}
+
+// beep blocks until it finishes, so it runs in the background, and the previous one is stopped first.
+func (beepDialect) Play(tones []tone) string {
+	var command strings.Builder
+	command.WriteString("pkill -x beep 2>/dev/null; beep")
+	for i, t := range tones {
+		if i != 0 {
+			command.WriteString(" -n")
+		}
+		fmt.Fprintf(&command, " -f %.0f -l %d", t.Frequency, toneMilli(t.Length))
+		if t.Rest > 0 && i != len(tones)-1 {
+			fmt.Fprintf(&command, " -D %d", toneMilli(t.Rest))
+		}
+	}
+	command.WriteString(" &\n")
+	return command.String()
+}
+
+func (beepDialect) Busy(tones []tone) time.Duration {
+	return 0
+}
+
+func (beepDialect) Silence() string {
+	return "pkill -x beep 2>/dev/null\n"
+}
+
+func (beepDialect) Capabilities() instrumentCapabilities {
+	return instrumentCapabilities{
+		MinFrequency: 20,
+		MaxFrequency: 20000,
+		MinLength:    1 * time.Millisecond,
+	}
+}
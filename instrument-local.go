@@ -0,0 +1,248 @@
+/*
+  MIT License
+  Copyright (c) 2020 Star Brilliant
+  Permission is hereby granted, free of charge, to any person obtaining a copy
+  of this software and associated documentation files (the "Software"), to deal
+  in the Software without restriction, including without limitation the rights
+  to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+  copies of the Software, and to permit persons to whom the Software is
+  furnished to do so, subject to the following conditions:
+  The above copyright notice and this permission notice shall be included in
+  all copies or substantial portions of the Software.
+  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+  AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+  LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+  OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+  SOFTWARE.
+*/
+
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	localSampleRate = 44100
+	// How far the generated audio runs ahead of the clock
+	localLatency = 50 * time.Millisecond
+	localPeriod  = 10 * time.Millisecond
+	// A quarter of the full scale, square waves are loud
+	localAmplitude = 8192
+	// Used when the "Output" option is not set
+	defaultLocalOutput = "|aplay -q -t raw -f S16_LE -c 1 -r 44100"
+	// The WAV sizes while streaming, when the length is not known yet
+	wavUnknownSize = math.MaxUint32
+)
+
+// localInstrument plays square waves through the sound system of this computer, for rehearsals.
+// The audio is written as 16-bit mono PCM at 44.1 kHz, either to the standard input of a command
+// if Output starts with "|", or to a file or named pipe, with a WAV header if the name ends with ".wav".
+type localInstrument struct {
+	Output string
+	DryRun bool
+
+	mu sync.Mutex
+	// The tones and the sample where they start
+	tones     []tone
+	toneStart int64
+	// Samples generated so far
+	position int64
+	phase    float64
+	err      error
+
+	w        io.WriteCloser
+	cmd      *exec.Cmd
+	done     chan struct{}
+	finished chan struct{}
+}
+
+func (inst *localInstrument) Connect() error {
+	inst.mu.Lock()
+	inst.tones, inst.position, inst.err = nil, 0, nil
+	inst.mu.Unlock()
+
+	switch {
+	case inst.DryRun:
+		inst.w = nopWriteCloser{io.Discard}
+	case strings.HasPrefix(inst.Output, "|"):
+		inst.cmd = exec.Command("sh", "-c", strings.TrimPrefix(inst.Output, "|"))
+		inst.cmd.Stdout, inst.cmd.Stderr = os.Stdout, os.Stderr
+		stdin, err := inst.cmd.StdinPipe()
+		if err != nil {
+			return err
+		}
+		err = inst.cmd.Start()
+		if err != nil {
+			return err
+		}
+		inst.w = stdin
+	default:
+		f, err := os.Create(inst.Output)
+		if err != nil {
+			return err
+		}
+		inst.w = f
+		if strings.HasSuffix(strings.ToLower(inst.Output), ".wav") {
+			_, err = f.Write(wavHeader(wavUnknownSize))
+			if err != nil {
+				f.Close()
+				return err
+			}
+		}
+	}
+
+	inst.done = make(chan struct{})
+	inst.finished = make(chan struct{})
+	go inst.generate(time.Now())
+	return nil
+}
+
+func (inst *localInstrument) Play(tones []tone) (string, error) {
+	inst.mu.Lock()
+	defer inst.mu.Unlock()
+	if inst.err != nil {
+		return "", inst.err
+	}
+	inst.tones = tones
+	inst.toneStart = inst.position
+
+	var command strings.Builder
+	for i, t := range tones {
+		if i != 0 {
+			command.WriteString(" ")
+		}
+		fmt.Fprintf(&command, "%.0fHz/%dms", t.Frequency, toneMilli(t.Length))
+		if t.Rest > 0 && i != len(tones)-1 {
+			fmt.Fprintf(&command, " rest/%dms", toneMilli(t.Rest))
+		}
+	}
+	command.WriteString("\n")
+	return command.String(), nil
+}
+
+func (inst *localInstrument) Silence() (string, error) {
+	return inst.Play(nil)
+}
+
+func (inst *localInstrument) Close() {
+	if inst.done == nil {
+		return
+	}
+	close(inst.done)
+	<-inst.finished
+	inst.done = nil
+
+	// Now that the length is known, fix the WAV header if the file can be rewritten
+	if f, ok := inst.w.(*os.File); ok && strings.HasSuffix(strings.ToLower(inst.Output), ".wav") {
+		if _, err := f.Seek(0, io.SeekStart); err == nil {
+			f.Write(wavHeader(uint32(min(inst.position*2, math.MaxUint32-36))))
+		}
+	}
+	inst.w.Close()
+	if inst.cmd != nil {
+		inst.cmd.Wait()
+		inst.cmd = nil
+	}
+}
+
+func (inst *localInstrument) Capabilities() instrumentCapabilities {
+	return instrumentCapabilities{
+		MinFrequency: 20,
+		MaxFrequency: 20000,
+		MinLength:    1 * time.Millisecond,
+	}
+}
+
+// Keeps the audio localLatency ahead of the clock, so a file fills at the same pace as a sound card.
+func (inst *localInstrument) generate(start time.Time) {
+	defer close(inst.finished)
+	ticker := time.NewTicker(localPeriod)
+	defer ticker.Stop()
+	latency := int64(localLatency.Seconds() * localSampleRate)
+	for {
+		target := int64(time.Since(start).Seconds()*localSampleRate) + latency
+
+		inst.mu.Lock()
+		buf := make([]byte, 0, 2*max(target-inst.position, 0))
+		for ; inst.position < target; inst.position++ {
+			buf = binary.LittleEndian.AppendUint16(buf, uint16(inst.sample()))
+		}
+		inst.mu.Unlock()
+
+		if _, err := inst.w.Write(buf); err != nil {
+			inst.mu.Lock()
+			inst.err = err
+			inst.mu.Unlock()
+			return
+		}
+		select {
+		case <-inst.done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Returns the sample at inst.position, inst.mu must be held.
+func (inst *localInstrument) sample() int16 {
+	offset := inst.position - inst.toneStart
+	for _, t := range inst.tones {
+		length := int64(t.Length.Seconds() * localSampleRate)
+		rest := int64(t.Rest.Seconds() * localSampleRate)
+		if offset >= length+rest {
+			offset -= length + rest
+			continue
+		}
+		if offset >= length {
+			return 0
+		}
+		inst.phase += t.Frequency / localSampleRate
+		inst.phase -= math.Floor(inst.phase)
+		if inst.phase < 0.5 {
+			return localAmplitude
+		}
+		return -localAmplitude
+	}
+	return 0
+}
+
+// The RIFF size is the data size and the rest of the header, unless the size is unknown.
+func wavHeader(dataSize uint32) []byte {
+	riffSize := uint32(wavUnknownSize)
+	if dataSize <= math.MaxUint32-36 {
+		riffSize = dataSize + 36
+	}
+	header := make([]byte, 0, 44)
+	header = append(header, "RIFF"...)
+	header = binary.LittleEndian.AppendUint32(header, riffSize)
+	header = append(header, "WAVEfmt "...)
+	header = binary.LittleEndian.AppendUint32(header, 16)
+	header = binary.LittleEndian.AppendUint16(header, 1) // PCM
+	header = binary.LittleEndian.AppendUint16(header, 1) // Mono
+	header = binary.LittleEndian.AppendUint32(header, localSampleRate)
+	header = binary.LittleEndian.AppendUint32(header, localSampleRate*2)
+	header = binary.LittleEndian.AppendUint16(header, 2)
+	header = binary.LittleEndian.AppendUint16(header, 16)
+	header = append(header, "data"...)
+	header = binary.LittleEndian.AppendUint32(header, dataSize)
+	return header
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
@@ -0,0 +1,101 @@
+//go:build unix
+
+/*
+  MIT License
+  Copyright (c) 2020 Star Brilliant
+  Permission is hereby granted, free of charge, to any person obtaining a copy
+  of this software and associated documentation files (the "Software"), to deal
+  in the Software without restriction, including without limitation the rights
+  to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+  copies of the Software, and to permit persons to whom the Software is
+  furnished to do so, subject to the following conditions:
+  The above copyright notice and this permission notice shall be included in
+  all copies or substantial portions of the Software.
+  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+  AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+  LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+  OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+  SOFTWARE.
+*/
+
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestLocalInstrumentWAVHeaderFIFO(t *testing.T) {
+	fifo := filepath.Join(t.TempDir(), "out.wav")
+	if err := syscall.Mkfifo(fifo, 0o600); err != nil {
+		t.Skip(err)
+	}
+
+	header := make(chan []byte, 1)
+	go func() {
+		f, err := os.Open(fifo)
+		if err != nil {
+			header <- nil
+			return
+		}
+		defer f.Close()
+		buf := make([]byte, 44)
+		if _, err := io.ReadFull(f, buf); err != nil {
+			header <- nil
+			return
+		}
+		header <- buf
+		io.Copy(io.Discard, f)
+	}()
+
+	inst := &localInstrument{Output: fifo}
+	if err := inst.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	inst.Play([]tone{{Frequency: 440, Length: 50 * time.Millisecond}})
+	time.Sleep(100 * time.Millisecond)
+	inst.Close()
+
+	buf := <-header
+	if buf == nil {
+		t.Fatal("failed to read the WAV header")
+	}
+	if riffSize := binary.LittleEndian.Uint32(buf[4:8]); riffSize != 0xffffffff {
+		t.Errorf("RIFF size = %#x, want 0xffffffff", riffSize)
+	}
+	if dataSize := binary.LittleEndian.Uint32(buf[40:44]); dataSize != 0xffffffff {
+		t.Errorf("data size = %#x, want 0xffffffff", dataSize)
+	}
+}
+
+func TestLocalInstrumentWAVHeaderFile(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "out.wav")
+	inst := &localInstrument{Output: name}
+	if err := inst.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	inst.Play([]tone{{Frequency: 440, Length: 50 * time.Millisecond}})
+	time.Sleep(100 * time.Millisecond)
+	inst.Close()
+
+	buf, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(buf) < 44 {
+		t.Fatalf("file is %d bytes, want a WAV header", len(buf))
+	}
+	if riffSize := binary.LittleEndian.Uint32(buf[4:8]); riffSize != uint32(len(buf)-8) {
+		t.Errorf("RIFF size = %d, want %d", riffSize, len(buf)-8)
+	}
+	if dataSize := binary.LittleEndian.Uint32(buf[40:44]); dataSize != uint32(len(buf)-44) {
+		t.Errorf("data size = %d, want %d", dataSize, len(buf)-44)
+	}
+}
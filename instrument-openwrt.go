@@ -0,0 +1,73 @@
+/*
+  MIT License
+  Copyright (c) 2020 Star Brilliant
+  Permission is hereby granted, free of charge, to any person obtaining a copy
+  of this software and associated documentation files (the "Software"), to deal
+  in the Software without restriction, including without limitation the rights
+  to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+  copies of the Software, and to permit persons to whom the Software is
+  furnished to do so, subject to the following conditions:
+  The above copyright notice and this permission notice shall be included in
+  all copies or substantial portions of the Software.
+  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+  AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+  LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+  OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+  SOFTWARE.
+*/
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"time"
+)
+
+const defaultOpenWrtPWM = "/sys/class/pwm/pwmchip0/pwm0"
+
+// openWrtDialect plays a buzzer connected to a PWM output of an OpenWrt device, through sysfs.
+type openWrtDialect struct {
+	// Such as /sys/class/pwm/pwmchip0/pwm0, exported on connecting if needed
+	PWM string
+}
+
+// The shell variables P and T keep the PWM path and the background job playing the tones.
+func (d openWrtDialect) Setup() string {
+	return fmt.Sprintf("P=%s; [ -d $P ] || echo ${P##*pwm} >${P%%/pwm*}/export; echo 0 >$P/enable\n", d.PWM)
+}
+
+// Each tone sets the period and a 50% duty cycle, which is always valid after setting the duty cycle to 0 first.
+func (openWrtDialect) Play(tones []tone) string {
+	var command strings.Builder
+	command.WriteString("kill $T 2>/dev/null; (")
+	for i, t := range tones {
+		period := int64(math.Round(1e9 / t.Frequency))
+		fmt.Fprintf(&command, "echo 0 >$P/duty_cycle; echo %d >$P/period; echo %d >$P/duty_cycle; echo 1 >$P/enable; usleep %d; ",
+			period, period/2, toneMilli(t.Length)*1000)
+		if t.Rest > 0 && i != len(tones)-1 {
+			fmt.Fprintf(&command, "echo 0 >$P/enable; usleep %d; ", toneMilli(t.Rest)*1000)
+		}
+	}
+	command.WriteString("echo 0 >$P/enable) & T=$!\n")
+	return command.String()
+}
+
+func (openWrtDialect) Busy(tones []tone) time.Duration {
+	return 0
+}
+
+func (openWrtDialect) Silence() string {
+	return "kill $T 2>/dev/null; echo 0 >$P/enable\n"
+}
+
+func (openWrtDialect) Capabilities() instrumentCapabilities {
+	return instrumentCapabilities{
+		MinFrequency: 20,
+		MaxFrequency: 20000,
+		MinLength:    1 * time.Millisecond,
+	}
+}
@@ -0,0 +1,73 @@
+/*
+  MIT License
+  Copyright (c) 2020 Star Brilliant
+  Permission is hereby granted, free of charge, to any person obtaining a copy
+  of this software and associated documentation files (the "Software"), to deal
+  in the Software without restriction, including without limitation the rights
+  to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+  copies of the Software, and to permit persons to whom the Software is
+  furnished to do so, subject to the following conditions:
+  The above copyright notice and this permission notice shall be included in
+  all copies or substantial portions of the Software.
+  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+  AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+  LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+  OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+  SOFTWARE.
+*/
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// routerOSDialect plays the beeper of a MikroTik router.
+type routerOSDialect struct{}
+
+func (routerOSDialect) Setup() string {
+	return ""
+}
+
+// :beep returns immediately, so each tone but the last waits for itself and its rest to finish before the next one starts.
+func (routerOSDialect) Play(tones []tone) string {
+	var command strings.Builder
+	for i, t := range tones {
+		if i != 0 {
+			command.WriteString(" ")
+		}
+		fmt.Fprintf(&command, ":beep as-value frequency=%.0f length=%dms;", t.Frequency, toneMilli(t.Length))
+		if i != len(tones)-1 {
+			fmt.Fprintf(&command, " :delay %dms;", toneMilli(t.Length)+toneMilli(t.Rest))
+		}
+	}
+	command.WriteString("\n")
+	return command.String()
+}
+
+// The shell waits in each :delay, which is everything but the last tone.
+func (routerOSDialect) Busy(tones []tone) time.Duration {
+	var busy time.Duration
+	for _, t := range tones[:max(len(tones)-1, 0)] {
+		busy += time.Duration(toneMilli(t.Length)+toneMilli(t.Rest)) * time.Millisecond
+	}
+	return busy
+}
+
+// A new beep replaces the sounding one, so a short beep at the lowest frequency silences the router.
+func (routerOSDialect) Silence() string {
+	return ":beep as-value frequency=20 length=1ms;\n"
+}
+
+// MikroTik restricts the frequency in 20 Hz - 20,000 Hz.
+func (routerOSDialect) Capabilities() instrumentCapabilities {
+	return instrumentCapabilities{
+		MinFrequency: 20,
+		MaxFrequency: 20000,
+		MinLength:    1 * time.Millisecond,
+	}
+}
@@ -0,0 +1,163 @@
+/*
+  MIT License
+  Copyright (c) 2020 Star Brilliant
+  Permission is hereby granted, free of charge, to any person obtaining a copy
+  of this software and associated documentation files (the "Software"), to deal
+  in the Software without restriction, including without limitation the rights
+  to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+  copies of the Software, and to permit persons to whom the Software is
+  furnished to do so, subject to the following conditions:
+  The above copyright notice and this permission notice shall be included in
+  all copies or substantial portions of the Software.
+  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+  AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+  LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+  OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+  SOFTWARE.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"time"
+)
+
+// Instrument is a device playing one tone at a time.
+type Instrument interface {
+	// Connect opens the device. After a failure, it can be called again after Close.
+	Connect() error
+	// Play plays the tones one after another, replacing the tone already sounding.
+	// It returns the command sent to the device, for the log.
+	Play(tones []tone) (string, error)
+	// Silence stops the sounding tone.
+	Silence() (string, error)
+	Close()
+	Capabilities() instrumentCapabilities
+}
+
+type tone struct {
+	Frequency float64
+	Length    time.Duration
+	// Silence after the tone before the next one starts
+	Rest time.Duration
+}
+
+type instrumentCapabilities struct {
+	MinFrequency float64
+	MaxFrequency float64
+	MinLength    time.Duration
+}
+
+// Values of the "Driver" option
+const (
+	driverRouterOS = "routeros"
+	driverBeep     = "beep"
+	driverOpenWrt  = "openwrt"
+	driverLocal    = "local"
+)
+
+func (c *connection) newInstrument(addr string) Instrument {
+	if c.ConnConf.Driver == driverLocal {
+		return &localInstrument{Output: c.ConnConf.Output, DryRun: c.AppConf.DryRun}
+	}
+	return &shellInstrument{c: c, addr: addr, dialect: newShellDialect(c.ConnConf)}
+}
+
+// Returns the commands for the device of a connection other than the local one.
+func newShellDialect(connConf *connConfig) shellDialect {
+	switch connConf.Driver {
+	case driverBeep:
+		return beepDialect{}
+	case driverOpenWrt:
+		return openWrtDialect{PWM: connConf.PWM}
+	default:
+		return routerOSDialect{}
+	}
+}
+
+// A shellDialect writes the commands for a device controlled through an SSH shell.
+type shellDialect interface {
+	// Setup returns the command run once after connecting, or an empty string
+	Setup() string
+	Play(tones []tone) string
+	// Busy returns how long the shell is kept busy running the command from Play
+	Busy(tones []tone) time.Duration
+	Silence() string
+	Capabilities() instrumentCapabilities
+}
+
+// shellInstrument sends commands to an SSH shell, or nowhere in a dry run.
+type shellInstrument struct {
+	c       *connection
+	addr    string
+	dialect shellDialect
+	pool    *sessionPool
+	cleanup func()
+}
+
+func (inst *shellInstrument) Connect() error {
+	var stdins []io.Writer
+	if inst.c.AppConf.DryRun {
+		for i := 0; i < inst.c.ConnConf.Sessions; i++ {
+			stdins = append(stdins, io.Discard)
+		}
+		inst.cleanup = func() {}
+	} else {
+		var err error
+		stdins, inst.cleanup, err = inst.c.openShell(inst.addr)
+		if err != nil {
+			return err
+		}
+	}
+	inst.pool = newSessionPool(stdins)
+	if setup := inst.dialect.Setup(); setup != "" {
+		err := inst.pool.WriteAll(setup)
+		if err != nil {
+			inst.Close()
+			return err
+		}
+	}
+	return nil
+}
+
+func (inst *shellInstrument) Play(tones []tone) (string, error) {
+	command := inst.dialect.Play(tones)
+	saturated, err := inst.pool.Write(command, inst.dialect.Busy(tones))
+	inst.c.Status.SessionCommand(saturated)
+	return command, err
+}
+
+func (inst *shellInstrument) Silence() (string, error) {
+	command := inst.dialect.Silence()
+	saturated, err := inst.pool.Write(command, 0)
+	inst.c.Status.SessionCommand(saturated)
+	return command, err
+}
+
+func (inst *shellInstrument) Close() {
+	if inst.cleanup != nil {
+		inst.cleanup()
+		inst.cleanup = nil
+	}
+}
+
+func (inst *shellInstrument) Capabilities() instrumentCapabilities {
+	return inst.dialect.Capabilities()
+}
+
+// Rounds up to whole milliseconds, because the devices take lengths in milliseconds.
+func toneMilli(length time.Duration) int64 {
+	return int64((length + 999999*time.Nanosecond) / time.Millisecond)
+}
+
+func validateDriver(driver string) error {
+	switch driver {
+	case driverRouterOS, driverBeep, driverOpenWrt, driverLocal:
+		return nil
+	}
+	return fmt.Errorf("unknown driver %q, must be %q, %q, %q or %q", driver, driverRouterOS, driverBeep, driverOpenWrt, driverLocal)
+}
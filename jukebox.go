@@ -0,0 +1,145 @@
+/*
+  MIT License
+  Copyright (c) 2020 Star Brilliant
+  Permission is hereby granted, free of charge, to any person obtaining a copy
+  of this software and associated documentation files (the "Software"), to deal
+  in the Software without restriction, including without limitation the rights
+  to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+  copies of the Software, and to permit persons to whom the Software is
+  furnished to do so, subject to the following conditions:
+  The above copyright notice and this permission notice shall be included in
+  all copies or substantial portions of the Software.
+  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+  AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+  LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+  OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+  SOFTWARE.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+type jukeboxFile struct {
+	Size    int64
+	ModTime time.Time
+	Queued  bool
+}
+
+func (app *application) runJukebox(args []string) {
+	flags := flag.NewFlagSet("jukebox", flag.ExitOnError)
+	interval := flags.Duration("interval", 2*time.Second, "How often to check the directory for new MIDI files")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		fmt.Println()
+		fmt.Println("Please specify which directory to watch for MIDI files.")
+		os.Exit(1)
+	}
+	dir := flags.Arg(0)
+
+	app.loadConfig()
+	app.loadKnownHosts()
+
+	queue := newSongQueue(nil, app.loop, app.shuffle)
+	queue.LeadTime = app.conf.InitialDelay
+	if queue.LeadTime < 1*time.Second {
+		queue.LeadTime = 1 * time.Second
+	}
+
+	// Files already in the directory are queued before connecting
+	files := make(map[string]*jukeboxFile)
+	fmt.Printf("Watching directory: %s\n", dir)
+	for _, filename := range app.scanJukeboxDir(dir, files, true) {
+		fmt.Printf("Loading %s\n", filename)
+		s, err := app.loadSong(newPlaylistEntry(filename))
+		if err != nil {
+			fmt.Printf("%s: %v\n", filename, err)
+			continue
+		}
+		queue.Add(s)
+	}
+
+	app.play(queue, func() {
+		go app.watchJukeboxDir(dir, *interval, files, queue)
+	})
+}
+
+func (app *application) watchJukeboxDir(dir string, interval time.Duration, files map[string]*jukeboxFile, queue *songQueue) {
+	for {
+		time.Sleep(interval)
+		for _, filename := range app.scanJukeboxDir(dir, files, false) {
+			s, err := app.loadSong(newPlaylistEntry(filename))
+			if err != nil {
+				app.debugChanMessage <- debugEventMessage{
+					Message: fmt.Sprintf("%s: %v", filename, err),
+				}
+				continue
+			}
+			queue.Add(s)
+			app.debugChanMessage <- debugEventMessage{
+				Message: fmt.Sprintf("Queued %s (%v)", filename, s.Duration),
+			}
+		}
+	}
+}
+
+// Returns new MIDI files in name order.
+// Unless initial is true, a file is only returned after its size and
+// modification time stop changing, so we do not read a file being uploaded.
+func (app *application) scanJukeboxDir(dir string, files map[string]*jukeboxFile, initial bool) []string {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if initial {
+			fmt.Printf("Failed to read directory: %v\n", err)
+			os.Exit(1)
+		}
+		app.debugChanMessage <- debugEventMessage{
+			Message: fmt.Sprintf("Failed to read directory: %v", err),
+		}
+		return nil
+	}
+
+	var ready []string
+	for _, entry := range entries {
+		if entry.IsDir() || !isSongFile(entry.Name()) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		filename := filepath.Join(dir, entry.Name())
+		file, ok := files[filename]
+		if !ok {
+			files[filename] = &jukeboxFile{
+				Size:    info.Size(),
+				ModTime: info.ModTime(),
+				Queued:  initial,
+			}
+			if initial {
+				ready = append(ready, filename)
+			}
+			continue
+		}
+		if file.Queued {
+			continue
+		}
+		if file.Size != info.Size() || !file.ModTime.Equal(info.ModTime()) {
+			file.Size, file.ModTime = info.Size(), info.ModTime()
+			continue
+		}
+		file.Queued = true
+		ready = append(ready, filename)
+	}
+	sort.Strings(ready)
+	return ready
+}
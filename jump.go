@@ -0,0 +1,240 @@
+/*
+  MIT License
+  Copyright (c) 2020 Star Brilliant
+  Permission is hereby granted, free of charge, to any person obtaining a copy
+  of this software and associated documentation files (the "Software"), to deal
+  in the Software without restriction, including without limitation the rights
+  to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+  copies of the Software, and to permit persons to whom the Software is
+  furnished to do so, subject to the following conditions:
+  The above copyright notice and this permission notice shall be included in
+  all copies or substantial portions of the Software.
+  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+  AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+  LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+  OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+  SOFTWARE.
+*/
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// jumpDialer connects to routers through the jump hosts in their ProxyJump.
+type jumpDialer struct {
+	hostKeys *hostKeyStore
+	// Whether connections through the same jump hosts share one SSH connection to them
+	shared bool
+
+	mu sync.Mutex
+	// Shared connections to the last hop, by the names of the hops
+	clients map[string]*jumpChain
+}
+
+// jumpChain is an SSH connection to each hop, each one made through the previous one.
+type jumpChain struct {
+	clients []*ssh.Client
+
+	// When shared, closed once the hops are connected or failed, with the error in err
+	ready chan struct{}
+	err   error
+}
+
+func newJumpDialer(hostKeys *hostKeyStore, shared bool) *jumpDialer {
+	return &jumpDialer{
+		hostKeys: hostKeys,
+		shared:   shared,
+		clients:  make(map[string]*jumpChain),
+	}
+}
+
+// Dial connects to the router of a connection, through its jump hosts if it has any.
+// The returned release function closes the connections to the jump hosts, unless they are shared.
+func (d *jumpDialer) Dial(connConf *connConfig, sshConf *ssh.ClientConfig) (sshClient *ssh.Client, release func(), err error) {
+	addr := connConf.address()
+	if len(connConf.Jumps) == 0 {
+		sshClient, err = ssh.Dial("tcp", addr, sshConf)
+		return sshClient, func() {}, err
+	}
+
+	chain, err := d.chain(connConf.Jumps)
+	if err != nil {
+		return nil, nil, err
+	}
+	release = func() {
+		if !d.shared {
+			chain.Close()
+		}
+	}
+	sshClient, err = dialThrough(chain.Last(), addr, sshConf)
+	if err != nil {
+		if !d.shared {
+			chain.Close()
+		} else if !chain.Alive() {
+			// The jump host has gone away, so it is connected again next time.
+			// Otherwise, other routers are still using it, even if this one refused to log in.
+			d.discard(connConf.Jumps, chain)
+			chain.Close()
+		}
+		return nil, nil, err
+	}
+	return sshClient, release, nil
+}
+
+// Returns the chain to the jump hosts, dialing it unless it is shared and already connected.
+// A shared chain is dialed without holding d.mu, so a stuck jump host does not block other connections.
+func (d *jumpDialer) chain(jumps []*connConfig) (*jumpChain, error) {
+	chain := &jumpChain{}
+	if !d.shared {
+		if err := d.dialChain(chain, jumps); err != nil {
+			return nil, err
+		}
+		return chain, nil
+	}
+	key := jumpNames(jumps)
+	d.mu.Lock()
+	if inFlight, ok := d.clients[key]; ok {
+		d.mu.Unlock()
+		<-inFlight.ready
+		if inFlight.err != nil {
+			return nil, inFlight.err
+		}
+		return inFlight, nil
+	}
+	chain.ready = make(chan struct{})
+	d.clients[key] = chain
+	d.mu.Unlock()
+
+	chain.err = d.dialChain(chain, jumps)
+	if chain.err != nil {
+		// Dialed again next time
+		d.discard(jumps, chain)
+	}
+	close(chain.ready)
+	if chain.err != nil {
+		return nil, chain.err
+	}
+	return chain, nil
+}
+
+func (d *jumpDialer) discard(jumps []*connConfig, chain *jumpChain) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	key := jumpNames(jumps)
+	if d.clients[key] == chain {
+		delete(d.clients, key)
+	}
+}
+
+// Connects the hops of chain one after another.
+func (d *jumpDialer) dialChain(chain *jumpChain, jumps []*connConfig) error {
+	for _, jump := range jumps {
+		sshConf := &ssh.ClientConfig{
+			User: jump.Username,
+			Auth: []ssh.AuthMethod{
+				ssh.Password(jump.Password),
+			},
+			HostKeyCallback: d.hostKeys.Callback(jump),
+			Timeout:         DefaultTimeout,
+		}
+		sshClient, err := dialThrough(chain.Last(), jump.address(), sshConf)
+		if err != nil {
+			chain.Close()
+			chain.clients = nil
+			return fmt.Errorf("jump host %s: %w", jump.Name, err)
+		}
+		chain.clients = append(chain.clients, sshClient)
+	}
+	return nil
+}
+
+// Returns the connection to the last hop, or nil before the first hop is connected.
+func (chain *jumpChain) Last() *ssh.Client {
+	if len(chain.clients) == 0 {
+		return nil
+	}
+	return chain.clients[len(chain.clients)-1]
+}
+
+// Alive asks the last hop to reply, so a dead jump host is not mistaken for a router refusing the connection.
+func (chain *jumpChain) Alive() bool {
+	replied := make(chan error, 1)
+	go func() {
+		_, _, err := chain.Last().SendRequest("keepalive@openssh.com", true, nil)
+		replied <- err
+	}()
+	select {
+	case err := <-replied:
+		return err == nil
+	case <-time.After(DefaultTimeout):
+		return false
+	}
+}
+
+// Closes the hops from the last one.
+func (chain *jumpChain) Close() {
+	for i := len(chain.clients) - 1; i >= 0; i-- {
+		chain.clients[i].Close()
+	}
+}
+
+// Connects to addr through an SSH connection, or directly if it is nil.
+func dialThrough(through *ssh.Client, addr string, sshConf *ssh.ClientConfig) (*ssh.Client, error) {
+	var conn net.Conn
+	var err error
+	if through == nil {
+		conn, err = net.DialTimeout("tcp", addr, sshConf.Timeout)
+	} else {
+		conn, err = through.Dial("tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	// ssh.NewClientConn ignores sshConf.Timeout, and connections through a jump host do not support deadlines.
+	// So a stuck handshake is ended by closing the connection.
+	var timer *time.Timer
+	if sshConf.Timeout > 0 {
+		timer = time.AfterFunc(sshConf.Timeout, func() {
+			conn.Close()
+		})
+	}
+	sshConn, chans, reqs, err := ssh.NewClientConn(conn, addr, sshConf)
+	if timer != nil && !timer.Stop() {
+		// The connection is closed or about to be
+		if err == nil {
+			sshConn.Close()
+		}
+		return nil, fmt.Errorf("ssh: handshake with %s timed out after %v", addr, sshConf.Timeout)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return ssh.NewClient(sshConn, chans, reqs), nil
+}
+
+func jumpNames(jumps []*connConfig) string {
+	names := make([]string, len(jumps))
+	for i, jump := range jumps {
+		names[i] = jump.Name
+	}
+	return strings.Join(names, ",")
+}
+
+// For messages, such as " via bastion,inner"
+func jumpVia(jumps []*connConfig) string {
+	if len(jumps) == 0 {
+		return ""
+	}
+	return " via " + jumpNames(jumps)
+}
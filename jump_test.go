@@ -0,0 +1,279 @@
+/*
+  MIT License
+  Copyright (c) 2020 Star Brilliant
+  Permission is hereby granted, free of charge, to any person obtaining a copy
+  of this software and associated documentation files (the "Software"), to deal
+  in the Software without restriction, including without limitation the rights
+  to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+  copies of the Software, and to permit persons to whom the Software is
+  furnished to do so, subject to the following conditions:
+  The above copyright notice and this permission notice shall be included in
+  all copies or substantial portions of the Software.
+  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+  AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+  LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+  OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+  SOFTWARE.
+*/
+
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/m13253/MikroTiChestra/fakerouteros"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// startFakeBastion serves a fake router accepting TCP forwarding, for user "jump".
+func startFakeBastion(t *testing.T) (*fakerouteros.Server, string) {
+	t.Helper()
+	bastion, err := fakerouteros.NewServer(fakerouteros.Config{
+		Users:      map[string]string{"jump": "jpw"},
+		Forwarding: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go bastion.Serve(l)
+	t.Cleanup(func() {
+		bastion.Close()
+	})
+	return bastion, l.Addr().String()
+}
+
+func testJumpConnConfig(t *testing.T, name, addr, username, password string, jumps ...*connConfig) *connConfig {
+	t.Helper()
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	connConf := &connConfig{
+		Name:     name,
+		Host:     host,
+		Port:     port,
+		Username: username,
+		Password: password,
+		Jumps:    jumps,
+	}
+	for _, jump := range jumps {
+		connConf.ProxyJump = append(connConf.ProxyJump, jump.Name)
+	}
+	return connConf
+}
+
+func TestJumpDialerSharedChain(t *testing.T) {
+	bastion, bastionAddr := startFakeBastion(t)
+	router, routerAddr := startFakeRouter(t)
+
+	knownHosts := filepath.Join(t.TempDir(), "known_hosts")
+	err := os.WriteFile(knownHosts, []byte(
+		knownhosts.Line([]string{knownhosts.Normalize(bastionAddr)}, bastion.HostKey())+"\n"+
+			knownhosts.Line([]string{knownhosts.Normalize(routerAddr)}, router.HostKey())+"\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostKeys, err := newHostKeyStore(knownHosts, hostKeyPolicyStrict)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := newJumpDialer(hostKeys, true)
+	jump := testJumpConnConfig(t, "bastion", bastionAddr, "jump", "jpw")
+	good := testJumpConnConfig(t, "A", routerAddr, "admin", "secret", jump)
+	bad := testJumpConnConfig(t, "B", routerAddr, "admin", "wrong", jump)
+	dial := func(connConf *connConfig) (*ssh.Client, error) {
+		client, _, err := d.Dial(connConf, &ssh.ClientConfig{
+			User:            connConf.Username,
+			Auth:            []ssh.AuthMethod{ssh.Password(connConf.Password)},
+			HostKeyCallback: hostKeys.Callback(connConf),
+			Timeout:         10 * time.Second,
+		})
+		return client, err
+	}
+
+	first, err := dial(good)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	chain := d.clients["bastion"]
+	if chain == nil {
+		t.Fatal("the chain to the jump host is not shared")
+	}
+
+	// A router refusing to log in leaves the jump host to the others
+	_, err = dial(bad)
+	if err == nil {
+		t.Fatal("logged in with a wrong password")
+	}
+	if d.clients["bastion"] != chain {
+		t.Fatal("the shared chain was discarded after an authentication failure")
+	}
+	session, err := first.NewSession()
+	if err != nil {
+		t.Fatalf("the first router was disconnected: %v", err)
+	}
+	session.Close()
+	second, err := dial(good)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second.Close()
+
+	// A dead jump host is connected again next time
+	bastion.Close()
+	chain.Last().Wait()
+	_, err = dial(good)
+	if err == nil {
+		t.Fatal("connected through a closed jump host")
+	}
+	if _, ok := d.clients["bastion"]; ok {
+		t.Error("the dead chain is still shared")
+	}
+}
+
+// startSilentListener accepts TCP connections but never speaks SSH.
+func startSilentListener(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mu sync.Mutex
+	var conns []net.Conn
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			conns = append(conns, conn)
+			mu.Unlock()
+		}
+	}()
+	t.Cleanup(func() {
+		l.Close()
+		mu.Lock()
+		defer mu.Unlock()
+		for _, conn := range conns {
+			conn.Close()
+		}
+	})
+	return l.Addr().String()
+}
+
+func TestJumpDialerHandshakeTimeout(t *testing.T) {
+	bastion, bastionAddr := startFakeBastion(t)
+	silentAddr := startSilentListener(t)
+
+	knownHosts := filepath.Join(t.TempDir(), "known_hosts")
+	err := os.WriteFile(knownHosts, []byte(knownhosts.Line([]string{knownhosts.Normalize(bastionAddr)}, bastion.HostKey())+"\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostKeys, err := newHostKeyStore(knownHosts, hostKeyPolicyStrict)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := newJumpDialer(hostKeys, true)
+	jump := testJumpConnConfig(t, "bastion", bastionAddr, "jump", "jpw")
+	router := testJumpConnConfig(t, "A", silentAddr, "admin", "secret", jump)
+
+	start := time.Now()
+	_, _, err = d.Dial(router, &ssh.ClientConfig{
+		User:            router.Username,
+		Auth:            []ssh.AuthMethod{ssh.Password(router.Password)},
+		HostKeyCallback: hostKeys.Callback(router),
+		Timeout:         200 * time.Millisecond,
+	})
+	if err == nil {
+		t.Fatal("connected to a router that never spoke SSH")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("the handshake took %v to time out, want about 200ms", elapsed)
+	}
+}
+
+func TestJumpDialerStuckJumpHost(t *testing.T) {
+	bastion, bastionAddr := startFakeBastion(t)
+	router, routerAddr := startFakeRouter(t)
+	stuckAddr := startSilentListener(t)
+
+	knownHosts := filepath.Join(t.TempDir(), "known_hosts")
+	err := os.WriteFile(knownHosts, []byte(
+		knownhosts.Line([]string{knownhosts.Normalize(bastionAddr)}, bastion.HostKey())+"\n"+
+			knownhosts.Line([]string{knownhosts.Normalize(routerAddr)}, router.HostKey())+"\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostKeys, err := newHostKeyStore(knownHosts, hostKeyPolicyStrict)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := newJumpDialer(hostKeys, true)
+	stuck := testJumpConnConfig(t, "stuck", stuckAddr, "jump", "jpw")
+	jump := testJumpConnConfig(t, "bastion", bastionAddr, "jump", "jpw")
+	dial := func(connConf *connConfig) error {
+		client, _, err := d.Dial(connConf, &ssh.ClientConfig{
+			User:            connConf.Username,
+			Auth:            []ssh.AuthMethod{ssh.Password(connConf.Password)},
+			HostKeyCallback: hostKeys.Callback(connConf),
+			Timeout:         10 * time.Second,
+		})
+		if err == nil {
+			client.Close()
+		}
+		return err
+	}
+
+	first := testJumpConnConfig(t, "A", routerAddr, "admin", "secret", stuck)
+	second := testJumpConnConfig(t, "B", routerAddr, "admin", "secret", jump)
+	stuckDone := make(chan error, 1)
+	go func() {
+		stuckDone <- dial(first)
+	}()
+	// Wait until the stuck chain is being dialed
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		d.mu.Lock()
+		_, ok := d.clients["stuck"]
+		d.mu.Unlock()
+		if ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the stuck chain is not being dialed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- dial(second)
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("a stuck jump host blocked connections through another one")
+	}
+	select {
+	case <-stuckDone:
+		t.Fatal("the stuck jump host finished before the other connection")
+	default:
+	}
+}
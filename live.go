@@ -0,0 +1,430 @@
+/*
+  MIT License
+  Copyright (c) 2020 Star Brilliant
+  Permission is hereby granted, free of charge, to any person obtaining a copy
+  of this software and associated documentation files (the "Software"), to deal
+  in the Software without restriction, including without limitation the rights
+  to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+  copies of the Software, and to permit persons to whom the Software is
+  furnished to do so, subject to the following conditions:
+  The above copyright notice and this permission notice shall be included in
+  all copies or substantial portions of the Software.
+  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+  AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+  LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+  OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+  SOFTWARE.
+*/
+
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"math"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/m13253/midimark"
+)
+
+const (
+	// A beep must have a length when it starts, so held notes stop after this long
+	liveNoteLength = 10 * time.Second
+	liveSongName   = "Live input"
+	liveBufferSize = 256
+)
+
+// liveRouter allocates the routers to notes received from a live MIDI input.
+// MIDI channel N is routed like track N of a MIDI file.
+type liveRouter struct {
+	conf    *config
+	mu      sync.Mutex
+	outputs []chan midimark.Event
+	voices  []liveVoice
+}
+
+type liveVoice struct {
+	Channel uint8
+	Key     midimark.Key
+	Since   time.Time
+	Active  bool
+}
+
+// An event for the connection with index Output, sent after the voices are unlocked.
+type liveDelivery struct {
+	Output int
+	Event  midimark.Event
+}
+
+// runLive plays MIDI from the network or a local ALSA port instead of from files.
+func (app *application) runLive(args []string) {
+	flags := flag.NewFlagSet("live", flag.ExitOnError)
+	protocol := flags.String("protocol", "rtpmidi", "MIDI input, \"rtpmidi\", \"udp\" or \"tcp\" from the network, or \"alsa\" for a local ALSA sequencer port")
+	listen := flags.String("listen", ":5004", "Address to receive MIDI on, for rtpmidi the control port with data on the next port")
+	name := flags.String("name", "MikroTiChestra", "Session name shown to RTP-MIDI peers, or ALSA client name")
+	flags.Parse(args)
+
+	app.loadConfig()
+	app.loadKnownHosts()
+
+	var serve func()
+	var err error
+	switch *protocol {
+	case "rtpmidi":
+		serve, err = app.listenRTPMIDI(*listen, *name)
+	case "udp":
+		serve, err = app.listenRawMIDIUDP(*listen)
+	case "tcp":
+		serve, err = app.listenRawMIDITCP(*listen)
+	case "alsa":
+		serve, err = app.listenALSA(*name)
+	default:
+		err = fmt.Errorf("unknown protocol %q, must be \"rtpmidi\", \"udp\", \"tcp\" or \"alsa\"", *protocol)
+	}
+	if err != nil {
+		fmt.Printf("Failed to listen for MIDI: %v\n", err)
+		os.Exit(1)
+	}
+	if *protocol != "alsa" {
+		fmt.Printf("Listening for %s MIDI on %s\n", *protocol, *listen)
+	}
+
+	app.live = newLiveRouter(&app.conf)
+	queue := newSongQueue(nil, false, false)
+	queue.Close()
+	app.play(queue, func() {
+		go serve()
+	})
+}
+
+func (app *application) listenRTPMIDI(listen, name string) (serve func(), err error) {
+	controlAddr, err := net.ResolveUDPAddr("udp", listen)
+	if err != nil {
+		return nil, err
+	}
+	control, err := net.ListenUDP("udp", controlAddr)
+	if err != nil {
+		return nil, err
+	}
+	dataAddr := *control.LocalAddr().(*net.UDPAddr)
+	dataAddr.Port++
+	data, err := net.ListenUDP("udp", &dataAddr)
+	if err != nil {
+		control.Close()
+		return nil, err
+	}
+	session := newRTPMIDISession(app, name)
+	return func() {
+		session.Serve(control, data)
+	}, nil
+}
+
+func (app *application) listenRawMIDIUDP(listen string) (serve func(), err error) {
+	conn, err := net.ListenPacket("udp", listen)
+	if err != nil {
+		return nil, err
+	}
+	return func() {
+		// Running status is kept for each sender
+		parsers := make(map[string]*midiStreamParser)
+		buf := make([]byte, 65536)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				app.debugChanMessage <- debugEventMessage{
+					Message: fmt.Sprintf("MIDI over UDP: %v", err),
+				}
+				return
+			}
+			p, ok := parsers[addr.String()]
+			if !ok {
+				p = &midiStreamParser{}
+				parsers[addr.String()] = p
+			}
+			for _, b := range buf[:n] {
+				if event, _ := p.Feed(b); event != nil {
+					app.live.Dispatch(event)
+				}
+			}
+		}
+	}, nil
+}
+
+func (app *application) listenRawMIDITCP(listen string) (serve func(), err error) {
+	listener, err := net.Listen("tcp", listen)
+	if err != nil {
+		return nil, err
+	}
+	return func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				app.debugChanMessage <- debugEventMessage{
+					Message: fmt.Sprintf("MIDI over TCP: %v", err),
+				}
+				return
+			}
+			go app.serveRawMIDIStream(conn)
+		}
+	}, nil
+}
+
+func (app *application) serveRawMIDIStream(conn net.Conn) {
+	defer conn.Close()
+	app.debugChanMessage <- debugEventMessage{
+		Message: fmt.Sprintf("MIDI stream connected from %v", conn.RemoteAddr()),
+	}
+	var p midiStreamParser
+	r := bufio.NewReader(conn)
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			app.debugChanMessage <- debugEventMessage{
+				Message: fmt.Sprintf("MIDI stream from %v closed", conn.RemoteAddr()),
+			}
+			return
+		}
+		if event, _ := p.Feed(b); event != nil {
+			app.live.Dispatch(event)
+		}
+	}
+}
+
+func newLiveRouter(conf *config) *liveRouter {
+	r := &liveRouter{
+		conf:    conf,
+		outputs: make([]chan midimark.Event, len(conf.Connections)),
+		voices:  make([]liveVoice, len(conf.Connections)),
+	}
+	for i := range r.outputs {
+		r.outputs[i] = make(chan midimark.Event, liveBufferSize)
+	}
+	return r
+}
+
+// Output returns the events for the i-th connection.
+func (r *liveRouter) Output(i int) <-chan midimark.Event {
+	if r == nil {
+		return nil
+	}
+	return r.outputs[i]
+}
+
+// Dispatch sends an event to the connections playing it.
+// A connection falling behind blocks the input, but not while the voices are locked.
+func (r *liveRouter) Dispatch(event midimark.Event) {
+	r.mu.Lock()
+	deliveries := r.route(event)
+	r.mu.Unlock()
+	for _, d := range deliveries {
+		r.outputs[d.Output] <- d.Event
+	}
+}
+
+// Assigns an event to voices, which must be locked, and returns where to send it.
+func (r *liveRouter) route(event midimark.Event) []liveDelivery {
+	var deliveries []liveDelivery
+	switch event := event.(type) {
+	case *midimark.EventNoteOn:
+		i := r.allocate(event)
+		if i < 0 {
+			return nil
+		}
+		r.voices[i] = liveVoice{
+			Channel: event.Channel,
+			Key:     event.Key,
+			Since:   time.Now(),
+			Active:  true,
+		}
+		deliveries = append(deliveries, liveDelivery{Output: i, Event: event})
+	case *midimark.EventNoteOff:
+		for i, voice := range r.voices {
+			if voice.Active && voice.Channel == event.Channel && voice.Key == event.Key {
+				r.voices[i].Active = false
+				deliveries = append(deliveries, liveDelivery{Output: i, Event: event})
+			}
+		}
+	case *midimark.EventControlChange:
+		switch event.Control {
+		case 0x78, 0x7b: // All sound off, all notes off
+			for i, voice := range r.voices {
+				if voice.Active && voice.Channel == event.Channel {
+					r.voices[i].Active = false
+					deliveries = append(deliveries, liveDelivery{Output: i, Event: &midimark.EventNoteOff{EventCommon: event.EventCommon, Key: voice.Key}})
+				}
+			}
+		}
+		for _, i := range r.candidates(event.Channel) {
+			deliveries = append(deliveries, liveDelivery{Output: i, Event: event})
+		}
+	case *midimark.EventPitchWheelChange:
+		for _, i := range r.candidates(event.Channel) {
+			deliveries = append(deliveries, liveDelivery{Output: i, Event: event})
+		}
+	}
+	return deliveries
+}
+
+// Prefers the router already playing the same key, then an idle router, then the one playing the oldest note.
+func (r *liveRouter) allocate(event *midimark.EventNoteOn) int {
+	candidates := r.candidates(event.Channel)
+	best := -1
+	for _, i := range candidates {
+		voice := r.voices[i]
+		if voice.Active && voice.Channel == event.Channel && voice.Key == event.Key {
+			return i
+		}
+		if best < 0 ||
+			(!voice.Active && r.voices[best].Active) ||
+			(voice.Active == r.voices[best].Active && voice.Since.Before(r.voices[best].Since)) {
+			best = i
+		}
+	}
+	return best
+}
+
+// Returns the connections playing a MIDI channel, in the same way as loadNotes chooses tracks.
+func (r *liveRouter) candidates(channel uint8) []int {
+	track := uint16(channel)
+	_, defined := r.conf.TracksDefined[track]
+	var result []int
+	for i, connConf := range r.conf.Connections {
+		if _, ok := connConf.Tracks.Map[track]; ok || (!defined && connConf.Tracks.OtherTracks) {
+			result = append(result, i)
+		}
+	}
+	return result
+}
+
+// playLive plays the events from the live router as soon as they arrive.
+// Controller states are kept in controllers, so they survive reconnecting.
+func (c *connection) playLive(controllers *controllerState) error {
+	var sounding *midimark.EventNoteOn
+	var soundingFrequency float64
+	var soundingEnd time.Time
+	// The key of the sounding note is released, but a pedal still holds it
+	var soundingKeyUp, soundingSostenuto bool
+	stop := func() error {
+		sounding = nil
+		if time.Now().After(soundingEnd) {
+			return nil
+		}
+		_, err := c.Instrument.Silence()
+		return err
+	}
+	for event := range c.Live {
+		switch event := event.(type) {
+		case *midimark.EventNoteOn:
+			frequency, err := c.sendLiveNote(controllers, event, liveNoteLength)
+			if err != nil {
+				return err
+			}
+			if event.Channel != 10 {
+				sounding, soundingFrequency, soundingEnd = event, frequency, time.Now().Add(liveNoteLength)
+				soundingKeyUp, soundingSostenuto = false, false
+			}
+		case *midimark.EventNoteOff:
+			if sounding == nil || sounding.Channel != event.Channel || sounding.Key != event.Key {
+				continue
+			}
+			if controllers.Sustain[event.Channel-1] || soundingSostenuto {
+				soundingKeyUp = true
+				continue
+			}
+			if err := stop(); err != nil {
+				return err
+			}
+		default:
+			if sounding == nil || event.Common().Channel != sounding.Channel {
+				controllers.Follow(event)
+				continue
+			}
+			ch := sounding.Channel - 1
+			wasSostenuto := controllers.Sostenuto[ch]
+			controllers.Follow(event)
+			if _, ok := event.(*midimark.EventControlChange); ok {
+				// Pressing the sostenuto pedal only holds notes already sounding
+				if controllers.Sostenuto[ch] != wasSostenuto {
+					soundingSostenuto = controllers.Sostenuto[ch]
+				}
+				if soundingKeyUp && !controllers.Sustain[ch] && !soundingSostenuto {
+					if err := stop(); err != nil {
+						return err
+					}
+					continue
+				}
+			}
+			// Bend the sounding note
+			remaining := time.Until(soundingEnd)
+			if remaining <= 0 {
+				sounding = nil
+				continue
+			}
+			frequency, _ := midiNoteToHertz(controllers.Pitch(sounding, 0), c.Instrument.Capabilities())
+			if math.Round(frequency) == math.Round(soundingFrequency) {
+				continue
+			}
+			frequency, err := c.sendLiveNote(controllers, sounding, remaining)
+			if err != nil {
+				return err
+			}
+			soundingFrequency = frequency
+		}
+	}
+	return nil
+}
+
+func (c *connection) sendLiveNote(controllers *controllerState, event *midimark.EventNoteOn, length time.Duration) (float64, error) {
+	caps := c.Instrument.Capabilities()
+	var frequency, pitch float64
+	if event.Channel != 10 {
+		pitch = controllers.Pitch(event, 0)
+		var substituted bool
+		frequency, substituted = midiNoteToHertz(pitch, caps)
+		if substituted {
+			c.Status.FrequencySubstituted()
+		}
+		length = max(length, caps.MinLength)
+	} else {
+		frequency = caps.MinFrequency
+		length = caps.MinLength
+	}
+	lengthMilli := toneMilli(length)
+
+	tones := []tone{{Frequency: frequency, Length: length}}
+	command, err := c.Instrument.Play(tones)
+	if err != nil {
+		return 0, err
+	}
+	sent := c.Queue.Elapsed()
+	c.EventLog.Note(noteRecord{
+		Hostname:    c.ConnConf.Name,
+		QueueID:     -1,
+		Song:        liveSongName,
+		TrackID:     int(event.Channel),
+		Channel:     event.Channel,
+		Key:         event.Key,
+		Frequency:   frequency,
+		LengthMilli: lengthMilli,
+		Tones:       tones,
+		Scheduled:   sent,
+		Sent:        sent,
+		Command:     command,
+	})
+	c.Status.NoteSent(frequency, noteName(event, pitch), time.Duration(lengthMilli)*time.Millisecond, 0)
+	select {
+	case c.DebugChanNote <- debugEventNote{
+		Hostname:    c.ConnConf.Name,
+		Frequency:   frequency,
+		LengthMilli: lengthMilli,
+	}:
+	default:
+	}
+	return frequency, nil
+}
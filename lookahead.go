@@ -0,0 +1,161 @@
+/*
+  MIT License
+  Copyright (c) 2020 Star Brilliant
+  Permission is hereby granted, free of charge, to any person obtaining a copy
+  of this software and associated documentation files (the "Software"), to deal
+  in the Software without restriction, including without limitation the rights
+  to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+  copies of the Software, and to permit persons to whom the Software is
+  furnished to do so, subject to the following conditions:
+  The above copyright notice and this permission notice shall be included in
+  all copies or substantial portions of the Software.
+  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+  AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+  LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+  OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+  SOFTWARE.
+*/
+
+package main
+
+import (
+	"time"
+
+	"github.com/m13253/midimark"
+)
+
+// A noteBatch is a series of notes sent to the device at once, so the device keeps their timing instead of the network.
+// Without lookahead, each batch has a single note.
+type noteBatch struct {
+	Notes []batchedNote
+}
+
+type batchedNote struct {
+	Song        *song
+	TrackID     int
+	Event       *midimark.EventNoteOn
+	Time        time.Duration
+	Frequency   float64
+	Pitch       float64
+	LengthMilli int64
+	Tones       []tone
+}
+
+func (b *noteBatch) Start() time.Duration {
+	return b.Notes[0].Time
+}
+
+// Fits reports whether a note at the given time starts within the window after the first note.
+func (b *noteBatch) Fits(t, window time.Duration) bool {
+	return len(b.Notes) == 0 || t < b.Notes[0].Time+window
+}
+
+// Tones joins the notes into one series, cutting each note short or resting after it so the next one starts on time.
+// It also returns when each note starts after the first one.
+func (b *noteBatch) Tones() ([]tone, []time.Duration) {
+	offsets := make([]time.Duration, len(b.Notes))
+	for i, n := range b.Notes {
+		offsets[i] = time.Duration(toneMilli(n.Time-b.Start())) * time.Millisecond
+	}
+	var tones []tone
+	for i, n := range b.Notes {
+		if i == len(b.Notes)-1 {
+			tones = append(tones, n.Tones...)
+		} else {
+			tones = append(tones, fitTones(n.Tones, offsets[i+1]-offsets[i])...)
+		}
+	}
+	return tones, offsets
+}
+
+// fitTones cuts the tones to the given length, or rests after them until then.
+func fitTones(tones []tone, length time.Duration) []tone {
+	fitted := make([]tone, 0, len(tones))
+	for _, t := range tones {
+		if length <= 0 {
+			break
+		}
+		t.Length = min(t.Length, length)
+		length -= t.Length
+		fitted = append(fitted, t)
+	}
+	if len(fitted) != 0 {
+		fitted[len(fitted)-1].Rest += length
+	}
+	return fitted
+}
+
+// Half of the keepalive round trip, smoothed so one slow reply does not move the notes much.
+func (c *connection) measureLatency(roundTrip time.Duration) {
+	latency := int64(roundTrip / 2)
+	if last := c.latency.Load(); last != 0 {
+		latency = (last*3 + latency) / 4
+	}
+	c.latency.Store(latency)
+}
+
+// Returns how early to send a batch, so it arrives at the device on time.
+// Without lookahead, notes are sent on time, as before.
+func (c *connection) sendAhead() time.Duration {
+	if c.ConnConf.Lookahead <= 0 {
+		return 0
+	}
+	return time.Duration(c.latency.Load())
+}
+
+// Waits until the batch is due and sends it. It returns false if the song is skipped.
+func (c *connection) sendBatch(queueID int, item scheduledSong, batch *noteBatch) (bool, error) {
+	ahead := c.sendAhead()
+	if !c.Queue.WaitUntil(queueID, batch.Start()-ahead) {
+		// Skipped by user
+		return false, nil
+	}
+	// Every note in the batch is late by the same amount
+	if c.Queue.Elapsed()+ahead-item.Start-batch.Start() > maxNoteLateness {
+		for range batch.Notes {
+			c.Status.NoteDropped(dropReasonLate)
+		}
+		return true, nil
+	}
+
+	tones, offsets := batch.Tones()
+	command, err := c.Instrument.Play(tones)
+	if err != nil {
+		return false, err
+	}
+	sent := c.Queue.Elapsed()
+	for i, n := range batch.Notes {
+		// The command is logged once, with the first note of the batch
+		if i != 0 {
+			command = ""
+		}
+		noteSent := sent + offsets[i]
+		lateness := noteSent + ahead - item.Start - n.Time
+		c.EventLog.Note(noteRecord{
+			Hostname:    c.ConnConf.Name,
+			QueueID:     queueID,
+			Song:        n.Song.Filename,
+			TrackID:     n.TrackID,
+			Channel:     n.Event.Channel,
+			Key:         n.Event.Key,
+			Frequency:   n.Frequency,
+			LengthMilli: n.LengthMilli,
+			Tones:       n.Tones,
+			Scheduled:   item.Start + n.Time,
+			Sent:        noteSent,
+			Command:     command,
+		})
+		c.Status.NoteSent(n.Frequency, noteName(n.Event, n.Pitch), time.Duration(n.LengthMilli)*time.Millisecond, lateness)
+		select {
+		case c.DebugChanNote <- debugEventNote{
+			Hostname:    c.ConnConf.Name,
+			Frequency:   n.Frequency,
+			LengthMilli: n.LengthMilli,
+		}:
+		default:
+		}
+	}
+	return true, nil
+}
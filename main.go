@@ -29,20 +29,50 @@ import (
 
 	"github.com/fatih/color"
 	"github.com/m13253/midimark"
-	"golang.org/x/crypto/ssh"
-	"golang.org/x/crypto/ssh/knownhosts"
 )
 
 type application struct {
-	conf config
+	conf         config
+	playlistFile string
+	loop         bool
+	shuffle      bool
+	useTUI       bool
+	logFile      string
+	logFormat    string
 
-	knownHosts ssh.HostKeyCallback
-	songs      []song
+	hostKeys *hostKeyStore
+	songs    []*song
+	queue    *songQueue
+	statuses []*connectionStatus
+	events   eventHub
+	roll     rollCache
+	tui      *tui
+	tuiMu    sync.Mutex
+	eventLog *eventLog
+	replay   map[string][]replayNote
+	live     *liveRouter
+
+	debugChanMessage       chan debugEventMessage
+	debugChanNote          chan debugEventNote
+	onDebugPrinterFinished sync.WaitGroup
 }
 
 type song struct {
-	Sequence *midimark.Sequence
-	Duration time.Duration
+	Filename  string
+	Sequence  *midimark.Sequence
+	Tempo     tempoMaps
+	Duration  time.Duration
+	Transpose int
+	Speed     float64
+	Gap       time.Duration
+	Repeat    int
+
+	Tracks        map[string]*connTracksConfig
+	TracksDefined map[uint16]struct{}
+	// Format 2 patterns not selected to be played
+	Skipped map[*midimark.MTrk]struct{}
+	// When each note stops sounding after applying the pedals
+	Releases map[*midimark.EventNoteOn]time.Duration
 }
 
 type debugEventMessage struct {
@@ -65,8 +95,34 @@ func main() {
 
 	app := &application{}
 	flag.StringVar(&app.conf.ConfigFile, "conf", "MikroTiChestra.conf", "Configure file path")
+	flag.StringVar(&app.playlistFile, "playlist", "", "Playlist file path, songs on the command line are played after it")
+	flag.BoolVar(&app.loop, "loop", false, "Repeat the whole list of songs forever")
+	flag.BoolVar(&app.shuffle, "shuffle", false, "Play songs in random order")
+	flag.BoolVar(&app.useTUI, "tui", false, "Show a full-screen status panel for each router instead of the log")
+	flag.StringVar(&app.logFile, "log-file", "", "Write every connection message and note to this file")
+	flag.StringVar(&app.logFormat, "log-format", "text", "Format of the log file, \"text\" or \"json\"")
+	flag.BoolVar(&app.conf.DryRun, "dry-run", false, "Do not connect to the routers, only print what would be sent")
 	flag.Parse()
-	app.run()
+	switch flag.Arg(0) {
+	case "jukebox":
+		app.runJukebox(flag.Args()[1:])
+	case "inspect":
+		app.runInspect(flag.Args()[1:])
+	case "plan":
+		app.runPlan(flag.Args()[1:])
+	case "replay":
+		app.runReplay(flag.Args()[1:])
+	case "live":
+		app.runLive(flag.Args()[1:])
+	case "fake-router":
+		app.runFakeRouter(flag.Args()[1:])
+	case "trust":
+		app.runTrust(flag.Args()[1:])
+	case "doctor":
+		app.runDoctor(flag.Args()[1:])
+	default:
+		app.run(flag.Args())
+	}
 
 	fmt.Println()
 	fmt.Println("=================================")
@@ -74,61 +130,72 @@ func main() {
 	fmt.Println("Copyright (c) 2020 Star Brilliant")
 }
 
-func (app *application) run() {
-	fmt.Printf("Loading configuration file: %s\n", app.conf.ConfigFile)
-	err := app.conf.parseConfigFile()
+func (app *application) run(midiFiles []string) {
+	app.loadConfig()
+	app.loadKnownHosts()
+	app.loadSongs(midiFiles)
+	err := app.resolveSongTracks()
 	if err != nil {
-		fmt.Printf("Failed to load config file: %v\n", err)
+		fmt.Printf("Failed to load playlist: %v\n", err)
 		os.Exit(1)
 	}
 
-	fmt.Printf("Loading known_hosts file: %s\n", app.conf.KnownHosts)
-	app.knownHosts, err = knownhosts.New(app.conf.KnownHosts)
-	if err != nil {
-		fmt.Printf("Failed to load known_hosts: %v\n", err)
-		os.Exit(1)
+	queue := newSongQueue(app.songs, app.loop, app.shuffle)
+	// Keep waiting for songs uploaded through the HTTP server
+	if app.conf.HTTPListen == "" {
+		queue.Close()
 	}
+	app.play(queue, nil)
+}
 
-	midiFiles := flag.Args()
-	if len(midiFiles) == 0 {
-		fmt.Println()
-		fmt.Println("Please specify which MIDI files to load using command line arguments.")
-		os.Exit(1)
+// If onStart is not nil, it is called after all connections are ready and the start time is decided.
+func (app *application) play(queue *songQueue, onStart func()) {
+	app.queue = queue
+	if queue.LeadTime == 0 {
+		queue.LeadTime = app.conf.InitialDelay
 	}
-
-	totalDuration := time.Duration(0)
-	for _, filename := range midiFiles {
-		fmt.Printf("Loading %s\n", filename)
-		seq, err := app.loadMIDIFile(filename)
+	if app.logFile != "" {
+		var err error
+		app.eventLog, err = openEventLog(app.logFile, app.logFormat)
 		if err != nil {
-			fmt.Printf("%s: %v\n", filename, err)
+			fmt.Printf("Failed to open log file: %v\n", err)
 			os.Exit(1)
 		}
-		duration := app.determineSongDuration(seq)
-		app.songs = append(app.songs, song{seq, duration})
-		totalDuration += duration
+		defer app.eventLog.Close()
 	}
-	fmt.Printf("Total duration: %v\n", totalDuration)
 
 	var onConnected sync.WaitGroup
 	onConnected.Add(len(app.conf.Connections))
 	startTimeChan := make(chan time.Time, len(app.conf.Connections))
 	var onFinished sync.WaitGroup
 	onFinished.Add(len(app.conf.Connections))
-	debugChanMessage := make(chan debugEventMessage, 2*len(app.conf.Connections))
-	debugChanNote := make(chan debugEventNote, 1024)
-	var onDebugPrinterFinished sync.WaitGroup
-	onDebugPrinterFinished.Add(1)
-	app.debugEventPrinter(debugChanMessage, debugChanNote, &onDebugPrinterFinished)
+	app.startDebugEventPrinter()
 
-	for _, connConf := range app.conf.Connections {
+	app.statuses = make([]*connectionStatus, len(app.conf.Connections))
+	for i, connConf := range app.conf.Connections {
+		app.statuses[i] = newConnectionStatus(connConf.Name)
+	}
+	if app.conf.HTTPListen != "" {
+		app.startHTTPServer()
+	}
+	if app.useTUI {
+		app.startTUI()
+	}
+
+	jumps := newJumpDialer(app.hostKeys, app.conf.ShareProxyJump)
+	for i, connConf := range app.conf.Connections {
 		c := &connection{
 			AppConf:          &app.conf,
 			ConnConf:         connConf,
-			KnownHosts:       app.knownHosts,
-			Songs:            app.songs,
-			DebugChanMessage: debugChanMessage,
-			DebugChanNote:    debugChanNote,
+			KnownHosts:       app.hostKeys.Callback(connConf),
+			Jumps:            jumps,
+			Queue:            queue,
+			Status:           app.statuses[i],
+			EventLog:         app.eventLog,
+			Replay:           app.replay[connConf.Name],
+			Live:             app.live.Output(i),
+			DebugChanMessage: app.debugChanMessage,
+			DebugChanNote:    app.debugChanNote,
 			OnConnected:      &onConnected,
 			StartTime:        startTimeChan,
 		}
@@ -136,6 +203,8 @@ func (app *application) run() {
 			defer onFinished.Done()
 			err := c.Start()
 			if err != nil {
+				c.Status.SetError(err)
+				app.stopTUI()
 				var wg sync.WaitGroup
 				wg.Add(1)
 				c.DebugChanMessage <- debugEventMessage{
@@ -151,14 +220,149 @@ func (app *application) run() {
 
 	onConnected.Wait()
 	startTime := time.Now().Add(app.conf.InitialDelay)
+	queue.SetStartTime(startTime)
 	for i := 0; i < len(app.conf.Connections); i++ {
 		startTimeChan <- startTime
 	}
 	close(startTimeChan)
+	if onStart != nil {
+		onStart()
+	}
 
 	onFinished.Wait()
-	close(debugChanNote)
-	onDebugPrinterFinished.Wait()
+	app.stopTUI()
+	close(app.debugChanNote)
+	app.onDebugPrinterFinished.Wait()
+}
+
+func (app *application) loadConfig() {
+	fmt.Printf("Loading configuration file: %s\n", app.conf.ConfigFile)
+	err := app.conf.parseConfigFile()
+	if err != nil {
+		fmt.Printf("Failed to load config file: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func (app *application) loadKnownHosts() {
+	if app.conf.DryRun {
+		return
+	}
+	// Local audio output does not need SSH
+	needed := false
+	for _, connConf := range app.conf.Connections {
+		needed = needed || connConf.Driver != driverLocal
+	}
+	if !needed {
+		return
+	}
+	fmt.Printf("Loading known_hosts file: %s\n", app.conf.KnownHosts)
+	var err error
+	app.hostKeys, err = newHostKeyStore(app.conf.KnownHosts, app.conf.HostKeyPolicy)
+	if err != nil {
+		fmt.Printf("Failed to load known_hosts: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func (app *application) loadSongs(midiFiles []string) {
+	var entries []playlistEntry
+	if app.playlistFile != "" {
+		fmt.Printf("Loading playlist file: %s\n", app.playlistFile)
+		var err error
+		entries, err = app.parsePlaylistFile(app.playlistFile)
+		if err != nil {
+			fmt.Printf("Failed to load playlist: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	for _, filename := range midiFiles {
+		entries = append(entries, newPlaylistEntry(filename))
+	}
+	if len(entries) == 0 {
+		fmt.Println()
+		fmt.Println("Please specify which MIDI files to load using command line arguments.")
+		os.Exit(1)
+	}
+
+	totalDuration := time.Duration(0)
+	for _, entry := range entries {
+		fmt.Printf("Loading %s\n", entry.Filename)
+		s, err := app.loadSong(entry)
+		if err != nil {
+			fmt.Printf("%s: %v\n", entry.Filename, err)
+			os.Exit(1)
+		}
+		app.songs = append(app.songs, s)
+		totalDuration += time.Duration(s.Repeat) * (s.Duration + s.Gap)
+	}
+	fmt.Printf("Total duration: %v\n", totalDuration)
+}
+
+func (app *application) loadSong(entry playlistEntry) (*song, error) {
+	seq, err := app.loadMIDIFile(entry.Filename)
+	if err != nil {
+		return nil, err
+	}
+	return app.newSong(entry, seq)
+}
+
+func (app *application) newSong(entry playlistEntry, seq *midimark.Sequence) (*song, error) {
+	patterns, err := app.resolvePatterns(entry, seq)
+	if err != nil {
+		return nil, err
+	}
+	s := &song{
+		Filename:  entry.Filename,
+		Sequence:  seq,
+		Tempo:     newTempoMaps(seq, patterns),
+		Skipped:   make(map[*midimark.MTrk]struct{}),
+		Transpose: entry.Transpose,
+		Speed:     entry.Speed,
+		Gap:       entry.Gap,
+		Repeat:    entry.Repeat,
+		Tracks:    entry.Tracks,
+	}
+	if seq.Header.Format == 2 {
+		for _, mtrk := range seq.Tracks {
+			s.Skipped[mtrk] = struct{}{}
+		}
+		for _, trackID := range patterns {
+			delete(s.Skipped, seq.Tracks[trackID])
+		}
+	}
+	s.Releases = newNoteReleases(s)
+	s.Duration = s.scaleDuration(app.determineSongDuration(s))
+	return s, nil
+}
+
+// Format 2 files contain independent patterns, which are played one after another.
+// By default all of them are played in file order, otherwise only the ones listed in "Patterns".
+func (app *application) resolvePatterns(entry playlistEntry, seq *midimark.Sequence) ([]int, error) {
+	if seq.Header.Format != 2 {
+		return nil, nil
+	}
+	patterns := entry.Patterns
+	if patterns == nil {
+		patterns = app.conf.Patterns
+	}
+	if patterns == nil {
+		patterns = make([]int, len(seq.Tracks))
+		for i := range patterns {
+			patterns[i] = i
+		}
+	}
+	seen := make(map[int]struct{}, len(patterns))
+	for _, trackID := range patterns {
+		if trackID >= len(seq.Tracks) {
+			return nil, fmt.Errorf("pattern %d does not exist, the file only has %d tracks", trackID, len(seq.Tracks))
+		}
+		if _, ok := seen[trackID]; ok {
+			return nil, fmt.Errorf("pattern %d is listed more than once", trackID)
+		}
+		seen[trackID] = struct{}{}
+	}
+	return patterns, nil
 }
 
 func (app *application) loadMIDIFile(filename string) (*midimark.Sequence, error) {
@@ -167,19 +371,20 @@ func (app *application) loadMIDIFile(filename string) (*midimark.Sequence, error
 		return nil, err
 	}
 	defer f.Close()
-	return midimark.DecodeSequenceFromSMF(f, func(err error) {
+	return decodeSongFile(filename, f, func(err error) {
 		fmt.Printf("%s: %v\n", filename, err)
 	})
 }
 
-func (app *application) determineSongDuration(seq *midimark.Sequence) time.Duration {
+// Returns the duration before applying the playback speed.
+func (app *application) determineSongDuration(s *song) time.Duration {
 	maxDuration := time.Duration(0)
-	for _, mtrk := range seq.Tracks {
-		if len(mtrk.Events) == 0 {
+	for _, mtrk := range s.Sequence.Tracks {
+		if _, ok := s.Skipped[mtrk]; ok || len(mtrk.Events) == 0 {
 			continue
 		}
 		maxTick := mtrk.Events[len(mtrk.Events)-1].Common().AbsTick
-		duration := mtrk.ConvertAbsTickToDuration(maxTick)
+		duration := s.Tempo.Duration(mtrk, maxTick)
 		if duration > maxDuration {
 			maxDuration = duration
 		}
@@ -187,7 +392,42 @@ func (app *application) determineSongDuration(seq *midimark.Sequence) time.Durat
 	return maxDuration
 }
 
-func (app *application) debugEventPrinter(chanMessage <-chan debugEventMessage, chanNote <-chan debugEventNote, wg *sync.WaitGroup) {
+func (s *song) scaleDuration(d time.Duration) time.Duration {
+	if s.Speed == 1 || s.Speed <= 0 {
+		return d
+	}
+	return time.Duration(float64(d) / s.Speed)
+}
+
+func (s *song) tickToDuration(mtrk *midimark.MTrk, absTick int64) time.Duration {
+	return s.scaleDuration(s.Tempo.Duration(mtrk, absTick))
+}
+
+// Returns when a note stops sounding, or false if it has no note-off.
+func (s *song) noteOffTime(event *midimark.EventNoteOn) (time.Duration, bool) {
+	release, ok := s.Releases[event]
+	return s.scaleDuration(release), ok
+}
+
+// Per-song track mapping in the playlist overrides the configure file.
+func (s *song) tracksFor(connConf *connConfig) *connTracksConfig {
+	if tracks, ok := s.Tracks[connConf.Name]; ok {
+		return tracks
+	}
+	return &connConf.Tracks
+}
+
+func (s *song) tracksDefined(appConf *config) map[uint16]struct{} {
+	if s.TracksDefined != nil {
+		return s.TracksDefined
+	}
+	return appConf.TracksDefined
+}
+
+func (app *application) startDebugEventPrinter() {
+	app.debugChanMessage = make(chan debugEventMessage, 2*len(app.conf.Connections))
+	app.debugChanNote = make(chan debugEventNote, 1024)
+	app.onDebugPrinterFinished.Add(1)
 	go func(chanMessage <-chan debugEventMessage, chanNote <-chan debugEventNote, wg *sync.WaitGroup) {
 		defer wg.Done()
 		colorGreen := color.New(color.FgGreen)
@@ -201,38 +441,48 @@ func (app *application) debugEventPrinter(chanMessage <-chan debugEventMessage,
 				if !ok {
 					return
 				}
-				color.Unset()
-				if msg.Hostname != "" {
-					fmt.Print("[")
-					colorCyan.Print(msg.Hostname)
-					fmt.Print("] ")
+				// The TUI shows messages by itself
+				if !app.tuiActive() {
+					color.Unset()
+					if msg.Hostname != "" {
+						fmt.Print("[")
+						colorCyan.Print(msg.Hostname)
+						fmt.Print("] ")
+					}
+					fmt.Println(msg.Message)
 				}
-				fmt.Println(msg.Message)
-				if msg.OnFinished != nil {
-					msg.OnFinished.Done()
+				onFinished := msg.OnFinished
+				msg.OnFinished = nil
+				app.events.Publish(msg)
+				app.eventLog.Message(msg.Hostname, msg.Message)
+				if onFinished != nil {
+					onFinished.Done()
 				}
 			case note, ok := <-chanNote:
 				if !ok {
 					return
 				}
-				color.Unset()
-				fmt.Print("[")
-				colorCyan.Print(note.Hostname)
-				fmt.Print("] > ")
-				colorCyan.Print(":")
-				colorMagenta.Print("beep")
-				fmt.Print(" ")
-				colorGreen.Print("as-value")
-				fmt.Print(" ")
-				colorGreen.Print("frequency")
-				colorYellow.Print("=")
-				fmt.Printf("%-5.0f ", note.Frequency)
-				colorGreen.Print("length")
-				colorYellow.Print("=")
-				fmt.Printf("%dms", note.LengthMilli)
-				colorYellow.Print(";")
-				fmt.Println()
+				if !app.tuiActive() {
+					color.Unset()
+					fmt.Print("[")
+					colorCyan.Print(note.Hostname)
+					fmt.Print("] > ")
+					colorCyan.Print(":")
+					colorMagenta.Print("beep")
+					fmt.Print(" ")
+					colorGreen.Print("as-value")
+					fmt.Print(" ")
+					colorGreen.Print("frequency")
+					colorYellow.Print("=")
+					fmt.Printf("%-5.0f ", note.Frequency)
+					colorGreen.Print("length")
+					colorYellow.Print("=")
+					fmt.Printf("%dms", note.LengthMilli)
+					colorYellow.Print(";")
+					fmt.Println()
+				}
+				app.events.Publish(note)
 			}
 		}
-	}(chanMessage, chanNote, wg)
+	}(app.debugChanMessage, app.debugChanNote, &app.onDebugPrinterFinished)
 }
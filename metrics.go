@@ -0,0 +1,130 @@
+/*
+  MIT License
+  Copyright (c) 2020 Star Brilliant
+  Permission is hereby granted, free of charge, to any person obtaining a copy
+  of this software and associated documentation files (the "Software"), to deal
+  in the Software without restriction, including without limitation the rights
+  to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+  copies of the Software, and to permit persons to whom the Software is
+  furnished to do so, subject to the following conditions:
+  The above copyright notice and this permission notice shall be included in
+  all copies or substantial portions of the Software.
+  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+  AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+  LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+  OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+  SOFTWARE.
+*/
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// handleHTTPMetrics exports counters in the Prometheus text format.
+func (app *application) handleHTTPMetrics(w http.ResponseWriter, r *http.Request) {
+	if !httpCheckMethod(w, r, http.MethodGet) {
+		return
+	}
+	infos := make([]connectionInfo, len(app.statuses))
+	for i, status := range app.statuses {
+		infos[i] = status.Info()
+	}
+
+	var buf bytes.Buffer
+	metricsHeader(&buf, "mikrotichestra_notes_sent_total", "counter", "Number of notes sent to the router.")
+	for _, info := range infos {
+		fmt.Fprintf(&buf, "mikrotichestra_notes_sent_total{connection=%s} %d\n", metricsQuote(info.Name), info.NotesSent)
+	}
+
+	metricsHeader(&buf, "mikrotichestra_notes_dropped_total", "counter", "Number of notes not sent to the router.")
+	for _, info := range infos {
+		reasons := []string{dropReasonEmpty, dropReasonLate, dropReasonQuiet}
+		for reason := range info.Dropped {
+			if reason != dropReasonEmpty && reason != dropReasonLate && reason != dropReasonQuiet {
+				reasons = append(reasons, reason)
+			}
+		}
+		sort.Strings(reasons[3:])
+		for _, reason := range reasons {
+			fmt.Fprintf(&buf, "mikrotichestra_notes_dropped_total{connection=%s,reason=%s} %d\n", metricsQuote(info.Name), metricsQuote(reason), info.Dropped[reason])
+		}
+	}
+
+	metricsHeader(&buf, "mikrotichestra_frequency_substitutions_total", "counter", "Number of notes outside the audible range played at a harmonic instead.")
+	for _, info := range infos {
+		fmt.Fprintf(&buf, "mikrotichestra_frequency_substitutions_total{connection=%s} %d\n", metricsQuote(info.Name), info.Substitutions)
+	}
+
+	metricsHeader(&buf, "mikrotichestra_session_commands_total", "counter", "Number of commands written to the SSH sessions.")
+	for _, info := range infos {
+		fmt.Fprintf(&buf, "mikrotichestra_session_commands_total{connection=%s} %d\n", metricsQuote(info.Name), info.SessionCommands)
+	}
+
+	metricsHeader(&buf, "mikrotichestra_session_pool_saturated_total", "counter", "Number of commands written while every SSH session was still busy.")
+	for _, info := range infos {
+		fmt.Fprintf(&buf, "mikrotichestra_session_pool_saturated_total{connection=%s} %d\n", metricsQuote(info.Name), info.SessionSaturated)
+	}
+
+	metricsHeader(&buf, "mikrotichestra_ssh_reconnects_total", "counter", "Number of successful SSH reconnections.")
+	for _, info := range infos {
+		fmt.Fprintf(&buf, "mikrotichestra_ssh_reconnects_total{connection=%s} %d\n", metricsQuote(info.Name), info.Reconnects)
+	}
+
+	metricsHeader(&buf, "mikrotichestra_connection_failures_total", "counter", "Number of times the connection was lost or failed to reconnect.")
+	for _, info := range infos {
+		fmt.Fprintf(&buf, "mikrotichestra_connection_failures_total{connection=%s} %d\n", metricsQuote(info.Name), info.Failures)
+	}
+
+	metricsHeader(&buf, "mikrotichestra_connection_up", "gauge", "Whether the connection is established.")
+	for _, info := range infos {
+		up := 0
+		switch info.State {
+		case connStateConnected, connStatePlaying, connStateLagging:
+			up = 1
+		}
+		fmt.Fprintf(&buf, "mikrotichestra_connection_up{connection=%s} %d\n", metricsQuote(info.Name), up)
+	}
+
+	metricsHeader(&buf, "mikrotichestra_send_lateness_seconds", "histogram", "How much later notes were sent than scheduled.")
+	for _, info := range infos {
+		name := metricsQuote(info.Name)
+		for i, bound := range latenessBuckets {
+			fmt.Fprintf(&buf, "mikrotichestra_send_lateness_seconds_bucket{connection=%s,le=%s} %d\n", name, metricsQuote(strconv.FormatFloat(bound, 'g', -1, 64)), info.LatenessCounts[i])
+		}
+		fmt.Fprintf(&buf, "mikrotichestra_send_lateness_seconds_bucket{connection=%s,le=\"+Inf\"} %d\n", name, info.LatenessCounts[len(latenessBuckets)])
+		fmt.Fprintf(&buf, "mikrotichestra_send_lateness_seconds_sum{connection=%s} %g\n", name, info.LatenessSum.Seconds())
+		fmt.Fprintf(&buf, "mikrotichestra_send_lateness_seconds_count{connection=%s} %d\n", name, info.LatenessCounts[len(latenessBuckets)])
+	}
+
+	status := app.queue.Status()
+	metricsHeader(&buf, "mikrotichestra_current_song_index", "gauge", "Queue index of the song being played, or -1 if none.")
+	fmt.Fprintf(&buf, "mikrotichestra_current_song_index %d\n", status.Current)
+	paused := 0
+	if status.Paused {
+		paused = 1
+	}
+	metricsHeader(&buf, "mikrotichestra_paused", "gauge", "Whether playback is paused.")
+	fmt.Fprintf(&buf, "mikrotichestra_paused %d\n", paused)
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write(buf.Bytes())
+}
+
+func metricsHeader(buf *bytes.Buffer, name, kind, help string) {
+	fmt.Fprintf(buf, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+var metricsEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func metricsQuote(value string) string {
+	return `"` + metricsEscaper.Replace(value) + `"`
+}
@@ -25,6 +25,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"net"
 	"os"
 	"path/filepath"
 	"regexp"
@@ -34,10 +35,20 @@ import (
 )
 
 type config struct {
-	ConfigFile   string
-	KnownHosts   string
-	InitialDelay time.Duration
-	Connections  []*connConfig
+	ConfigFile     string
+	DryRun         bool
+	KnownHosts     string
+	HostKeyPolicy  string
+	InitialDelay   time.Duration
+	ReconnectDelay time.Duration
+	Patterns       []int
+	HTTPListen     string
+	HTTPUsername   string
+	HTTPPassword   string
+	ShareProxyJump bool
+	Connections    []*connConfig
+	// Jump hosts by name, which connections reach their routers through
+	Jumps map[string]*connConfig
 
 	TracksDefined      map[uint16]struct{}
 	OtherTracksDefined bool
@@ -46,11 +57,23 @@ type config struct {
 type connConfig struct {
 	Name string
 
-	Tracks   connTracksConfig
-	Host     string
-	Port     string
-	Username string
-	Password string
+	Tracks       connTracksConfig
+	Articulation articulationConfig
+	GlideStep    time.Duration
+	Lookahead    time.Duration
+	Sessions     int
+	// If set, the host key must have this SHA256 fingerprint, instead of being in KnownHosts
+	HostKeyFingerprint string
+	// Names of the jump hosts, from the first hop, and the jump hosts themselves
+	ProxyJump []string
+	Jumps     []*connConfig
+	Driver    string
+	PWM       string
+	Output    string
+	Host      string
+	Port      string
+	Username  string
+	Password  string
 }
 
 type connTracksConfig struct {
@@ -58,6 +81,20 @@ type connTracksConfig struct {
 	OtherTracks bool
 }
 
+// Options for the whole orchestra rather than one connection, allowed anywhere in the configure file.
+// Each of them is parsed by parseConfigGlobal.
+var globalConfigKeys = map[string]struct{}{
+	"KnownHosts":     {},
+	"HostKeyPolicy":  {},
+	"InitialDelay":   {},
+	"ReconnectDelay": {},
+	"Patterns":       {},
+	"HTTPListen":     {},
+	"HTTPUsername":   {},
+	"HTTPPassword":   {},
+	"ShareProxyJump": {},
+}
+
 func (conf *config) parseConfigFile() error {
 	f, err := os.Open(conf.ConfigFile)
 	if err != nil {
@@ -68,6 +105,17 @@ func (conf *config) parseConfigFile() error {
 
 	currentConn := conf.newConnection()
 	currentConnValid := false
+	// A "Jump" section describes a jump host instead of a connection
+	currentIsJump := false
+	appendCurrent := func() error {
+		if currentIsJump {
+			return conf.appendJump(currentConn)
+		}
+		return conf.appendConnection(currentConn)
+	}
+	if conf.Jumps == nil {
+		conf.Jumps = make(map[string]*connConfig)
+	}
 	if conf.TracksDefined == nil {
 		conf.TracksDefined = make(map[uint16]struct{})
 	}
@@ -81,19 +129,19 @@ func (conf *config) parseConfigFile() error {
 			return err
 		}
 		key, value := conf.splitKeyValue(line)
+		if _, ok := globalConfigKeys[key]; ok {
+			err = conf.parseConfigGlobal(key, value)
+			if err != nil {
+				return err
+			}
+			continue
+		}
 		// I do not want to use reflect.Value, they are too ugly
 		switch key {
 		case "":
-		case "KnownHosts":
-			err = conf.parseConfigString(key, value, &conf.KnownHosts)
-			if err == nil {
-				conf.KnownHosts = os.ExpandEnv(conf.KnownHosts)
-			}
-		case "InitialDelay":
-			err = conf.parseConfigDuration(key, value, &conf.InitialDelay)
-		case "Connection":
+		case "Connection", "Jump":
 			if currentConnValid {
-				err = conf.appendConnection(currentConn)
+				err = appendCurrent()
 				if err != nil {
 					return err
 				}
@@ -101,10 +149,56 @@ func (conf *config) parseConfigFile() error {
 			} else {
 				currentConnValid = true
 			}
+			currentIsJump = key == "Jump"
 			err = conf.parseConfigString(key, value, &currentConn.Name)
 		case "Track":
 			currentConnValid = true
 			err = conf.parseConfigTracks(key, value, &currentConn.Tracks)
+		case "MinVelocity":
+			currentConnValid = true
+			err = conf.parseConfigVelocity(key, value, &currentConn.Articulation.MinVelocity)
+		case "StaccatoVelocity":
+			currentConnValid = true
+			err = conf.parseConfigVelocity(key, value, &currentConn.Articulation.StaccatoVelocity)
+		case "StaccatoLength":
+			currentConnValid = true
+			err = conf.parseConfigPercent(key, value, &currentConn.Articulation.StaccatoLength)
+		case "AccentVelocity":
+			currentConnValid = true
+			err = conf.parseConfigVelocity(key, value, &currentConn.Articulation.AccentVelocity)
+		case "AccentLength":
+			currentConnValid = true
+			err = conf.parseConfigDuration(key, value, &currentConn.Articulation.AccentLength)
+		case "GlideStep":
+			currentConnValid = true
+			err = conf.parseConfigDuration(key, value, &currentConn.GlideStep)
+		case "Lookahead":
+			currentConnValid = true
+			err = conf.parseConfigDuration(key, value, &currentConn.Lookahead)
+		case "Sessions":
+			currentConnValid = true
+			err = conf.parseConfigSessions(key, value, &currentConn.Sessions)
+		case "HostKeyFingerprint":
+			currentConnValid = true
+			err = conf.parseConfigString(key, value, &currentConn.HostKeyFingerprint)
+			if err == nil && !strings.HasPrefix(value, "SHA256:") {
+				err = fmt.Errorf("syntax error in option %q: must be a SHA256 fingerprint like SHA256:...", key)
+			}
+		case "ProxyJump":
+			currentConnValid = true
+			currentConn.ProxyJump = strings.Fields(value)
+		case "Driver":
+			currentConnValid = true
+			err = conf.parseConfigString(key, value, &currentConn.Driver)
+			if err == nil {
+				err = validateDriver(currentConn.Driver)
+			}
+		case "PWM":
+			currentConnValid = true
+			err = conf.parseConfigString(key, value, &currentConn.PWM)
+		case "Output":
+			currentConnValid = true
+			err = conf.parseConfigString(key, value, &currentConn.Output)
 		case "Host":
 			currentConnValid = true
 			err = conf.parseConfigString(key, value, &currentConn.Host)
@@ -130,15 +224,27 @@ func (conf *config) parseConfigFile() error {
 		}
 		conf.KnownHosts = filepath.Join(home, ".ssh", "known_hosts")
 	}
+	if conf.HostKeyPolicy == "" {
+		conf.HostKeyPolicy = hostKeyPolicyStrict
+	}
 
 	if currentConnValid {
-		err = conf.appendConnection(currentConn)
+		err = appendCurrent()
 		if err != nil {
 			return err
 		}
-	} else {
+	}
+	if len(conf.Connections) == 0 {
 		return errors.New("no SSH connections configured")
 	}
+	err = conf.resolveProxyJumps()
+	if err != nil {
+		return err
+	}
+	err = conf.checkHTTPAuth()
+	if err != nil {
+		return err
+	}
 	if len(conf.TracksDefined) == 0 && !conf.OtherTracksDefined {
 		fmt.Println("Warning: no tracks configured")
 	} else if !conf.OtherTracksDefined {
@@ -153,11 +259,20 @@ func (conf *config) newConnection() *connConfig {
 		Tracks: connTracksConfig{
 			Map: make(map[uint16]struct{}),
 		},
+		Articulation: newArticulationConfig(),
+		GlideStep:    20 * time.Millisecond,
+		Sessions:     1,
+		Driver:       driverRouterOS,
+		PWM:          defaultOpenWrtPWM,
+		Output:       defaultLocalOutput,
 	}
 }
 
 func (conf *config) appendConnection(currentConn *connConfig) error {
-	if currentConn.Host == "" {
+	if currentConn.Driver == driverLocal && currentConn.Name == "" {
+		currentConn.Name = driverLocal
+	}
+	if currentConn.Host == "" && currentConn.Driver != driverLocal {
 		if currentConn.Name == "" {
 			return fmt.Errorf("Host not defined for connection (unnamed)")
 		}
@@ -166,6 +281,10 @@ func (conf *config) appendConnection(currentConn *connConfig) error {
 	if currentConn.Name == "" {
 		currentConn.Name = currentConn.Host
 	}
+	// The OpenWrt shell keeps the tone being played in a shell variable, and the local driver has no shell
+	if currentConn.Sessions > 1 && (currentConn.Driver == driverOpenWrt || currentConn.Driver == driverLocal) {
+		return fmt.Errorf("Sessions not supported by driver %q for connection %q", currentConn.Driver, currentConn.Name)
+	}
 	conf.Connections = append(conf.Connections, currentConn)
 	return nil
 }
@@ -182,6 +301,99 @@ func (conf *config) splitKeyValue(line string) (key, value string) {
 	return match[1], match[2]
 }
 
+func (conf *config) parseConfigGlobal(key, value string) error {
+	switch key {
+	case "KnownHosts":
+		err := conf.parseConfigString(key, value, &conf.KnownHosts)
+		if err == nil {
+			conf.KnownHosts = os.ExpandEnv(conf.KnownHosts)
+		}
+		return err
+	case "HostKeyPolicy":
+		err := conf.parseConfigString(key, value, &conf.HostKeyPolicy)
+		if err == nil {
+			err = validateHostKeyPolicy(value)
+		}
+		return err
+	case "InitialDelay":
+		return conf.parseConfigDuration(key, value, &conf.InitialDelay)
+	case "ReconnectDelay":
+		return conf.parseConfigDuration(key, value, &conf.ReconnectDelay)
+	case "Patterns":
+		return conf.parseConfigPatterns(key, value, &conf.Patterns)
+	case "HTTPListen":
+		return conf.parseConfigString(key, value, &conf.HTTPListen)
+	case "HTTPUsername":
+		return conf.parseConfigString(key, value, &conf.HTTPUsername)
+	case "HTTPPassword":
+		return conf.parseConfigString(key, value, &conf.HTTPPassword)
+	case "ShareProxyJump":
+		return conf.parseConfigBool(key, value, &conf.ShareProxyJump)
+	}
+	return fmt.Errorf("option %q is listed in globalConfigKeys but not parsed", key)
+}
+
+func (conf *config) appendJump(currentConn *connConfig) error {
+	if currentConn.Name == "" {
+		return errors.New("Jump must have a name")
+	}
+	if currentConn.Host == "" {
+		return fmt.Errorf("Host not defined for jump host %q", currentConn.Name)
+	}
+	if _, ok := conf.Jumps[currentConn.Name]; ok {
+		return fmt.Errorf("jump host %q defined twice", currentConn.Name)
+	}
+	if len(currentConn.ProxyJump) != 0 {
+		return fmt.Errorf("jump host %q cannot have ProxyJump, list every hop in the ProxyJump of the connection instead", currentConn.Name)
+	}
+	conf.Jumps[currentConn.Name] = currentConn
+	return nil
+}
+
+// Jump hosts may be defined after the connections using them.
+// Without HTTPPassword, anyone reaching HTTPListen can upload songs and stop the show.
+func (conf *config) checkHTTPAuth() error {
+	if conf.HTTPListen == "" || conf.HTTPPassword != "" {
+		return nil
+	}
+	if conf.HTTPUsername != "" {
+		return fmt.Errorf("HTTPUsername is set without HTTPPassword, which would leave the HTTP server open to anyone")
+	}
+	if !isLoopbackListen(conf.HTTPListen) {
+		fmt.Printf("Warning: HTTPPassword is not set, anyone who can reach %s can control the orchestra\n", conf.HTTPListen)
+	}
+	return nil
+}
+
+// Whether a listen address only accepts connections from this computer.
+func isLoopbackListen(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+func (conf *config) resolveProxyJumps() error {
+	for _, connConf := range conf.Connections {
+		if len(connConf.ProxyJump) != 0 && connConf.Driver == driverLocal {
+			return fmt.Errorf("ProxyJump not supported by driver %q for connection %q", connConf.Driver, connConf.Name)
+		}
+		for _, name := range connConf.ProxyJump {
+			jump, ok := conf.Jumps[name]
+			if !ok {
+				return fmt.Errorf("jump host %q of connection %q is not defined", name, connConf.Name)
+			}
+			connConf.Jumps = append(connConf.Jumps, jump)
+		}
+	}
+	return nil
+}
+
 func (conf *config) parseConfigDuration(key, value string, dest *time.Duration) error {
 	duration, err := time.ParseDuration(value)
 	if err != nil {
@@ -212,6 +424,78 @@ func (conf *config) parseConfigTracks(key, value string, dest *connTracksConfig)
 	return nil
 }
 
+// Track IDs of the format 2 patterns to play, in playing order
+func (conf *config) parseConfigPatterns(key, value string, dest *[]int) error {
+	fields := strings.Fields(value)
+	if len(fields) == 0 {
+		return fmt.Errorf("syntax error in option %q: no patterns listed", key)
+	}
+	patterns := make([]int, 0, len(fields))
+	for _, i := range fields {
+		value, err := strconv.ParseUint(i, 0, 16)
+		if err != nil {
+			return fmt.Errorf("syntax error in option %q: %v", key, err)
+		}
+		patterns = append(patterns, int(value))
+	}
+	*dest = patterns
+	return nil
+}
+
+// Number of SSH sessions to a router, one at least
+func (conf *config) parseConfigSessions(key, value string, dest *int) error {
+	sessions, err := strconv.ParseUint(value, 0, 8)
+	if err != nil {
+		return fmt.Errorf("syntax error in option %q: %v", key, err)
+	}
+	if sessions < 1 || sessions > maxSessions {
+		return fmt.Errorf("syntax error in option %q: must be between 1 and %d", key, maxSessions)
+	}
+	*dest = int(sessions)
+	return nil
+}
+
+func (conf *config) parseConfigVelocity(key, value string, dest *uint8) error {
+	velocity, err := strconv.ParseUint(value, 0, 8)
+	if err != nil {
+		return fmt.Errorf("syntax error in option %q: %v", key, err)
+	}
+	if velocity > 127 {
+		return fmt.Errorf("syntax error in option %q: velocity must be between 0 and 127", key)
+	}
+	*dest = uint8(velocity)
+	return nil
+}
+
+// Written as a percentage like "50%", or a factor like "0.5".
+func (conf *config) parseConfigPercent(key, value string, dest *float64) error {
+	percent := strings.HasSuffix(value, "%")
+	factor, err := strconv.ParseFloat(strings.TrimSuffix(value, "%"), 64)
+	if err != nil {
+		return fmt.Errorf("syntax error in option %q: %v", key, err)
+	}
+	if percent {
+		factor /= 100
+	}
+	if !(factor > 0) || factor > 1 {
+		return fmt.Errorf("syntax error in option %q: must be more than 0%% and at most 100%%", key)
+	}
+	*dest = factor
+	return nil
+}
+
+func (conf *config) parseConfigBool(key, value string, dest *bool) error {
+	switch strings.ToLower(value) {
+	case "yes", "true", "on":
+		*dest = true
+	case "no", "false", "off":
+		*dest = false
+	default:
+		return fmt.Errorf("syntax error in option %q: must be yes or no", key)
+	}
+	return nil
+}
+
 func (conf *config) parseConfigString(key, value string, dest *string) error {
 	*dest = value
 	return nil
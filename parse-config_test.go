@@ -0,0 +1,66 @@
+/*
+  MIT License
+  Copyright (c) 2020 Star Brilliant
+  Permission is hereby granted, free of charge, to any person obtaining a copy
+  of this software and associated documentation files (the "Software"), to deal
+  in the Software without restriction, including without limitation the rights
+  to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+  copies of the Software, and to permit persons to whom the Software is
+  furnished to do so, subject to the following conditions:
+  The above copyright notice and this permission notice shall be included in
+  all copies or substantial portions of the Software.
+  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+  AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+  LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+  OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+  SOFTWARE.
+*/
+
+package main
+
+import "testing"
+
+func TestCheckHTTPAuth(t *testing.T) {
+	tests := []struct {
+		listen, username, password string
+		ok                         bool
+	}{
+		{"", "admin", "", true},
+		{"127.0.0.1:8080", "", "", true},
+		{"127.0.0.1:8080", "admin", "", false},
+		{":8080", "admin", "", false},
+		{":8080", "admin", "secret", true},
+		{":8080", "", "secret", true},
+		// Only warns
+		{":8080", "", "", true},
+	}
+	for _, test := range tests {
+		conf := &config{HTTPListen: test.listen, HTTPUsername: test.username, HTTPPassword: test.password}
+		err := conf.checkHTTPAuth()
+		if (err == nil) != test.ok {
+			t.Errorf("HTTPListen %q, HTTPUsername %q, HTTPPassword %q: got error %v", test.listen, test.username, test.password, err)
+		}
+	}
+}
+
+func TestIsLoopbackListen(t *testing.T) {
+	tests := []struct {
+		addr string
+		want bool
+	}{
+		{"127.0.0.1:8080", true},
+		{"[::1]:8080", true},
+		{"localhost:8080", true},
+		{":8080", false},
+		{"0.0.0.0:8080", false},
+		{"192.168.88.2:8080", false},
+		{"8080", false},
+	}
+	for _, test := range tests {
+		if got := isLoopbackListen(test.addr); got != test.want {
+			t.Errorf("isLoopbackListen(%q) = %v, want %v", test.addr, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,190 @@
+/*
+  MIT License
+  Copyright (c) 2020 Star Brilliant
+  Permission is hereby granted, free of charge, to any person obtaining a copy
+  of this software and associated documentation files (the "Software"), to deal
+  in the Software without restriction, including without limitation the rights
+  to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+  copies of the Software, and to permit persons to whom the Software is
+  furnished to do so, subject to the following conditions:
+  The above copyright notice and this permission notice shall be included in
+  all copies or substantial portions of the Software.
+  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+  AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+  LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+  OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+  SOFTWARE.
+*/
+
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+
+	"github.com/m13253/midimark"
+)
+
+// midiStreamParser decodes MIDI messages received byte by byte, as on a MIDI cable.
+type midiStreamParser struct {
+	status  byte
+	data    [2]byte
+	count   int
+	inSysEx bool
+}
+
+// Feed returns done once a whole message is received.
+// The event is nil for messages we do not play, such as SysEx or MIDI clock.
+func (p *midiStreamParser) Feed(b byte) (event midimark.Event, done bool) {
+	if b >= 0xf8 {
+		// Real-time messages may appear anywhere without affecting running status
+		return nil, true
+	}
+	if p.inSysEx {
+		switch b {
+		case 0xf7, 0xf0, 0xf4:
+			// End of SysEx, or the end or cancellation of a SysEx segment in RTP-MIDI
+			p.inSysEx = false
+			return nil, true
+		}
+		if b < 0x80 {
+			return nil, false
+		}
+		// Any other status byte ends an unterminated SysEx
+		p.inSysEx = false
+	}
+	if b >= 0x80 {
+		p.count = 0
+		switch b {
+		case 0xf0, 0xf7:
+			p.inSysEx = true
+			p.status = 0
+			return nil, false
+		}
+		p.status = b
+		if midiDataLength(b) == 0 {
+			p.status = 0
+			return nil, true
+		}
+		return nil, false
+	}
+	if p.status == 0 {
+		// Data byte without status
+		return nil, false
+	}
+	p.data[p.count] = b
+	p.count++
+	if p.count < midiDataLength(p.status) {
+		return nil, false
+	}
+	p.count = 0
+	status := p.status
+	if status >= 0xf0 {
+		// System common messages cancel running status
+		p.status = 0
+		return nil, true
+	}
+	return p.event(status), true
+}
+
+func (p *midiStreamParser) event(status byte) midimark.Event {
+	// Channels are numbered from 1 in midimark
+	common := midimark.EventCommon{Channel: status&0x0f + 1}
+	switch status & 0xf0 {
+	case 0x80:
+		return &midimark.EventNoteOff{EventCommon: common, Key: midimark.Key(p.data[0]), Velocity: p.data[1]}
+	case 0x90:
+		if p.data[1] == 0 {
+			return &midimark.EventNoteOff{EventCommon: common, Key: midimark.Key(p.data[0]), Velocity: 0x40}
+		}
+		return &midimark.EventNoteOn{EventCommon: common, Key: midimark.Key(p.data[0]), Velocity: p.data[1]}
+	case 0xb0:
+		return &midimark.EventControlChange{EventCommon: common, Control: p.data[0], Value: p.data[1]}
+	case 0xc0:
+		return &midimark.EventProgramChange{EventCommon: common, Program: p.data[0] + 1}
+	case 0xe0:
+		// The least significant 7 bits come first
+		return &midimark.EventPitchWheelChange{EventCommon: common, Pitch: (int16(p.data[1])<<7 | int16(p.data[0])) - 0x2000}
+	}
+	return nil
+}
+
+func midiDataLength(status byte) int {
+	switch status & 0xf0 {
+	case 0x80, 0x90, 0xa0, 0xb0, 0xe0:
+		return 2
+	case 0xc0, 0xd0:
+		return 1
+	}
+	switch status {
+	case 0xf1, 0xf3:
+		return 1
+	case 0xf2:
+		return 2
+	}
+	return 0
+}
+
+var errInvalidRTPMIDI = errors.New("invalid RTP-MIDI packet")
+
+// parseRTPMIDI decodes the MIDI command section of an RTP-MIDI packet (RFC 6295).
+// Timestamps are ignored, so commands are played as soon as they arrive.
+// The recovery journal is also ignored, which is fine on a local network.
+func parseRTPMIDI(packet []byte, p *midiStreamParser, dispatch func(midimark.Event)) error {
+	if len(packet) < 12 || packet[0]>>6 != 2 {
+		return errInvalidRTPMIDI
+	}
+	offset := 12 + 4*int(packet[0]&0x0f)
+	if packet[0]&0x10 != 0 {
+		// Header extension
+		if offset+4 > len(packet) {
+			return errInvalidRTPMIDI
+		}
+		offset += 4 + 4*int(binary.BigEndian.Uint16(packet[offset+2:]))
+	}
+	if offset >= len(packet) {
+		return errInvalidRTPMIDI
+	}
+	header := packet[offset]
+	offset++
+	length := int(header & 0x0f)
+	if header&0x80 != 0 {
+		if offset >= len(packet) {
+			return errInvalidRTPMIDI
+		}
+		length = length<<8 | int(packet[offset])
+		offset++
+	}
+	if offset+length > len(packet) {
+		return errInvalidRTPMIDI
+	}
+	list := packet[offset : offset+length]
+
+	// The Z flag tells whether the first command has a delta time
+	hasDeltaTime := header&0x20 != 0
+	for i := 0; i < len(list); {
+		if hasDeltaTime {
+			for j := 0; j < 4 && i < len(list); j++ {
+				b := list[i]
+				i++
+				if b < 0x80 {
+					break
+				}
+			}
+		}
+		hasDeltaTime = true
+		for i < len(list) {
+			event, done := p.Feed(list[i])
+			i++
+			if event != nil {
+				dispatch(event)
+			}
+			if done {
+				break
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,194 @@
+/*
+  MIT License
+  Copyright (c) 2020 Star Brilliant
+  Permission is hereby granted, free of charge, to any person obtaining a copy
+  of this software and associated documentation files (the "Software"), to deal
+  in the Software without restriction, including without limitation the rights
+  to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+  copies of the Software, and to permit persons to whom the Software is
+  furnished to do so, subject to the following conditions:
+  The above copyright notice and this permission notice shall be included in
+  all copies or substantial portions of the Software.
+  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+  AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+  LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+  OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+  SOFTWARE.
+*/
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type playlistEntry struct {
+	Filename  string
+	Transpose int
+	Speed     float64
+	Gap       time.Duration
+	Repeat    int
+	Patterns  []int
+	Tracks    map[string]*connTracksConfig
+}
+
+func newPlaylistEntry(filename string) playlistEntry {
+	return playlistEntry{
+		Filename: filename,
+		Speed:    1,
+		Repeat:   1,
+	}
+}
+
+// Song files are relative to the directory of the playlist file.
+func (app *application) parsePlaylistFile(filename string) ([]playlistEntry, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	buf := bufio.NewReader(f)
+	dir := filepath.Dir(filename)
+
+	var entries []playlistEntry
+	var current *playlistEntry
+	for {
+		line, lineerr := buf.ReadString('\n')
+		if lineerr != nil && lineerr != io.EOF {
+			return nil, lineerr
+		}
+		key, value := app.conf.splitKeyValue(line)
+		if key != "" && key != "Song" && current == nil {
+			return nil, fmt.Errorf("option %q appears before the first \"Song\"", key)
+		}
+		switch key {
+		case "":
+		case "Song":
+			if value == "" {
+				return nil, errors.New("syntax error in option \"Song\": file name is empty")
+			}
+			songFile := os.ExpandEnv(value)
+			if !filepath.IsAbs(songFile) {
+				songFile = filepath.Join(dir, songFile)
+			}
+			entries = append(entries, newPlaylistEntry(songFile))
+			current = &entries[len(entries)-1]
+		case "Transpose":
+			current.Transpose, err = strconv.Atoi(value)
+			if err != nil {
+				err = fmt.Errorf("syntax error in option %q: %v", key, err)
+			}
+		case "Tempo":
+			err = app.parsePlaylistTempo(key, value, &current.Speed)
+		case "Gap":
+			err = app.conf.parseConfigDuration(key, value, &current.Gap)
+		case "Repeat":
+			current.Repeat, err = strconv.Atoi(value)
+			if err != nil {
+				err = fmt.Errorf("syntax error in option %q: %v", key, err)
+			} else if current.Repeat < 1 {
+				err = fmt.Errorf("syntax error in option %q: must be at least 1", key)
+			}
+		case "Patterns":
+			err = app.conf.parseConfigPatterns(key, value, &current.Patterns)
+		case "Track":
+			err = app.parsePlaylistTracks(key, value, current)
+		default:
+			err = fmt.Errorf("unknown option %q", key)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if lineerr == io.EOF {
+			break
+		}
+	}
+	if len(entries) == 0 {
+		return nil, errors.New("no songs in playlist")
+	}
+	return entries, nil
+}
+
+// Tempo can be written as a factor like "1.25", or a percentage like "125%".
+func (app *application) parsePlaylistTempo(key, value string, dest *float64) error {
+	percent := strings.HasSuffix(value, "%")
+	speed, err := strconv.ParseFloat(strings.TrimSuffix(value, "%"), 64)
+	if err != nil {
+		return fmt.Errorf("syntax error in option %q: %v", key, err)
+	}
+	if percent {
+		speed /= 100
+	}
+	if !(speed > 0) || speed > 1000 {
+		return fmt.Errorf("syntax error in option %q: tempo out of range", key)
+	}
+	*dest = speed
+	return nil
+}
+
+// Format: Track <connection name> <track ID>... [Other]
+func (app *application) parsePlaylistTracks(key, value string, dest *playlistEntry) error {
+	fields := strings.Fields(value)
+	if len(fields) == 0 {
+		return fmt.Errorf("syntax error in option %q: connection name is empty", key)
+	}
+	if dest.Tracks == nil {
+		dest.Tracks = make(map[string]*connTracksConfig)
+	}
+	tracks, ok := dest.Tracks[fields[0]]
+	if !ok {
+		tracks = &connTracksConfig{
+			Map: make(map[uint16]struct{}),
+		}
+		dest.Tracks[fields[0]] = tracks
+	}
+	for _, i := range fields[1:] {
+		if i == "Other" {
+			tracks.OtherTracks = true
+		} else {
+			value, err := strconv.ParseUint(i, 0, 16)
+			if err != nil {
+				return fmt.Errorf("syntax error in option %q: %v", key, err)
+			}
+			tracks.Map[uint16(value)] = struct{}{}
+		}
+	}
+	return nil
+}
+
+// Check the connection names used in per-song track mappings, and find out
+// which tracks are explicitly assigned in each song, so that "Track Other"
+// still means "all tracks nobody else plays".
+func (app *application) resolveSongTracks() error {
+	names := make(map[string]struct{}, len(app.conf.Connections))
+	for _, connConf := range app.conf.Connections {
+		names[connConf.Name] = struct{}{}
+	}
+	for _, s := range app.songs {
+		if len(s.Tracks) == 0 {
+			continue
+		}
+		for name := range s.Tracks {
+			if _, ok := names[name]; !ok {
+				return fmt.Errorf("%s: unknown connection %q in option \"Track\"", s.Filename, name)
+			}
+		}
+		s.TracksDefined = make(map[uint16]struct{})
+		for _, connConf := range app.conf.Connections {
+			for trackID := range s.tracksFor(connConf).Map {
+				s.TracksDefined[trackID] = struct{}{}
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,149 @@
+/*
+  MIT License
+  Copyright (c) 2020 Star Brilliant
+  Permission is hereby granted, free of charge, to any person obtaining a copy
+  of this software and associated documentation files (the "Software"), to deal
+  in the Software without restriction, including without limitation the rights
+  to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+  copies of the Software, and to permit persons to whom the Software is
+  furnished to do so, subject to the following conditions:
+  The above copyright notice and this permission notice shall be included in
+  all copies or substantial portions of the Software.
+  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+  AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+  LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+  OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+  SOFTWARE.
+*/
+
+package main
+
+import (
+	"sort"
+	"time"
+
+	"github.com/m13253/midimark"
+)
+
+type pedalNote struct {
+	Event     *midimark.EventNoteOn
+	KeyUp     bool
+	Sostenuto bool
+}
+
+type pedalEvent struct {
+	Time  time.Duration
+	Event midimark.Event
+}
+
+// Returns when each note stops sounding, before applying the playback speed.
+// A note released while the sustain pedal is down keeps sounding until the pedal is released.
+// The sostenuto pedal does the same, but only for notes already sounding when it was pressed.
+// A note released while the legato footswitch is down keeps sounding until the next note in the same channel starts.
+// Notes without a note-off are not included.
+func newNoteReleases(s *song) map[*midimark.EventNoteOn]time.Duration {
+	releases := make(map[*midimark.EventNoteOn]time.Duration)
+	// Format 2 patterns have their own pedals
+	var timelines [][]*midimark.MTrk
+	if s.Sequence.Header.Format == 2 {
+		for _, mtrk := range s.Sequence.Tracks {
+			if _, ok := s.Skipped[mtrk]; !ok {
+				timelines = append(timelines, []*midimark.MTrk{mtrk})
+			}
+		}
+	} else {
+		timelines = append(timelines, s.Sequence.Tracks)
+	}
+	for _, tracks := range timelines {
+		var events []pedalEvent
+		for _, mtrk := range tracks {
+			for _, event := range mtrk.Events {
+				switch event.(type) {
+				case *midimark.EventNoteOn, *midimark.EventNoteOff, *midimark.EventControlChange, *midimark.MetaEventEndOfTrack:
+					events = append(events, pedalEvent{s.Tempo.Duration(mtrk, event.Common().AbsTick), event})
+				}
+			}
+		}
+		sort.SliceStable(events, func(i, j int) bool {
+			return events[i].Time < events[j].Time ||
+				(events[i].Time == events[j].Time && events[i].Event.Common().FilePosition < events[j].Event.Common().FilePosition)
+		})
+		followPedals(events, releases)
+	}
+	return releases
+}
+
+func followPedals(events []pedalEvent, releases map[*midimark.EventNoteOn]time.Duration) {
+	controllers := newControllerState()
+	// Notes with the key still down, or held by a pedal
+	var sounding [16][]*pedalNote
+	var last [16]*midimark.EventNoteOn
+	var legatoSince [16]time.Duration
+	release := func(ch int, now time.Duration) {
+		remaining := sounding[ch][:0]
+		for _, n := range sounding[ch] {
+			if n.KeyUp && !controllers.Sustain[ch] && !n.Sostenuto {
+				releases[n.Event] = now
+			} else {
+				remaining = append(remaining, n)
+			}
+		}
+		sounding[ch] = remaining
+	}
+
+	end := time.Duration(0)
+	for _, e := range events {
+		end = e.Time
+		switch event := e.Event.(type) {
+		case *midimark.EventNoteOn:
+			ch := int(event.Channel - 1)
+			if ch >= 16 {
+				continue
+			}
+			if prev := last[ch]; prev != nil && controllers.Legato[ch] {
+				if off, ok := releases[prev]; ok && off >= legatoSince[ch] && off < e.Time {
+					releases[prev] = e.Time
+				}
+			}
+			last[ch] = event
+			if event.RelatedNoteOff != nil {
+				sounding[ch] = append(sounding[ch], &pedalNote{Event: event})
+			}
+		case *midimark.EventNoteOff:
+			ch := int(event.Channel - 1)
+			if ch >= 16 || event.RelatedNoteOn == nil {
+				continue
+			}
+			for _, n := range sounding[ch] {
+				if n.Event == event.RelatedNoteOn {
+					n.KeyUp = true
+				}
+			}
+			release(ch, e.Time)
+		case *midimark.EventControlChange:
+			ch := int(event.Channel - 1)
+			if ch >= 16 {
+				continue
+			}
+			wasSostenuto, wasLegato := controllers.Sostenuto[ch], controllers.Legato[ch]
+			controllers.Follow(event)
+			if controllers.Legato[ch] && !wasLegato {
+				legatoSince[ch] = e.Time
+			}
+			if controllers.Sostenuto[ch] != wasSostenuto {
+				for _, n := range sounding[ch] {
+					n.Sostenuto = controllers.Sostenuto[ch]
+				}
+			}
+			release(ch, e.Time)
+		}
+	}
+	// Pedals never released
+	for ch := range sounding {
+		for _, n := range sounding[ch] {
+			releases[n.Event] = end
+		}
+	}
+}
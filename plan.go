@@ -0,0 +1,243 @@
+/*
+  MIT License
+  Copyright (c) 2020 Star Brilliant
+  Permission is hereby granted, free of charge, to any person obtaining a copy
+  of this software and associated documentation files (the "Software"), to deal
+  in the Software without restriction, including without limitation the rights
+  to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+  copies of the Software, and to permit persons to whom the Software is
+  furnished to do so, subject to the following conditions:
+  The above copyright notice and this permission notice shall be included in
+  all copies or substantial portions of the Software.
+  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+  AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+  LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+  OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+  SOFTWARE.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type planEntry struct {
+	Conn        *connConfig
+	Tracks      []int
+	OtherTracks bool
+	Load        float64
+	Polyphony   int
+}
+
+func (app *application) runPlan(args []string) {
+	flags := flag.NewFlagSet("plan", flag.ExitOnError)
+	output := flags.String("o", "", "Write the proposed assignment into a copy of the configure file")
+	flags.Parse(args)
+
+	app.loadConfig()
+	app.loadSongs(flags.Args())
+
+	totalDuration := time.Duration(0)
+	for _, song := range app.songs {
+		totalDuration += song.Duration
+	}
+	stats := app.analyzeSongs()
+	if len(stats) == 0 {
+		fmt.Println("No notes found in the MIDI files.")
+		os.Exit(1)
+	}
+
+	fmt.Println()
+	fmt.Printf("%-6s %-12s %6s %-10s %9s %9s\n", "Track", "Channels", "Notes", "Range", "Polyphony", "Density")
+	for _, s := range stats {
+		fmt.Printf("%-6d %-12s %6d %-10s %9d %7.2f/s\n", s.TrackID, formatChannels(s.Channels), s.NoteCount, s.MinKey.String()+"-"+s.MaxKey.String(), s.MaxPolyphony, noteDensity(s, totalDuration))
+	}
+
+	plan := app.planAssignment(stats, totalDuration)
+
+	fmt.Println()
+	fmt.Println("Proposed assignment:")
+	totalPolyphony := 0
+	for _, s := range stats {
+		totalPolyphony += s.MaxPolyphony
+	}
+	for _, entry := range plan {
+		fmt.Printf("[%s] Track %s\n", entry.Conn.Name, formatPlanTracks(entry))
+	}
+	fmt.Println()
+	for _, entry := range plan {
+		if entry.Polyphony > 1 {
+			fmt.Printf("Warning: [%s] may need to sound up to %d notes at once, but a beeper can only sound one\n", entry.Conn.Name, entry.Polyphony)
+		}
+	}
+	if totalPolyphony > len(plan) {
+		fmt.Printf("Warning: detected polyphony needs %d routers, but only %d SSH connections are configured\n", totalPolyphony, len(plan))
+	}
+
+	if *output != "" {
+		fmt.Printf("Writing configuration file: %s\n", *output)
+		err := app.writePlan(*output, plan)
+		if err != nil {
+			fmt.Printf("Failed to write config file: %v\n", err)
+			os.Exit(1)
+		}
+	}
+}
+
+// Assign the busiest tracks first, each to the least loaded connection.
+// If there are at least as many connections as tracks, every track gets its own router.
+func (app *application) planAssignment(stats []trackStats, totalDuration time.Duration) []planEntry {
+	plan := make([]planEntry, len(app.conf.Connections))
+	for i, connConf := range app.conf.Connections {
+		plan[i].Conn = connConf
+	}
+
+	sorted := make([]trackStats, len(stats))
+	copy(sorted, stats)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return noteDensity(sorted[i], totalDuration) > noteDensity(sorted[j], totalDuration)
+	})
+	for _, s := range sorted {
+		entry := leastLoadedEntry(plan)
+		entry.Tracks = append(entry.Tracks, s.TrackID)
+		entry.Load += noteDensity(s, totalDuration)
+		entry.Polyphony += s.MaxPolyphony
+	}
+	for i := range plan {
+		sort.Ints(plan[i].Tracks)
+	}
+
+	// Songs loaded later may contain tracks we have not seen
+	leastLoadedEntry(plan).OtherTracks = true
+	return plan
+}
+
+func leastLoadedEntry(plan []planEntry) *planEntry {
+	best := &plan[0]
+	for i := range plan {
+		if len(plan[i].Tracks) < len(best.Tracks) || (len(plan[i].Tracks) == len(best.Tracks) && plan[i].Load < best.Load) {
+			best = &plan[i]
+		}
+	}
+	return best
+}
+
+func noteDensity(s trackStats, totalDuration time.Duration) float64 {
+	if totalDuration <= 0 {
+		return 0
+	}
+	return float64(s.NoteCount) / totalDuration.Seconds()
+}
+
+func formatChannels[T uint8 | int](channels []T) string {
+	fields := make([]string, len(channels))
+	for i, ch := range channels {
+		fields[i] = strconv.Itoa(int(ch))
+	}
+	return strings.Join(fields, ",")
+}
+
+func formatPlanTracks(entry planEntry) string {
+	var fields []string
+	for _, trackID := range entry.Tracks {
+		fields = append(fields, strconv.Itoa(trackID))
+	}
+	if entry.OtherTracks {
+		fields = append(fields, "Other")
+	}
+	if len(fields) == 0 {
+		return "(none)"
+	}
+	return strings.Join(fields, " ")
+}
+
+// Copy the configure file, replacing the Track option of each connection.
+// Comments and other options are kept as they are.
+func (app *application) writePlan(filename string, plan []planEntry) error {
+	src, err := os.ReadFile(app.conf.ConfigFile)
+	if err != nil {
+		return err
+	}
+	lines := strings.SplitAfter(string(src), "\n")
+
+	// Find the sections in the same way as parseConfigFile
+	sectionStart := make([]int, 0, len(plan))
+	trackLine := make([]int, 0, len(plan))
+	connLine := make([]int, 0, len(plan))
+	inJump := false
+	for i, line := range lines {
+		key, _ := app.conf.splitKeyValue(line)
+		if _, ok := globalConfigKeys[key]; key == "" || ok {
+			continue
+		}
+		// Jump hosts are not connections
+		switch key {
+		case "Jump":
+			inJump = true
+		case "Connection":
+			inJump = false
+		}
+		if inJump {
+			continue
+		}
+		// Every "Connection" starts a new section, except that options before the first one belong to the first section
+		if key == "Connection" || len(sectionStart) == 0 {
+			sectionStart = append(sectionStart, i)
+			trackLine = append(trackLine, -1)
+			connLine = append(connLine, -1)
+		}
+		current := len(sectionStart) - 1
+		switch key {
+		case "Connection":
+			connLine[current] = i
+		case "Track":
+			if trackLine[current] < 0 {
+				trackLine[current] = i
+			} else {
+				lines[i] = ""
+			}
+		}
+	}
+	if len(sectionStart) != len(plan) {
+		return fmt.Errorf("found %d SSH connections, expected %d", len(sectionStart), len(plan))
+	}
+
+	insertAfter := make(map[int]string)
+	for i, entry := range plan {
+		newLine := "Track\t\t" + formatPlanTracks(entry) + "\n"
+		if len(entry.Tracks) == 0 && !entry.OtherTracks {
+			newLine = "# Track\t\t(not needed)\n"
+		}
+		if trackLine[i] >= 0 {
+			lines[trackLine[i]] = newLine
+		} else if connLine[i] >= 0 {
+			insertAfter[connLine[i]] = newLine
+		} else {
+			insertAfter[sectionStart[i]-1] = newLine
+		}
+	}
+
+	var sb strings.Builder
+	if line, ok := insertAfter[-1]; ok {
+		sb.WriteString(line)
+	}
+	for i, line := range lines {
+		sb.WriteString(line)
+		if newLine, ok := insertAfter[i]; ok {
+			if !strings.HasSuffix(line, "\n") {
+				sb.WriteString("\n")
+			}
+			sb.WriteString(newLine)
+		}
+	}
+	return os.WriteFile(filename, []byte(sb.String()), 0600)
+}
@@ -0,0 +1,53 @@
+/*
+  MIT License
+  Copyright (c) 2020 Star Brilliant
+  Permission is hereby granted, free of charge, to any person obtaining a copy
+  of this software and associated documentation files (the "Software"), to deal
+  in the Software without restriction, including without limitation the rights
+  to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+  copies of the Software, and to permit persons to whom the Software is
+  furnished to do so, subject to the following conditions:
+  The above copyright notice and this permission notice shall be included in
+  all copies or substantial portions of the Software.
+  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+  AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+  LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+  OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+  SOFTWARE.
+*/
+
+package main
+
+import (
+	"time"
+)
+
+// Longer glides use longer steps, so a single note does not flood the device.
+const maxGlideSteps = 50
+
+// glideTones slides from one pitch to another with a series of short tones,
+// then holds the target pitch for the rest of the note.
+// It returns nil if the glide is too short to have at least one step.
+func glideTones(from, to float64, glide, step, length time.Duration, caps instrumentCapabilities) []tone {
+	if step <= 0 || from == to {
+		return nil
+	}
+	if step < glide/maxGlideSteps {
+		step = glide / maxGlideSteps
+	}
+	step = time.Duration(toneMilli(max(step, caps.MinLength))) * time.Millisecond
+	steps := int64(min(glide, length-caps.MinLength) / step)
+	if steps < 1 {
+		return nil
+	}
+
+	tones := make([]tone, 0, steps+1)
+	for i := int64(0); i < steps; i++ {
+		frequency, _ := midiNoteToHertz(from+(to-from)*float64(i)/float64(steps), caps)
+		tones = append(tones, tone{Frequency: frequency, Length: step})
+	}
+	frequency, _ := midiNoteToHertz(to, caps)
+	return append(tones, tone{Frequency: frequency, Length: length - time.Duration(steps)*step})
+}
@@ -0,0 +1,364 @@
+/*
+  MIT License
+  Copyright (c) 2020 Star Brilliant
+  Permission is hereby granted, free of charge, to any person obtaining a copy
+  of this software and associated documentation files (the "Software"), to deal
+  in the Software without restriction, including without limitation the rights
+  to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+  copies of the Software, and to permit persons to whom the Software is
+  furnished to do so, subject to the following conditions:
+  The above copyright notice and this permission notice shall be included in
+  all copies or substantial portions of the Software.
+  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+  AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+  LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+  OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+  SOFTWARE.
+*/
+
+package main
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// A connection fetches the next song only this long before it starts,
+// so that songs can still be dequeued while the previous one is playing.
+const queueFetchAhead = 500 * time.Millisecond
+
+type scheduledSong struct {
+	Song    *song
+	Start   time.Duration
+	Skipped bool
+}
+
+type queueStatus struct {
+	Items   []scheduledSong
+	Current int
+	Elapsed time.Duration
+	Paused  bool
+}
+
+// All connections read the same schedule from a songQueue, one song at a
+// time, so that they stay in sync even if the song order is decided on the fly.
+// The queue also keeps the playback clock, which can be paused.
+type songQueue struct {
+	Loop    bool
+	Shuffle bool
+	// Songs queued while idle start this long after being queued
+	LeadTime time.Duration
+
+	mu      sync.Mutex
+	changed chan struct{}
+	library []*song
+	items   []*scheduledSong
+	end     time.Duration
+	closed  bool
+	// Stopped by the user, so a looping queue does not start another round until started again
+	stopped     bool
+	startTime   time.Time
+	paused      bool
+	pausedAt    time.Time
+	pausedTotal time.Duration
+}
+
+func newSongQueue(songs []*song, loop, shuffle bool) *songQueue {
+	q := &songQueue{
+		Loop:    loop,
+		Shuffle: shuffle,
+		changed: make(chan struct{}),
+	}
+	q.appendRound(songs)
+	return q
+}
+
+// Close means no more songs will be added.
+// Connections finish after playing the remaining songs, unless in loop mode.
+func (q *songQueue) Close() {
+	q.mu.Lock()
+	q.closed = true
+	q.notifyLocked()
+	q.mu.Unlock()
+}
+
+func (q *songQueue) SetStartTime(startTime time.Time) {
+	q.mu.Lock()
+	q.startTime = startTime
+	q.notifyLocked()
+	q.mu.Unlock()
+}
+
+func (q *songQueue) Library() []*song {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	library := make([]*song, len(q.library))
+	copy(library, q.library)
+	return library
+}
+
+// Add puts a new song into the library and the end of the queue.
+// It returns the library ID of the song.
+func (q *songQueue) Add(s *song) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.library = append(q.library, s)
+	q.stopped = false
+	q.appendSongLocked(s)
+	q.notifyLocked()
+	return len(q.library) - 1
+}
+
+// AddToLibrary puts a new song into the library without queuing it.
+func (q *songQueue) AddToLibrary(s *song) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.library = append(q.library, s)
+	return len(q.library) - 1
+}
+
+// Enqueue puts a song from the library to the end of the queue.
+func (q *songQueue) Enqueue(libraryID int) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if libraryID < 0 || libraryID >= len(q.library) {
+		return false
+	}
+	q.stopped = false
+	q.appendSongLocked(q.library[libraryID])
+	q.notifyLocked()
+	return true
+}
+
+// Get returns the i-th song in the schedule, waiting until shortly before it starts.
+func (q *songQueue) Get(i int) (scheduledSong, bool) {
+	q.mu.Lock()
+	for i >= len(q.items) {
+		if q.Loop && len(q.library) != 0 && !q.stopped {
+			q.appendRound(nil)
+			continue
+		}
+		if q.closed {
+			q.mu.Unlock()
+			return scheduledSong{}, false
+		}
+		changed := q.changed
+		q.mu.Unlock()
+		<-changed
+		q.mu.Lock()
+	}
+	q.mu.Unlock()
+
+	q.WaitUntil(i, -queueFetchAhead)
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return *q.items[i], true
+}
+
+// WaitUntil waits until the playback clock reaches offset into the i-th song.
+// It returns false if the song is skipped or removed from the queue.
+func (q *songQueue) WaitUntil(i int, offset time.Duration) bool {
+	for {
+		q.mu.Lock()
+		item := q.items[i]
+		if item.Skipped {
+			q.mu.Unlock()
+			return false
+		}
+		changed := q.changed
+		stopped := q.startTime.IsZero() || q.paused
+		remaining := item.Start + offset - q.elapsedLocked()
+		q.mu.Unlock()
+
+		if stopped {
+			<-changed
+			continue
+		}
+		if remaining <= 0 {
+			return true
+		}
+		timer := time.NewTimer(remaining)
+		select {
+		case <-timer.C:
+		case <-changed:
+			timer.Stop()
+		}
+	}
+}
+
+// Elapsed returns the time on the playback clock.
+func (q *songQueue) Elapsed() time.Duration {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.elapsedLocked()
+}
+
+func (q *songQueue) Pause() {
+	q.mu.Lock()
+	if !q.paused {
+		q.paused = true
+		q.pausedAt = time.Now()
+		q.notifyLocked()
+	}
+	q.mu.Unlock()
+}
+
+func (q *songQueue) Resume() {
+	q.mu.Lock()
+	if q.stopped {
+		q.stopped = false
+		q.notifyLocked()
+	}
+	if q.paused {
+		q.paused = false
+		q.pausedTotal += time.Since(q.pausedAt)
+		q.notifyLocked()
+	}
+	q.mu.Unlock()
+}
+
+// Skip stops the song currently playing, and the next one starts right away.
+func (q *songQueue) Skip() {
+	q.mu.Lock()
+	current := q.currentLocked()
+	if current >= 0 {
+		q.items[current].Skipped = true
+		q.rescheduleLocked(current + 1)
+		q.notifyLocked()
+	}
+	q.mu.Unlock()
+}
+
+// Remove takes the i-th song out of the queue if it has not started yet.
+func (q *songQueue) Remove(i int) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if i < 0 || i >= len(q.items) || q.items[i].Skipped || i <= q.currentLocked() {
+		return false
+	}
+	q.items[i].Skipped = true
+	q.rescheduleLocked(i)
+	q.notifyLocked()
+	return true
+}
+
+// Stop skips the song currently playing and removes all songs after it.
+func (q *songQueue) Stop() {
+	q.mu.Lock()
+	current := q.currentLocked()
+	for i := range q.items {
+		if i >= current {
+			q.items[i].Skipped = true
+		}
+	}
+	q.end = q.elapsedLocked()
+	q.stopped = true
+	q.notifyLocked()
+	q.mu.Unlock()
+}
+
+func (q *songQueue) Status() queueStatus {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	status := queueStatus{
+		Items:   make([]scheduledSong, len(q.items)),
+		Current: q.currentLocked(),
+		Elapsed: q.elapsedLocked(),
+		Paused:  q.paused,
+	}
+	for i, item := range q.items {
+		status.Items[i] = *item
+	}
+	return status
+}
+
+func (q *songQueue) notifyLocked() {
+	close(q.changed)
+	q.changed = make(chan struct{})
+}
+
+func (q *songQueue) elapsedLocked() time.Duration {
+	if q.startTime.IsZero() {
+		return 0
+	}
+	now := time.Now()
+	if q.paused {
+		now = q.pausedAt
+	}
+	return now.Sub(q.startTime) - q.pausedTotal
+}
+
+// Returns the index of the song playing now, or the last song played, or -1.
+func (q *songQueue) currentLocked() int {
+	if q.startTime.IsZero() {
+		return -1
+	}
+	elapsed := q.elapsedLocked()
+	current := -1
+	for i, item := range q.items {
+		if item.Start > elapsed {
+			break
+		}
+		if !item.Skipped {
+			current = i
+		}
+	}
+	return current
+}
+
+// Move songs from the i-th on to start as early as possible.
+func (q *songQueue) rescheduleLocked(i int) {
+	q.end = q.elapsedLocked() + q.LeadTime
+	for j := i - 1; j >= 0; j-- {
+		if !q.items[j].Skipped {
+			end := q.items[j].Start + q.items[j].Song.Duration + q.items[j].Song.Gap
+			if end > q.end {
+				q.end = end
+			}
+			break
+		}
+	}
+	for _, item := range q.items[i:] {
+		if item.Skipped {
+			continue
+		}
+		item.Start = q.end
+		q.end += item.Song.Duration + item.Song.Gap
+	}
+}
+
+// Must be called with q.mu locked, or before the queue is shared.
+func (q *songQueue) appendRound(songs []*song) {
+	q.library = append(q.library, songs...)
+	round := make([]*song, len(q.library))
+	copy(round, q.library)
+	if q.Shuffle {
+		rand.Shuffle(len(round), func(i, j int) {
+			round[i], round[j] = round[j], round[i]
+		})
+	}
+	for _, s := range round {
+		q.appendSongLocked(s)
+	}
+}
+
+func (q *songQueue) appendSongLocked(s *song) {
+	// If the orchestra has been idle, do not schedule the song in the past
+	if !q.startTime.IsZero() {
+		earliest := q.elapsedLocked() + q.LeadTime
+		if q.end < earliest {
+			q.end = earliest
+		}
+	}
+	for repeat := 0; repeat < s.Repeat; repeat++ {
+		q.items = append(q.items, &scheduledSong{
+			Song:  s,
+			Start: q.end,
+		})
+		q.end += s.Duration + s.Gap
+	}
+}
@@ -0,0 +1,163 @@
+/*
+  MIT License
+  Copyright (c) 2020 Star Brilliant
+  Permission is hereby granted, free of charge, to any person obtaining a copy
+  of this software and associated documentation files (the "Software"), to deal
+  in the Software without restriction, including without limitation the rights
+  to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+  copies of the Software, and to permit persons to whom the Software is
+  furnished to do so, subject to the following conditions:
+  The above copyright notice and this permission notice shall be included in
+  all copies or substantial portions of the Software.
+  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+  AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+  LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+  OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+  SOFTWARE.
+*/
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+)
+
+type replayNote struct {
+	Time        time.Duration
+	Frequency   float64
+	LengthMilli int64
+	// Empty in transcripts written before the tones were logged
+	Tones []tone
+}
+
+// replay plays a transcript written with "-log-format json", sending the recorded notes to the same connections.
+func (app *application) runReplay(args []string) {
+	flags := flag.NewFlagSet("replay", flag.ExitOnError)
+	timing := flags.String("timing", "sent", "Use the \"sent\" or \"scheduled\" time of each note in the transcript")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		fmt.Println()
+		fmt.Println("Please specify which transcript file to replay.")
+		os.Exit(1)
+	}
+	if *timing != "sent" && *timing != "scheduled" {
+		fmt.Printf("Unknown timing %q, must be \"sent\" or \"scheduled\"\n", *timing)
+		os.Exit(1)
+	}
+
+	app.loadConfig()
+	app.loadKnownHosts()
+
+	fmt.Printf("Loading transcript: %s\n", flags.Arg(0))
+	notes, err := app.loadTranscript(flags.Arg(0), *timing == "scheduled")
+	if err != nil {
+		fmt.Printf("Failed to load transcript: %v\n", err)
+		os.Exit(1)
+	}
+	app.replay = make(map[string][]replayNote)
+	for _, connConf := range app.conf.Connections {
+		app.replay[connConf.Name] = []replayNote{}
+	}
+	for hostname, hostNotes := range notes {
+		if _, ok := app.replay[hostname]; !ok {
+			fmt.Printf("Warning: connection %q in transcript is not configured, %d notes ignored\n", hostname, len(hostNotes))
+			continue
+		}
+		app.replay[hostname] = hostNotes
+	}
+
+	queue := newSongQueue(nil, false, false)
+	queue.Close()
+	app.play(queue, nil)
+}
+
+func (app *application) loadTranscript(filename string, useScheduled bool) (map[string][]replayNote, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	notes := make(map[string][]replayNote)
+	sc := bufio.NewScanner(f)
+	sc.Buffer(nil, 1<<20)
+	for line := 1; sc.Scan(); line++ {
+		var rec logRecord
+		err := json.Unmarshal(sc.Bytes(), &rec)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		if rec.Type != "note" || rec.Sent == nil || rec.Scheduled == nil {
+			continue
+		}
+		t := *rec.Sent
+		if useScheduled {
+			t = *rec.Scheduled
+		}
+		n := replayNote{
+			Time:        time.Duration(t * float64(time.Second)),
+			Frequency:   rec.Frequency,
+			LengthMilli: rec.LengthMilli,
+		}
+		for _, r := range rec.Tones {
+			n.Tones = append(n.Tones, r.Tone())
+		}
+		notes[rec.Hostname] = append(notes[rec.Hostname], n)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	for _, hostNotes := range notes {
+		sort.SliceStable(hostNotes, func(i, j int) bool {
+			return hostNotes[i].Time < hostNotes[j].Time
+		})
+	}
+	return notes, nil
+}
+
+func (c *connection) replay(startTime time.Time) error {
+	c.Status.SetSong("(replay)")
+	defer c.Status.SetSong("")
+	for _, n := range c.Replay {
+		time.Sleep(time.Until(startTime.Add(n.Time)))
+		// The notes are played again instead of sending the same commands, in case the driver is changed
+		tones := n.Tones
+		if len(tones) == 0 {
+			tones = []tone{{Frequency: n.Frequency, Length: time.Duration(n.LengthMilli) * time.Millisecond}}
+		}
+		command, err := c.Instrument.Play(tones)
+		if err != nil {
+			return err
+		}
+		sent := time.Since(startTime)
+		c.Status.NoteSent(n.Frequency, "", time.Duration(n.LengthMilli)*time.Millisecond, sent-n.Time)
+		c.EventLog.Note(noteRecord{
+			Hostname:    c.ConnConf.Name,
+			QueueID:     -1,
+			TrackID:     -1,
+			Frequency:   n.Frequency,
+			LengthMilli: n.LengthMilli,
+			Tones:       tones,
+			Scheduled:   n.Time,
+			Sent:        sent,
+			Command:     command,
+		})
+		select {
+		case c.DebugChanNote <- debugEventNote{
+			Hostname:    c.ConnConf.Name,
+			Frequency:   n.Frequency,
+			LengthMilli: n.LengthMilli,
+		}:
+		default:
+		}
+	}
+	return nil
+}
@@ -0,0 +1,144 @@
+/*
+  MIT License
+  Copyright (c) 2020 Star Brilliant
+  Permission is hereby granted, free of charge, to any person obtaining a copy
+  of this software and associated documentation files (the "Software"), to deal
+  in the Software without restriction, including without limitation the rights
+  to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+  copies of the Software, and to permit persons to whom the Software is
+  furnished to do so, subject to the following conditions:
+  The above copyright notice and this permission notice shall be included in
+  all copies or substantial portions of the Software.
+  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+  AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+  LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+  OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+  SOFTWARE.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// rtpMIDISession accepts AppleMIDI sessions, as used by macOS, iOS and rtpMIDI on Windows.
+// The control port receives invitations, and the data port right after it receives MIDI.
+type rtpMIDISession struct {
+	app       *application
+	name      string
+	ssrc      uint32
+	startTime time.Time
+
+	mu      sync.Mutex
+	parsers map[uint32]*midiStreamParser
+}
+
+func newRTPMIDISession(app *application, name string) *rtpMIDISession {
+	return &rtpMIDISession{
+		app:       app,
+		name:      name,
+		ssrc:      rand.Uint32(),
+		startTime: time.Now(),
+		parsers:   make(map[uint32]*midiStreamParser),
+	}
+}
+
+func (s *rtpMIDISession) Serve(control, data *net.UDPConn) {
+	go s.servePort(control, false)
+	s.servePort(data, true)
+}
+
+func (s *rtpMIDISession) servePort(conn *net.UDPConn, isData bool) {
+	buf := make([]byte, 65536)
+	for {
+		n, addr, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			s.app.debugChanMessage <- debugEventMessage{
+				Message: fmt.Sprintf("RTP-MIDI: %v", err),
+			}
+			return
+		}
+		packet := buf[:n]
+		if len(packet) >= 4 && packet[0] == 0xff && packet[1] == 0xff {
+			s.handleCommand(conn, addr, packet, isData)
+			continue
+		}
+		if !isData || len(packet) < 12 {
+			continue
+		}
+		ssrc := binary.BigEndian.Uint32(packet[8:])
+		// Only this goroutine parses, so the parser is used outside the lock.
+		// Dispatch may wait for a slow router, which must not hold up invitations and other sessions.
+		s.mu.Lock()
+		p, ok := s.parsers[ssrc]
+		if !ok {
+			p = &midiStreamParser{}
+			s.parsers[ssrc] = p
+		}
+		s.mu.Unlock()
+		err = parseRTPMIDI(packet, p, s.app.live.Dispatch)
+		if err != nil {
+			s.app.debugChanMessage <- debugEventMessage{
+				Message: fmt.Sprintf("RTP-MIDI from %v: %v", addr, err),
+			}
+		}
+	}
+}
+
+func (s *rtpMIDISession) handleCommand(conn *net.UDPConn, addr *net.UDPAddr, packet []byte, isData bool) {
+	switch string(packet[2:4]) {
+	case "IN":
+		// Invitation: version, initiator token, SSRC, name
+		if len(packet) < 16 {
+			return
+		}
+		token := binary.BigEndian.Uint32(packet[8:])
+		name, _, _ := bytes.Cut(packet[16:], []byte{0})
+		reply := make([]byte, 16, 16+len(s.name)+1)
+		copy(reply, "\xff\xffOK")
+		binary.BigEndian.PutUint32(reply[4:], 2)
+		binary.BigEndian.PutUint32(reply[8:], token)
+		binary.BigEndian.PutUint32(reply[12:], s.ssrc)
+		reply = append(reply, s.name...)
+		reply = append(reply, 0)
+		conn.WriteToUDP(reply, addr)
+		if isData {
+			s.app.debugChanMessage <- debugEventMessage{
+				Message: fmt.Sprintf("RTP-MIDI session started by %q (%v)", name, addr),
+			}
+		}
+	case "BY":
+		if len(packet) < 16 {
+			return
+		}
+		ssrc := binary.BigEndian.Uint32(packet[12:])
+		s.mu.Lock()
+		delete(s.parsers, ssrc)
+		s.mu.Unlock()
+		if !isData {
+			s.app.debugChanMessage <- debugEventMessage{
+				Message: fmt.Sprintf("RTP-MIDI session ended by %v", addr),
+			}
+		}
+	case "CK":
+		// Clock synchronization: SSRC, count, padding, then three timestamps in units of 100 microseconds
+		if len(packet) < 36 || packet[8] != 0 {
+			return
+		}
+		reply := make([]byte, 36)
+		copy(reply, packet)
+		binary.BigEndian.PutUint32(reply[4:], s.ssrc)
+		reply[8] = 1
+		binary.BigEndian.PutUint64(reply[20:], uint64(time.Since(s.startTime)/(100*time.Microsecond)))
+		conn.WriteToUDP(reply, addr)
+	}
+}
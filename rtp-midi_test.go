@@ -0,0 +1,126 @@
+/*
+  MIT License
+  Copyright (c) 2020 Star Brilliant
+  Permission is hereby granted, free of charge, to any person obtaining a copy
+  of this software and associated documentation files (the "Software"), to deal
+  in the Software without restriction, including without limitation the rights
+  to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+  copies of the Software, and to permit persons to whom the Software is
+  furnished to do so, subject to the following conditions:
+  The above copyright notice and this permission notice shall be included in
+  all copies or substantial portions of the Software.
+  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+  AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+  LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+  OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+  SOFTWARE.
+*/
+
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+// A router falling behind blocks the data port, but not the control port of the session.
+func TestRTPMIDISlowRouter(t *testing.T) {
+	app := &application{conf: config{
+		Connections:        []*connConfig{{Name: "A", Tracks: connTracksConfig{OtherTracks: true}}},
+		OtherTracksDefined: true,
+	}}
+	app.live = newLiveRouter(&app.conf)
+	messages := make(chan debugEventMessage)
+	app.debugChanMessage = messages
+	go func() {
+		for range messages {
+		}
+	}()
+
+	listen := func() *net.UDPConn {
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return conn
+	}
+	control, data := listen(), listen()
+	session := newRTPMIDISession(app, "test")
+	go session.Serve(control, data)
+	defer func() {
+		control.Close()
+		data.Close()
+		// Let the data port finish its last event
+		go func() {
+			for range app.live.outputs[0] {
+			}
+		}()
+	}()
+	client, err := net.DialUDP("udp", nil, data.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	// Nobody reads the output, so it fills up and the next pitch wheel change waits
+	const ssrc = 1
+	for i := 0; i <= liveBufferSize; i++ {
+		packet := make([]byte, 12, 16)
+		packet[0], packet[1] = 0x80, 0x61
+		binary.BigEndian.PutUint16(packet[2:], uint16(i))
+		binary.BigEndian.PutUint32(packet[8:], ssrc)
+		packet = append(packet, 3, 0xe0, 0x00, 0x40)
+		_, err := client.Write(packet)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Keep the socket buffer from overflowing
+		if i%32 == 0 {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for len(app.live.outputs[0]) != liveBufferSize {
+		if time.Now().After(deadline) {
+			t.Fatalf("only %d events arrived", len(app.live.outputs[0]))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Ending the session goes through the control port
+	bye := make([]byte, 16)
+	copy(bye, "\xff\xffBY")
+	binary.BigEndian.PutUint32(bye[4:], 2)
+	binary.BigEndian.PutUint32(bye[12:], ssrc)
+	byeClient, err := net.DialUDP("udp", nil, control.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer byeClient.Close()
+	_, err = byeClient.Write(bye)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ended := make(chan struct{})
+	go func() {
+		for {
+			session.mu.Lock()
+			_, ok := session.parsers[ssrc]
+			session.mu.Unlock()
+			if !ok {
+				close(ended)
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}()
+	select {
+	case <-ended:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the control port is stuck behind the slow router")
+	}
+}
@@ -0,0 +1,85 @@
+/*
+  MIT License
+  Copyright (c) 2020 Star Brilliant
+  Permission is hereby granted, free of charge, to any person obtaining a copy
+  of this software and associated documentation files (the "Software"), to deal
+  in the Software without restriction, including without limitation the rights
+  to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+  copies of the Software, and to permit persons to whom the Software is
+  furnished to do so, subject to the following conditions:
+  The above copyright notice and this permission notice shall be included in
+  all copies or substantial portions of the Software.
+  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+  AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+  LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+  OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+  SOFTWARE.
+*/
+
+package main
+
+import (
+	"io"
+	"time"
+)
+
+// The most SSH sessions opened to one router
+const maxSessions = 16
+
+// sessionPool spreads commands over the shells of one SSH connection,
+// so a note does not wait behind a shell still running the :delay of the last one.
+type sessionPool struct {
+	stdins []io.Writer
+	// When each shell is expected to have finished its commands
+	busyUntil []time.Time
+	next      int
+}
+
+func newSessionPool(stdins []io.Writer) *sessionPool {
+	return &sessionPool{
+		stdins:    stdins,
+		busyUntil: make([]time.Time, len(stdins)),
+	}
+}
+
+// Write sends the command to the first shell which is not busy, taking turns.
+// If every shell is busy, the pool is saturated, and the shell to finish first gets the command.
+func (p *sessionPool) Write(command string, busy time.Duration) (saturated bool, err error) {
+	now := time.Now()
+	chosen := -1
+	for i := range p.stdins {
+		j := (p.next + i) % len(p.stdins)
+		if !p.busyUntil[j].After(now) {
+			chosen = j
+			break
+		}
+	}
+	start := now
+	if chosen < 0 {
+		saturated = true
+		chosen = p.next
+		for j := range p.stdins {
+			if p.busyUntil[j].Before(p.busyUntil[chosen]) {
+				chosen = j
+			}
+		}
+		start = p.busyUntil[chosen]
+	}
+	p.next = (chosen + 1) % len(p.stdins)
+	p.busyUntil[chosen] = start.Add(busy)
+	_, err = io.WriteString(p.stdins[chosen], command)
+	return saturated, err
+}
+
+// WriteAll sends the command to every shell, such as to set it up.
+func (p *sessionPool) WriteAll(command string) error {
+	for _, stdin := range p.stdins {
+		_, err := io.WriteString(stdin, command)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
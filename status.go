@@ -0,0 +1,189 @@
+/*
+  MIT License
+  Copyright (c) 2020 Star Brilliant
+  Permission is hereby granted, free of charge, to any person obtaining a copy
+  of this software and associated documentation files (the "Software"), to deal
+  in the Software without restriction, including without limitation the rights
+  to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+  copies of the Software, and to permit persons to whom the Software is
+  furnished to do so, subject to the following conditions:
+  The above copyright notice and this permission notice shall be included in
+  all copies or substantial portions of the Software.
+  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+  AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+  LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+  OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+  SOFTWARE.
+*/
+
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// A connection is lagging if a note was sent this late within the last few seconds.
+const (
+	lagThreshold = 100 * time.Millisecond
+	lagMemory    = 3 * time.Second
+)
+
+const (
+	connStateConnecting = "connecting"
+	connStateConnected  = "connected"
+	connStatePlaying    = "playing"
+	connStateLagging    = "lagging"
+	connStateClosed     = "closed"
+	connStateFailed     = "failed"
+)
+
+const (
+	dropReasonEmpty = "empty"
+	dropReasonLate  = "late"
+	dropReasonQuiet = "quiet"
+)
+
+// Upper bounds of the lateness histogram, in seconds.
+var latenessBuckets = []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1}
+
+// connectionStatus is updated by a connection and read by the user interfaces.
+type connectionStatus struct {
+	mu   sync.Mutex
+	info connectionInfo
+}
+
+type connectionInfo struct {
+	Name          string
+	State         string
+	Error         string
+	Song          string
+	NotesSent     int64
+	LastFrequency float64
+	LastNote      string
+	LastNoteTime  time.Time
+	LastNoteEnd   time.Time
+	Lateness      time.Duration
+	LastLagTime   time.Time
+	Reconnects    int64
+	// Connections lost and reconnections failed, which are only survived with ReconnectDelay
+	Failures      int64
+	Dropped       map[string]int64
+	Substitutions int64
+	// Commands written to the SSH sessions, and how many found every session busy
+	SessionCommands  int64
+	SessionSaturated int64
+	// LatenessCounts[i] counts notes no later than latenessBuckets[i], the last one counts all notes.
+	LatenessCounts []int64
+	LatenessSum    time.Duration
+}
+
+func newConnectionStatus(name string) *connectionStatus {
+	return &connectionStatus{
+		info: connectionInfo{
+			Name:           name,
+			State:          connStateConnecting,
+			Dropped:        make(map[string]int64),
+			LatenessCounts: make([]int64, len(latenessBuckets)+1),
+		},
+	}
+}
+
+func (s *connectionStatus) SetState(state string) {
+	s.mu.Lock()
+	s.info.State = state
+	s.mu.Unlock()
+}
+
+func (s *connectionStatus) SetError(err error) {
+	s.mu.Lock()
+	s.info.State = connStateFailed
+	s.info.Error = err.Error()
+	s.mu.Unlock()
+}
+
+func (s *connectionStatus) SetSong(filename string) {
+	s.mu.Lock()
+	s.info.Song = filename
+	if filename != "" {
+		s.info.State = connStatePlaying
+	} else if s.info.State == connStatePlaying {
+		s.info.State = connStateConnected
+	}
+	s.mu.Unlock()
+}
+
+// Lateness is how much later the note was sent than scheduled.
+func (s *connectionStatus) NoteSent(frequency float64, name string, length, lateness time.Duration) {
+	now := time.Now()
+	s.mu.Lock()
+	s.info.NotesSent++
+	s.info.LastFrequency = frequency
+	s.info.LastNote = name
+	s.info.LastNoteTime = now
+	s.info.LastNoteEnd = now.Add(length)
+	s.info.Lateness = lateness
+	if lateness > lagThreshold {
+		s.info.LastLagTime = now
+	}
+	for i, bound := range latenessBuckets {
+		if lateness.Seconds() <= bound {
+			s.info.LatenessCounts[i]++
+		}
+	}
+	s.info.LatenessCounts[len(latenessBuckets)]++
+	s.info.LatenessSum += lateness
+	s.mu.Unlock()
+}
+
+func (s *connectionStatus) NoteDropped(reason string) {
+	s.mu.Lock()
+	s.info.Dropped[reason]++
+	s.mu.Unlock()
+}
+
+func (s *connectionStatus) FrequencySubstituted() {
+	s.mu.Lock()
+	s.info.Substitutions++
+	s.mu.Unlock()
+}
+
+func (s *connectionStatus) SessionCommand(saturated bool) {
+	s.mu.Lock()
+	s.info.SessionCommands++
+	if saturated {
+		s.info.SessionSaturated++
+	}
+	s.mu.Unlock()
+}
+
+func (s *connectionStatus) ConnectionFailed(err error) {
+	s.mu.Lock()
+	s.info.Failures++
+	s.info.Error = err.Error()
+	s.mu.Unlock()
+}
+
+func (s *connectionStatus) Reconnected() {
+	s.mu.Lock()
+	s.info.Reconnects++
+	s.info.Error = ""
+	s.mu.Unlock()
+}
+
+func (s *connectionStatus) Info() connectionInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	info := s.info
+	info.Dropped = make(map[string]int64, len(s.info.Dropped))
+	for reason, count := range s.info.Dropped {
+		info.Dropped[reason] = count
+	}
+	info.LatenessCounts = append([]int64(nil), s.info.LatenessCounts...)
+	if info.State == connStatePlaying && !info.LastLagTime.IsZero() && time.Since(info.LastLagTime) < lagMemory {
+		info.State = connStateLagging
+	}
+	return info
+}
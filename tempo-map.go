@@ -0,0 +1,166 @@
+/*
+  MIT License
+  Copyright (c) 2020 Star Brilliant
+  Permission is hereby granted, free of charge, to any person obtaining a copy
+  of this software and associated documentation files (the "Software"), to deal
+  in the Software without restriction, including without limitation the rights
+  to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+  copies of the Software, and to permit persons to whom the Software is
+  furnished to do so, subject to the following conditions:
+  The above copyright notice and this permission notice shall be included in
+  all copies or substantial portions of the Software.
+  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+  AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+  LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+  OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+  SOFTWARE.
+*/
+
+package main
+
+import (
+	"sort"
+	"time"
+
+	"github.com/m13253/midimark"
+)
+
+// Used when the header says 0 ticks per quarter note, which would otherwise divide by zero
+const fallbackDivision = 96
+
+// tempoMap converts ticks into time from the start of a song.
+type tempoMap struct {
+	// Ticks per quarter note, or ticks per frame for SMPTE timing
+	division int64
+	// Non-zero for SMPTE timing, which ignores tempo changes
+	framesPerSecond float64
+	// Sorted by tick, the first one is at tick 0
+	segments []tempoSegment
+	// Where the track starts when format 2 patterns are played one after another
+	offset time.Duration
+}
+
+type tempoSegment struct {
+	tick         int64
+	start        time.Duration
+	usPerQuarter int64
+}
+
+// tempoMaps holds the tempo map of each track of a sequence.
+// In format 0 and 1, the tempo changes in track 0, the conductor track, apply to all tracks.
+// Only if track 0 has none, tempo changes in the other tracks are used instead.
+// In format 2, each track is an independent pattern with its own tempo,
+// and the patterns are played one after another in the order of patterns.
+type tempoMaps map[*midimark.MTrk]*tempoMap
+
+func newTempoMaps(seq *midimark.Sequence, patterns []int) tempoMaps {
+	maps := make(tempoMaps, len(seq.Tracks))
+	if seq.Header.Format == 2 {
+		for _, mtrk := range seq.Tracks {
+			maps[mtrk] = newTempoMap(seq.Header, []*midimark.MTrk{mtrk})
+		}
+		offset := time.Duration(0)
+		for _, trackID := range patterns {
+			mtrk := seq.Tracks[trackID]
+			maps[mtrk].offset = offset
+			if len(mtrk.Events) != 0 {
+				offset = maps.Duration(mtrk, mtrk.Events[len(mtrk.Events)-1].Common().AbsTick)
+			}
+		}
+		return maps
+	}
+	tracks := seq.Tracks
+	if len(tracks) != 0 && hasTempoChanges(tracks[0]) {
+		tracks = tracks[:1]
+	}
+	shared := newTempoMap(seq.Header, tracks)
+	for _, mtrk := range seq.Tracks {
+		maps[mtrk] = shared
+	}
+	return maps
+}
+
+func hasTempoChanges(mtrk *midimark.MTrk) bool {
+	for _, event := range mtrk.Events {
+		if event, ok := event.(*midimark.MetaEventSetTempo); ok && event.UsPerQuarter != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func (maps tempoMaps) Duration(mtrk *midimark.MTrk, absTick int64) time.Duration {
+	return maps[mtrk].Duration(absTick)
+}
+
+func newTempoMap(header *midimark.MThd, tracks []*midimark.MTrk) *tempoMap {
+	m := &tempoMap{
+		division: int64(header.Division),
+	}
+	if m.division == 0 {
+		m.division = fallbackDivision
+	}
+	if header.Framerate != 0 {
+		m.framesPerSecond = float64(header.Framerate)
+		if header.Framerate == 29 {
+			// 30 drop frame
+			m.framesPerSecond = 30000.0 / 1001.0
+		}
+		return m
+	}
+
+	type change struct {
+		tick         int64
+		position     int64
+		usPerQuarter int64
+	}
+	var changes []change
+	for _, mtrk := range tracks {
+		for _, event := range mtrk.Events {
+			if event, ok := event.(*midimark.MetaEventSetTempo); ok && event.UsPerQuarter != 0 {
+				changes = append(changes, change{event.AbsTick, event.FilePosition, int64(event.UsPerQuarter)})
+			}
+		}
+	}
+	// At the same tick, the change appearing later in the file wins
+	sort.SliceStable(changes, func(i, j int) bool {
+		return changes[i].tick < changes[j].tick || (changes[i].tick == changes[j].tick && changes[i].position < changes[j].position)
+	})
+
+	// 120 beats per minute until the first change
+	m.segments = []tempoSegment{{usPerQuarter: 500000}}
+	for _, c := range changes {
+		last := &m.segments[len(m.segments)-1]
+		if c.tick == last.tick {
+			last.usPerQuarter = c.usPerQuarter
+			continue
+		}
+		m.segments = append(m.segments, tempoSegment{
+			tick:         c.tick,
+			start:        last.start + m.segmentDuration(last, c.tick),
+			usPerQuarter: c.usPerQuarter,
+		})
+	}
+	return m
+}
+
+func (m *tempoMap) Duration(absTick int64) time.Duration {
+	if m.framesPerSecond != 0 {
+		return m.offset + time.Duration(float64(absTick)*float64(time.Second)/(float64(m.division)*m.framesPerSecond))
+	}
+	// The last segment starting at or before absTick
+	i := sort.Search(len(m.segments), func(i int) bool {
+		return m.segments[i].tick > absTick
+	}) - 1
+	if i < 0 {
+		i = 0
+	}
+	return m.offset + m.segments[i].start + m.segmentDuration(&m.segments[i], absTick)
+}
+
+func (m *tempoMap) segmentDuration(segment *tempoSegment, absTick int64) time.Duration {
+	// Computed in nanoseconds to avoid rounding errors adding up
+	return time.Duration((absTick - segment.tick) * segment.usPerQuarter * int64(time.Microsecond) / m.division)
+}
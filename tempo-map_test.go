@@ -0,0 +1,294 @@
+/*
+  MIT License
+  Copyright (c) 2020 Star Brilliant
+  Permission is hereby granted, free of charge, to any person obtaining a copy
+  of this software and associated documentation files (the "Software"), to deal
+  in the Software without restriction, including without limitation the rights
+  to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+  copies of the Software, and to permit persons to whom the Software is
+  furnished to do so, subject to the following conditions:
+  The above copyright notice and this permission notice shall be included in
+  all copies or substantial portions of the Software.
+  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+  AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+  LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+  OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+  SOFTWARE.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"sort"
+	"testing"
+	"time"
+)
+
+// smfEvent is a raw event in a test track, at an absolute tick.
+type smfEvent struct {
+	tick int64
+	data []byte
+}
+
+func smfTempo(tick int64, usPerQuarter uint32) smfEvent {
+	return smfEvent{tick, []byte{0xff, 0x51, 0x03, byte(usPerQuarter >> 16), byte(usPerQuarter >> 8), byte(usPerQuarter)}}
+}
+
+func smfNote(tick, length int64, key byte) []smfEvent {
+	return []smfEvent{
+		{tick, []byte{0x90, key, 100}},
+		{tick + length, []byte{0x80, key, 0}},
+	}
+}
+
+// smfTrack encodes the events in order of tick, and adds the end of track.
+func smfTrack(events ...smfEvent) []byte {
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].tick < events[j].tick
+	})
+	var body []byte
+	last := int64(0)
+	for _, e := range events {
+		body = append(body, smfVarLen(e.tick-last)...)
+		body = append(body, e.data...)
+		last = e.tick
+	}
+	body = append(body, 0x00, 0xff, 0x2f, 0x00)
+	track := append([]byte("MTrk"), 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(track[4:], uint32(len(body)))
+	return append(track, body...)
+}
+
+func smfVarLen(n int64) []byte {
+	buf := []byte{byte(n & 0x7f)}
+	for n >>= 7; n != 0; n >>= 7 {
+		buf = append([]byte{byte(n&0x7f) | 0x80}, buf...)
+	}
+	return buf
+}
+
+// smfFile builds a standard MIDI file. For SMPTE timing, division is the upper byte
+// holding the negative frame rate and the lower byte holding the ticks per frame.
+func smfFile(format, division uint16, tracks ...[]byte) []byte {
+	header := []byte("MThd\x00\x00\x00\x06")
+	header = binary.BigEndian.AppendUint16(header, format)
+	header = binary.BigEndian.AppendUint16(header, uint16(len(tracks)))
+	header = binary.BigEndian.AppendUint16(header, division)
+	return append(header, bytes.Join(tracks, nil)...)
+}
+
+func smpteDivision(framerate int8, ticksPerFrame uint8) uint16 {
+	return uint16(uint8(-framerate))<<8 | uint16(ticksPerFrame)
+}
+
+func loadTestSong(t *testing.T, app *application, entry playlistEntry, file []byte) *song {
+	t.Helper()
+	seq, err := decodeSongFile(entry.Filename, bytes.NewReader(file), func(err error) {
+		t.Logf("%s: %v", entry.Filename, err)
+	})
+	if err != nil {
+		t.Fatalf("failed to decode %s: %v", entry.Filename, err)
+	}
+	s, err := app.newSong(entry, seq)
+	if err != nil {
+		t.Fatalf("failed to load %s: %v", entry.Filename, err)
+	}
+	return s
+}
+
+func smfEvents(events ...[]smfEvent) []smfEvent {
+	var result []smfEvent
+	for _, e := range events {
+		result = append(result, e...)
+	}
+	return result
+}
+
+func TestTempoMapDuration(t *testing.T) {
+	tests := []struct {
+		name     string
+		file     []byte
+		patterns []int
+		// The duration of each tick, per track
+		ticks    map[int]map[int64]time.Duration
+		duration time.Duration
+	}{
+		{
+			name: "format 0 at the default tempo",
+			file: smfFile(0, 96, smfTrack(smfNote(0, 384, 60)...)),
+			ticks: map[int]map[int64]time.Duration{
+				0: {0: 0, 96: 500 * time.Millisecond, 384: 2 * time.Second},
+			},
+			duration: 2 * time.Second,
+		},
+		{
+			name: "format 0 with a tempo change",
+			file: smfFile(0, 96, smfTrack(smfEvents(
+				[]smfEvent{smfTempo(0, 250000)},
+				smfNote(0, 96, 60),
+				[]smfEvent{smfTempo(192, 1000000)},
+				smfNote(192, 192, 62),
+			)...)),
+			ticks: map[int]map[int64]time.Duration{
+				0: {96: 250 * time.Millisecond, 192: 500 * time.Millisecond, 288: 1500 * time.Millisecond},
+			},
+			duration: 2500 * time.Millisecond,
+		},
+		{
+			name: "format 1 with tempo changes on the conductor track",
+			file: smfFile(1, 96,
+				smfTrack(smfTempo(0, 500000), smfTempo(384, 250000), smfTempo(576, 1000000)),
+				smfTrack(smfNote(0, 768, 60)...),
+				smfTrack(smfNote(96, 96, 64)...),
+			),
+			ticks: map[int]map[int64]time.Duration{
+				0: {384: 2 * time.Second, 576: 2500 * time.Millisecond},
+				1: {384: 2 * time.Second, 480: 2250 * time.Millisecond, 768: 4500 * time.Millisecond},
+				2: {96: 500 * time.Millisecond, 192: time.Second},
+			},
+			duration: 4500 * time.Millisecond,
+		},
+		{
+			name: "format 1 ignores a tempo change outside the conductor track",
+			file: smfFile(1, 96,
+				smfTrack(smfTempo(0, 1000000)),
+				smfTrack(smfEvents([]smfEvent{smfTempo(96, 500000)}, smfNote(0, 192, 60))...),
+				smfTrack(smfNote(0, 192, 64)...),
+			),
+			ticks: map[int]map[int64]time.Duration{
+				1: {96: time.Second, 192: 2 * time.Second},
+				2: {96: time.Second, 192: 2 * time.Second},
+			},
+			duration: 2 * time.Second,
+		},
+		{
+			name: "format 1 without tempo changes on the conductor track",
+			file: smfFile(1, 96,
+				smfTrack(),
+				smfTrack(smfEvents([]smfEvent{smfTempo(96, 1000000)}, smfNote(0, 192, 60))...),
+				smfTrack(smfNote(0, 192, 64)...),
+			),
+			ticks: map[int]map[int64]time.Duration{
+				2: {96: 500 * time.Millisecond, 192: 1500 * time.Millisecond},
+			},
+			duration: 1500 * time.Millisecond,
+		},
+		{
+			name: "format 2 patterns in file order",
+			file: smfFile(2, 96,
+				smfTrack(smfEvents([]smfEvent{smfTempo(0, 1000000)}, smfNote(0, 96, 60))...),
+				smfTrack(smfNote(0, 192, 62)...),
+				smfTrack(smfEvents([]smfEvent{smfTempo(0, 250000)}, smfNote(0, 384, 64))...),
+			),
+			ticks: map[int]map[int64]time.Duration{
+				0: {0: 0, 96: time.Second},
+				1: {0: time.Second, 96: 1500 * time.Millisecond, 192: 2 * time.Second},
+				2: {0: 2 * time.Second, 384: 3 * time.Second},
+			},
+			duration: 3 * time.Second,
+		},
+		{
+			name: "format 2 patterns in a chosen order",
+			file: smfFile(2, 96,
+				smfTrack(smfEvents([]smfEvent{smfTempo(0, 1000000)}, smfNote(0, 96, 60))...),
+				smfTrack(smfNote(0, 192, 62)...),
+				smfTrack(smfEvents([]smfEvent{smfTempo(0, 250000)}, smfNote(0, 384, 64))...),
+			),
+			patterns: []int{2, 0},
+			ticks: map[int]map[int64]time.Duration{
+				2: {0: 0, 384: time.Second},
+				0: {0: time.Second, 96: 2 * time.Second},
+			},
+			// The pattern left out does not count
+			duration: 2 * time.Second,
+		},
+		{
+			name: "SMPTE 24 frames per second ignores tempo changes",
+			file: smfFile(0, smpteDivision(24, 40), smfTrack(smfEvents([]smfEvent{smfTempo(0, 1000000)}, smfNote(0, 1200, 60))...)),
+			ticks: map[int]map[int64]time.Duration{
+				0: {40: time.Second / 24, 960: time.Second},
+			},
+			duration: 1250 * time.Millisecond,
+		},
+		{
+			name: "SMPTE 25 frames per second",
+			file: smfFile(0, smpteDivision(25, 40), smfTrack(smfNote(0, 1200, 60)...)),
+			ticks: map[int]map[int64]time.Duration{
+				0: {1000: time.Second},
+			},
+			duration: 1200 * time.Millisecond,
+		},
+		{
+			name: "SMPTE 29 frames per second is 30 drop frame",
+			file: smfFile(0, smpteDivision(29, 40), smfTrack(smfNote(0, 1200, 60)...)),
+			ticks: map[int]map[int64]time.Duration{
+				0: {1200: 1001 * time.Millisecond},
+			},
+			duration: 1001 * time.Millisecond,
+		},
+		{
+			name: "SMPTE 30 frames per second",
+			file: smfFile(1, smpteDivision(30, 80),
+				smfTrack(smfTempo(0, 250000)),
+				smfTrack(smfNote(0, 2400, 60)...),
+			),
+			ticks: map[int]map[int64]time.Duration{
+				0: {2400: time.Second},
+				1: {1200: 500 * time.Millisecond},
+			},
+			duration: time.Second,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			app := &application{}
+			entry := newPlaylistEntry("test.mid")
+			entry.Patterns = test.patterns
+			s := loadTestSong(t, app, entry, test.file)
+			for trackID, ticks := range test.ticks {
+				mtrk := s.Sequence.Tracks[trackID]
+				for tick, want := range ticks {
+					got := s.Tempo.Duration(mtrk, tick)
+					if !durationsClose(got, want) {
+						t.Errorf("track %d, tick %d: got %v, want %v", trackID, tick, got, want)
+					}
+				}
+			}
+			got := app.determineSongDuration(s)
+			if !durationsClose(got, test.duration) {
+				t.Errorf("song duration: got %v, want %v", got, test.duration)
+			}
+		})
+	}
+}
+
+func TestSongDurationSpeed(t *testing.T) {
+	app := &application{}
+	entry := newPlaylistEntry("test.mid")
+	entry.Speed = 2
+	s := loadTestSong(t, app, entry, smfFile(0, 96, smfTrack(smfNote(0, 384, 60)...)))
+	if got := app.determineSongDuration(s); got != 2*time.Second {
+		t.Errorf("duration before speed: got %v, want 2s", got)
+	}
+	if s.Duration != time.Second {
+		t.Errorf("duration at double speed: got %v, want 1s", s.Duration)
+	}
+}
+
+func TestTempoMapZeroDivision(t *testing.T) {
+	app := &application{}
+	s := loadTestSong(t, app, newPlaylistEntry("test.mid"), smfFile(0, 0, smfTrack(smfNote(0, fallbackDivision, 60)...)))
+	if got := app.determineSongDuration(s); got != 500*time.Millisecond {
+		t.Errorf("got %v, want 500ms at %d ticks per quarter note", got, fallbackDivision)
+	}
+}
+
+// SMPTE durations are computed in floating point, so they may be off by a nanosecond.
+func durationsClose(a, b time.Duration) bool {
+	d := a - b
+	return d >= -time.Microsecond && d <= time.Microsecond
+}
@@ -0,0 +1,186 @@
+/*
+  MIT License
+  Copyright (c) 2020 Star Brilliant
+  Permission is hereby granted, free of charge, to any person obtaining a copy
+  of this software and associated documentation files (the "Software"), to deal
+  in the Software without restriction, including without limitation the rights
+  to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+  copies of the Software, and to permit persons to whom the Software is
+  furnished to do so, subject to the following conditions:
+  The above copyright notice and this permission notice shall be included in
+  all copies or substantial portions of the Software.
+  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+  AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+  LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+  OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+  SOFTWARE.
+*/
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+var errHostKeyFetched = errors.New("host key fetched")
+
+// runTrust shows the host key of every configured router, and records the new ones in KnownHosts.
+func (app *application) runTrust(args []string) {
+	flags := flag.NewFlagSet("trust", flag.ExitOnError)
+	yes := flags.Bool("yes", false, "Record the new host keys without asking")
+	flags.Parse(args)
+
+	app.loadConfig()
+	store, err := newHostKeyStore(app.conf.KnownHosts, hostKeyPolicyAsk)
+	if err != nil {
+		fmt.Printf("Failed to load known_hosts: %v\n", err)
+		os.Exit(1)
+	}
+
+	t := &trustCheck{
+		store: store,
+		seen:  make(map[string]struct{}),
+	}
+	fmt.Println()
+	for _, connConf := range app.conf.Connections {
+		if connConf.Driver == driverLocal {
+			continue
+		}
+		t.checkConnection(connConf)
+	}
+	newKeys, failed := t.newKeys, t.failed
+
+	fmt.Println()
+	if len(newKeys) == 0 {
+		fmt.Println("No new host keys to record.")
+	} else if !*yes && !store.ask(fmt.Sprintf("Record %d new host keys in %s? [y/N] ", len(newKeys), store.filename)) {
+		fmt.Println("Host keys not recorded. Add -yes after \"trust\" to record them without asking.")
+	} else {
+		store.mu.Lock()
+		for _, k := range newKeys {
+			err := store.add(k.Addr, k.Key)
+			if err != nil {
+				fmt.Printf("Failed to record host key of %s: %v\n", k.Addr, err)
+				os.Exit(1)
+			}
+		}
+		store.mu.Unlock()
+		fmt.Printf("Recorded %d new host keys in %s.\n", len(newKeys), store.filename)
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// trustCheck collects the new host keys found by the trust command.
+type trustCheck struct {
+	store   *hostKeyStore
+	newKeys []trustedKey
+	// Several connections may share a router or jump host
+	seen   map[string]struct{}
+	failed bool
+}
+
+type trustedKey struct {
+	Addr string
+	Key  ssh.PublicKey
+}
+
+// Checks the jump hosts of a connection and then its router.
+// Hosts behind a jump host not trusted yet are not checked, because logging in to it would send the password.
+func (t *trustCheck) checkConnection(connConf *connConfig) {
+	chain := &jumpChain{}
+	defer chain.Close()
+	for _, jump := range connConf.Jumps {
+		label := fmt.Sprintf("[%s] jump host %s", connConf.Name, jump.Name)
+		if !t.checkHost(label, jump, chain.Last()) {
+			fmt.Printf("[%s] not checked behind jump host %s, run trust again after recording its key\n", connConf.Name, jump.Name)
+			return
+		}
+		sshConf := &ssh.ClientConfig{
+			User: jump.Username,
+			Auth: []ssh.AuthMethod{
+				ssh.Password(jump.Password),
+			},
+			HostKeyCallback: t.store.Callback(jump),
+			Timeout:         DefaultTimeout,
+		}
+		sshClient, err := dialThrough(chain.Last(), jump.address(), sshConf)
+		if err != nil {
+			fmt.Printf("%s: %v\n", label, err)
+			t.failed = true
+			return
+		}
+		chain.clients = append(chain.clients, sshClient)
+	}
+	t.checkHost(fmt.Sprintf("[%s]", connConf.Name), connConf, chain.Last())
+}
+
+// Shows the host key, and reports whether it is already trusted.
+func (t *trustCheck) checkHost(label string, hostConf *connConfig, through *ssh.Client) bool {
+	addr := hostConf.address()
+	key, remote, err := fetchHostKey(through, addr)
+	if err != nil {
+		fmt.Printf("%s %s: %v\n", label, addr, err)
+		t.failed = true
+		return false
+	}
+
+	fingerprint := ssh.FingerprintSHA256(key)
+	var status string
+	if hostConf.HostKeyFingerprint != "" {
+		err = checkFingerprint(key, hostConf.HostKeyFingerprint)
+		status = "pinned by HostKeyFingerprint"
+	} else {
+		err = t.store.known(addr, remote, key)
+		status = "known"
+		if isUnknownHost(err) {
+			if _, ok := t.seen[addr+" "+fingerprint]; !ok {
+				t.seen[addr+" "+fingerprint] = struct{}{}
+				t.newKeys = append(t.newKeys, trustedKey{addr, key})
+			}
+			fmt.Printf("%s %s %s %s: new\n", label, addr, key.Type(), fingerprint)
+			return false
+		}
+	}
+	var keyErr *knownhosts.KeyError
+	if errors.As(err, &keyErr) {
+		status = fmt.Sprintf("CHANGED, remove the old key from %s if this is expected", t.store.filename)
+		t.failed = true
+	} else if err != nil {
+		status = err.Error()
+		t.failed = true
+	}
+	fmt.Printf("%s %s %s %s: %s\n", label, addr, key.Type(), fingerprint, status)
+	return err == nil
+}
+
+// Connects only as far as the key exchange, which shows the host key without logging in.
+func fetchHostKey(through *ssh.Client, addr string) (ssh.PublicKey, net.Addr, error) {
+	var hostKey ssh.PublicKey
+	var remoteAddr net.Addr
+	sshConf := &ssh.ClientConfig{
+		HostKeyCallback: func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			hostKey, remoteAddr = key, remote
+			return errHostKeyFetched
+		},
+		Timeout: DefaultTimeout,
+	}
+	sshClient, err := dialThrough(through, addr, sshConf)
+	if err == nil {
+		sshClient.Close()
+	}
+	if hostKey == nil {
+		return nil, nil, err
+	}
+	return hostKey, remoteAddr, nil
+}
@@ -0,0 +1,307 @@
+/*
+  MIT License
+  Copyright (c) 2020 Star Brilliant
+  Permission is hereby granted, free of charge, to any person obtaining a copy
+  of this software and associated documentation files (the "Software"), to deal
+  in the Software without restriction, including without limitation the rights
+  to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+  copies of the Software, and to permit persons to whom the Software is
+  furnished to do so, subject to the following conditions:
+  The above copyright notice and this permission notice shall be included in
+  all copies or substantial portions of the Software.
+  THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+  IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+  FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+  AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+  LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+  OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+  SOFTWARE.
+*/
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/fatih/color"
+	"golang.org/x/term"
+)
+
+const (
+	tuiRefreshInterval = 100 * time.Millisecond
+	tuiPanelWidth      = 30
+	tuiMaxMessages     = 100
+)
+
+// tui draws a full-screen view with a panel for each connection, using plain ANSI escape sequences.
+type tui struct {
+	app      *application
+	events   chan interface{}
+	messages []string
+	stop     chan struct{}
+	stopped  sync.WaitGroup
+	stopOnce sync.Once
+
+	colorTitle   *color.Color
+	colorName    *color.Color
+	colorDim     *color.Color
+	colorNote    *color.Color
+	colorStates  map[string]*color.Color
+	colorBar     *color.Color
+	colorBarDone *color.Color
+}
+
+func (app *application) startTUI() {
+	if !term.IsTerminal(int(os.Stdout.Fd())) {
+		fmt.Println("Warning: standard output is not a terminal, TUI mode disabled")
+		return
+	}
+	t := &tui{
+		app:          app,
+		events:       app.events.Subscribe(256),
+		stop:         make(chan struct{}),
+		colorTitle:   color.New(color.FgCyan, color.Bold),
+		colorName:    color.New(color.FgCyan),
+		colorDim:     color.New(color.FgHiBlack),
+		colorNote:    color.New(color.FgMagenta, color.Bold),
+		colorBar:     color.New(color.FgGreen),
+		colorBarDone: color.New(color.FgHiBlack),
+		colorStates: map[string]*color.Color{
+			connStateConnecting: color.New(color.FgYellow),
+			connStateConnected:  color.New(color.FgBlue),
+			connStatePlaying:    color.New(color.FgGreen),
+			connStateLagging:    color.New(color.FgYellow, color.Bold),
+			connStateClosed:     color.New(color.FgHiBlack),
+			connStateFailed:     color.New(color.FgRed, color.Bold),
+		},
+	}
+	app.tuiMu.Lock()
+	app.tui = t
+	app.tuiMu.Unlock()
+
+	// Switch to the alternate screen and hide the cursor
+	fmt.Print("\x1b[?1049h\x1b[?25l")
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		_, ok := <-signals
+		if ok {
+			app.stopTUI()
+			os.Exit(1)
+		}
+	}()
+
+	t.stopped.Add(1)
+	go t.run()
+}
+
+// stopTUI restores the terminal. It is safe to call even if the TUI is not running.
+func (app *application) stopTUI() {
+	app.tuiMu.Lock()
+	t := app.tui
+	app.tui = nil
+	app.tuiMu.Unlock()
+	if t == nil {
+		return
+	}
+	t.stopOnce.Do(func() {
+		close(t.stop)
+		t.stopped.Wait()
+		app.events.Unsubscribe(t.events)
+		fmt.Print("\x1b[?25h\x1b[?1049l")
+		// Keep the recent messages visible after leaving the alternate screen
+		for _, msg := range t.messages {
+			fmt.Println(msg)
+		}
+	})
+}
+
+func (app *application) tuiActive() bool {
+	app.tuiMu.Lock()
+	defer app.tuiMu.Unlock()
+	return app.tui != nil
+}
+
+func (t *tui) run() {
+	defer t.stopped.Done()
+	ticker := time.NewTicker(tuiRefreshInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-t.stop:
+			return
+		case event := <-t.events:
+			if msg, ok := event.(debugEventMessage); ok {
+				line := msg.Message
+				if msg.Hostname != "" {
+					line = "[" + msg.Hostname + "] " + line
+				}
+				t.messages = append(t.messages, line)
+				if len(t.messages) > tuiMaxMessages {
+					t.messages = t.messages[len(t.messages)-tuiMaxMessages:]
+				}
+			}
+		case <-ticker.C:
+			t.draw()
+		}
+	}
+}
+
+func (t *tui) draw() {
+	width, height, err := term.GetSize(int(os.Stdout.Fd()))
+	if err != nil || width < 20 || height < 5 {
+		width, height = 80, 24
+	}
+	var lines []string
+
+	status := t.app.queue.Status()
+	total := time.Duration(0)
+	for _, item := range status.Items {
+		if !item.Skipped && item.Start+item.Song.Duration > total {
+			total = item.Start + item.Song.Duration
+		}
+	}
+	elapsed := status.Elapsed
+	if elapsed < 0 {
+		elapsed = 0
+	}
+	if elapsed > total {
+		elapsed = total
+	}
+
+	title := "MikroTiChestra"
+	songLine := "Waiting"
+	if status.Current >= 0 {
+		item := status.Items[status.Current]
+		if status.Elapsed < item.Start+item.Song.Duration {
+			songLine = fmt.Sprintf("%s (%d/%d)", item.Song.Filename, status.Current+1, len(status.Items))
+		} else {
+			songLine = "Idle"
+		}
+	}
+	if status.Paused {
+		songLine = "Paused: " + songLine
+	}
+	lines = append(lines, t.colorTitle.Sprint(title)+"  "+tuiTruncate(songLine, width-len(title)-2))
+
+	clock := fmt.Sprintf(" %s / %s", formatClock(elapsed), formatClock(total))
+	barWidth := width - len(clock) - 2
+	if barWidth < 10 {
+		barWidth = 10
+	}
+	done := 0
+	if total > 0 {
+		done = int(int64(barWidth) * int64(elapsed) / int64(total))
+	}
+	lines = append(lines, "["+t.colorBar.Sprint(strings.Repeat("#", done))+t.colorBarDone.Sprint(strings.Repeat("-", barWidth-done))+"]"+clock)
+	lines = append(lines, "")
+
+	columns := width / tuiPanelWidth
+	if columns < 1 {
+		columns = 1
+	}
+	for i := 0; i < len(t.app.statuses); i += columns {
+		var row [5]string
+		for j := i; j < i+columns && j < len(t.app.statuses); j++ {
+			panel := t.panel(t.app.statuses[j].Info())
+			for k := range row {
+				row[k] += panel[k]
+			}
+		}
+		lines = append(lines, row[:]...)
+	}
+	lines = append(lines, "")
+
+	if remaining := height - len(lines); remaining > 0 {
+		messages := t.messages
+		if len(messages) > remaining {
+			messages = messages[len(messages)-remaining:]
+		}
+		for _, msg := range messages {
+			lines = append(lines, t.colorDim.Sprint(tuiTruncate(msg, width)))
+		}
+	}
+	if len(lines) > height {
+		lines = lines[:height]
+	}
+
+	var sb strings.Builder
+	sb.WriteString("\x1b[H")
+	for i, line := range lines {
+		sb.WriteString(line)
+		sb.WriteString("\x1b[K")
+		if i != len(lines)-1 {
+			sb.WriteString("\r\n")
+		}
+	}
+	sb.WriteString("\x1b[J")
+	os.Stdout.WriteString(sb.String())
+}
+
+// Returns 5 lines, each tuiPanelWidth characters wide.
+func (t *tui) panel(info connectionInfo) [5]string {
+	inner := tuiPanelWidth - 4
+	name := tuiTruncate(info.Name, inner-2)
+	top := "┌ " + t.colorName.Sprint(name) + " " + strings.Repeat("─", inner-tuiLen(name)) + "┐ "
+
+	stateColor, ok := t.colorStates[info.State]
+	if !ok {
+		stateColor = t.colorDim
+	}
+	state := info.State
+	if info.State == connStateFailed && info.Error != "" {
+		state += ": " + info.Error
+	}
+	stateLine := stateColor.Sprint(tuiPad(state, inner))
+
+	noteLine := t.colorDim.Sprint(tuiPad("-", inner))
+	if info.LastNote != "" && time.Now().Before(info.LastNoteEnd) {
+		noteLine = t.colorNote.Sprint(tuiPad(fmt.Sprintf("♪ %-5s %6.0f Hz", info.LastNote, info.LastFrequency), inner))
+	}
+
+	stats := fmt.Sprintf("%d notes", info.NotesSent)
+	if info.NotesSent != 0 {
+		stats += fmt.Sprintf(", late %dms", info.Lateness.Milliseconds())
+	}
+	statsLine := t.colorDim.Sprint(tuiPad(stats, inner))
+
+	return [5]string{
+		top,
+		"│ " + stateLine + " │ ",
+		"│ " + noteLine + " │ ",
+		"│ " + statsLine + " │ ",
+		"└" + strings.Repeat("─", inner+2) + "┘ ",
+	}
+}
+
+func formatClock(d time.Duration) string {
+	seconds := int64(d / time.Second)
+	return fmt.Sprintf("%02d:%02d", seconds/60, seconds%60)
+}
+
+func tuiLen(s string) int {
+	return len([]rune(s))
+}
+
+func tuiTruncate(s string, width int) string {
+	if width <= 0 {
+		return ""
+	}
+	runes := []rune(s)
+	if len(runes) <= width {
+		return s
+	}
+	return string(runes[:width-1]) + "…"
+}
+
+func tuiPad(s string, width int) string {
+	s = tuiTruncate(s, width)
+	return s + strings.Repeat(" ", width-tuiLen(s))
+}
@@ -23,27 +23,28 @@ package main
 import "math"
 
 // Notes are tuned using Equal Temperament.
-// MikroTik restricts the frequency in 20 Hz - 20,000 Hz.
+// Instruments restrict the frequency, for example MikroTik in 20 Hz - 20,000 Hz.
 // Therefore, frequencies beyond this range are substituted using their harmonic series.
-func midiNoteToHertz(note float64) float64 {
+// The second return value tells whether the frequency is substituted.
+func midiNoteToHertz(note float64, caps instrumentCapabilities) (float64, bool) {
 	freq := 440 * math.Pow(2, (note-69)/12)
-	if freq < 20 {
-		if freq >= 20/3 {
-			return freq * 3
+	if freq < caps.MinFrequency {
+		if freq*3 >= caps.MinFrequency {
+			return freq * 3, true
 		}
-		if freq >= 4 {
-			return freq * 5
+		if freq*5 >= caps.MinFrequency {
+			return freq * 5, true
 		}
-		return 20
+		return caps.MinFrequency, true
 	}
-	if freq > 20000 {
-		if freq <= 60000 {
-			return freq / 3
+	if freq > caps.MaxFrequency {
+		if freq/3 <= caps.MaxFrequency {
+			return freq / 3, true
 		}
-		if freq <= 100000 {
-			return freq / 5
+		if freq/5 <= caps.MaxFrequency {
+			return freq / 5, true
 		}
-		return 20000
+		return caps.MaxFrequency, true
 	}
-	return freq
+	return freq, false
 }